@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -54,14 +55,28 @@ func parseYAML(filename string) map[string]interface{} {
 */
 var appName string
 
-func init() {
-	// 获取应用名称，默认为peer1
-	appname := flag.String("appname", "", "app name")
-	flag.Parse()
-	if len(*appname) == 0 {
+// 应用名称的启动参数，注册以后应用自己调用flag.Parse的时候也能识别
+var appNameFlag = flag.String("appname", "", "app name")
+
+var loadOnce sync.Once
+
+/*
+*
+读取应用的配置，第一次读取配置参数的时候调用，只读取一次
+应用名称来自启动参数appname，缺省为peer，这里不调用flag.Parse，
+包初始化的时候还没有注册测试和应用的其他启动参数，解析会因为不认识这些参数而退出
+*/
+func Load() {
+	loadOnce.Do(load)
+}
+
+func load() {
+	appName = *appNameFlag
+	if appName == "" {
+		appName = argValue(os.Args[1:], "appname")
+	}
+	if appName == "" {
 		appName = "peer"
-	} else {
-		appName = *appname
 	}
 
 	// 读取应用配置
@@ -81,11 +96,34 @@ func init() {
 	}
 }
 
+// 查找启动参数的值，支持-name value，--name value，-name=value和--name=value
+func argValue(args []string, name string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if arg == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"=")
+		}
+	}
+
+	return ""
+}
+
 func GetAppName() string {
+	Load()
 	return appName
 }
 
 func Get(name string) (interface{}, error) {
+	Load()
 	return get(name, appName)
 }
 
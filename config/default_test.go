@@ -0,0 +1,25 @@
+package config
+
+import "testing"
+
+func TestArgValue(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-appname", "peer1"}, "peer1"},
+		{[]string{"--appname", "peer1"}, "peer1"},
+		{[]string{"-appname=peer1"}, "peer1"},
+		{[]string{"-test.v", "--appname=peer1"}, "peer1"},
+		{[]string{"-test.v", "-test.run", "TestArgValue"}, ""},
+		{[]string{"-appname"}, ""},
+		{[]string{"appname", "peer1"}, ""},
+		{[]string{"--", "-appname", "peer1"}, ""},
+	}
+	for _, c := range cases {
+		got := argValue(c.args, "appname")
+		if got != c.want {
+			t.Fatalf("%v: %v", c.args, got)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,7 +29,8 @@ type consensusParams struct {
 	Selector       string
 }
 
-type databaseParams struct {
+type DbParams struct {
+	Name            string //数据库的名称，缺省数据库是空字符串
 	Drivername      string
 	Host            string
 	Port            string
@@ -46,9 +48,22 @@ type databaseParams struct {
 	Readtransaction bool
 	Orm             string
 	Dsn             string
-	Sequence        string //sequence的产生方式，缺省是seq，可选table
+	Sequence        string   //sequence的产生方式，缺省是seq，可选table
+	BatchSize       int      //流式查询每批读取的记录数，缺省是1000
+	InsertBatchSize int      //批量新增的时候一条INSERT语句的记录数，缺省是1000
+	InsertParallel  int      //批量新增的并发数，每个并发使用单独的事务，缺省是1
+	CopyThreshold   int      //postgres批量新增的记录数达到这个数量的时候使用COPY，缺省是10000，0表示不使用
+	Replicas        []string //只读副本的dsn列表，配置的时候用逗号分隔，读操作路由到副本
+	ReplicaCheck    int      //副本健康检查的间隔秒数，缺省是10
+	Tenant          string   //多租户的方式，column是共享表的租户字段，schema是每个租户一个schema，缺省不区分租户
+	Schema          string   //使用的schema，schema方式的租户数据库是租户的schema
 }
 
+const (
+	Tenant_Column = "column"
+	Tenant_Schema = "schema"
+)
+
 type searchParams struct {
 	Address               []string
 	Username              string
@@ -256,7 +271,7 @@ var AppParams = appParams{}
 
 var ServerWebsocketParams = serverWebsocketParams{}
 
-var DatabaseParams = databaseParams{}
+var DatabaseParams = DbParams{}
 
 var SearchParams = searchParams{}
 
@@ -360,36 +375,21 @@ func init() {
 	ServerParams.Password, _ = GetString("server.password")
 	ServerParams.Email, _ = GetString("server.email")
 
-	DatabaseParams.Drivername, _ = GetString("database.drivername", "postgres")
-	DatabaseParams.Dsn, _ = GetString("database.dsn")
-	DatabaseParams.Dbname, _ = GetString("database.dbname", "postgres")
-	DatabaseParams.Host, _ = GetString("database.host", "localhost")
-	DatabaseParams.Port, _ = GetString("database.port", "5432")
-	DatabaseParams.User, _ = GetString("database.user", "postgres")
-	DatabaseParams.Password, _ = GetString("database.password")
-	DatabaseParams.Readtransaction, _ = GetBool("database.readtransaction", false)
-	DatabaseParams.Sslmode, _ = GetString("database.sslmode")
-	DatabaseParams.TimeZone, _ = GetString("database.timeZone")
-	DatabaseParams.MaxIdleConns, _ = GetInt("database.maxIdleConns")
-	DatabaseParams.MaxOpenConns, _ = GetInt("database.maxOpenConns")
-	DatabaseParams.ConnMaxLifetime, _ = GetInt("database.connMaxLifetime")
-	DatabaseParams.ConnMaxIdleTime, _ = GetInt("database.connMaxIdleTime")
-	DatabaseParams.ShowSQL, _ = GetBool("database.showSQL", false)
-	DatabaseParams.Orm, _ = GetString("database.orm", "xorm")
-	DatabaseParams.Sequence, _ = GetString("database.sequence", "seq")
-	level, _ := GetString("database.logLevel", "info")
-	switch level {
-	case "debug":
-		DatabaseParams.LogLevel = 0
-	case "info":
-		DatabaseParams.LogLevel = 1
-	case "warn":
-		DatabaseParams.LogLevel = 2
-	case "error":
-		DatabaseParams.LogLevel = 3
-	case "off":
-		DatabaseParams.LogLevel = 4
-	}
+	loadDatabaseParams("database", &DatabaseParams, &DbParams{
+		Drivername:      "postgres",
+		Dbname:          "postgres",
+		Host:            "localhost",
+		Port:            "5432",
+		User:            "postgres",
+		Orm:             "xorm",
+		Sequence:        "seq",
+		LogLevel:        1,
+		BatchSize:       1000,
+		InsertBatchSize: 1000,
+		InsertParallel:  1,
+		CopyThreshold:   10000,
+		ReplicaCheck:    10,
+	})
 
 	SearchParams.Mode, _ = GetString("search.mode", "bleve")
 	if SearchParams.Mode == "default" || SearchParams.Mode == "elastic" {
@@ -555,3 +555,105 @@ func init() {
 	ImapServerParams.Addr, _ = GetString("mail.server.imap.addr", ":1143")
 	ImapServerParams.Domain, _ = GetString("mail.server.imap.domain", "localhost")
 }
+
+func loadDatabaseParams(prefix string, params *DbParams, defaults *DbParams) {
+	params.Drivername, _ = GetString(prefix+".drivername", defaults.Drivername)
+	params.Dsn, _ = GetString(prefix+".dsn", defaults.Dsn)
+	params.Dbname, _ = GetString(prefix+".dbname", defaults.Dbname)
+	params.Host, _ = GetString(prefix+".host", defaults.Host)
+	params.Port, _ = GetString(prefix+".port", defaults.Port)
+	params.User, _ = GetString(prefix+".user", defaults.User)
+	params.Password, _ = GetString(prefix+".password", defaults.Password)
+	params.Readtransaction, _ = GetBool(prefix+".readtransaction", defaults.Readtransaction)
+	params.Sslmode, _ = GetString(prefix+".sslmode", defaults.Sslmode)
+	params.TimeZone, _ = GetString(prefix+".timeZone", defaults.TimeZone)
+	params.MaxIdleConns, _ = GetInt(prefix+".maxIdleConns", defaults.MaxIdleConns)
+	params.MaxOpenConns, _ = GetInt(prefix+".maxOpenConns", defaults.MaxOpenConns)
+	params.ConnMaxLifetime, _ = GetInt(prefix+".connMaxLifetime", defaults.ConnMaxLifetime)
+	params.ConnMaxIdleTime, _ = GetInt(prefix+".connMaxIdleTime", defaults.ConnMaxIdleTime)
+	params.ShowSQL, _ = GetBool(prefix+".showSQL", defaults.ShowSQL)
+	params.Orm, _ = GetString(prefix+".orm", defaults.Orm)
+	params.Sequence, _ = GetString(prefix+".sequence", defaults.Sequence)
+	params.BatchSize, _ = GetInt(prefix+".batchSize", defaults.BatchSize)
+	params.InsertBatchSize, _ = GetInt(prefix+".insertBatchSize", defaults.InsertBatchSize)
+	params.InsertParallel, _ = GetInt(prefix+".insertParallel", defaults.InsertParallel)
+	params.CopyThreshold, _ = GetInt(prefix+".copyThreshold", defaults.CopyThreshold)
+	params.Replicas = defaults.Replicas
+	replicas, _ := GetString(prefix+".replicas", "")
+	if replicas != "" {
+		params.Replicas = strings.Split(replicas, ",")
+	}
+	params.ReplicaCheck, _ = GetInt(prefix+".replicaCheck", defaults.ReplicaCheck)
+	params.Tenant, _ = GetString(prefix+".tenant", defaults.Tenant)
+	params.Schema, _ = GetString(prefix+".schema", defaults.Schema)
+	params.LogLevel = defaults.LogLevel
+	level, _ := GetString(prefix+".logLevel", "")
+	switch level {
+	case "debug":
+		params.LogLevel = 0
+	case "info":
+		params.LogLevel = 1
+	case "warn":
+		params.LogLevel = 2
+	case "error":
+		params.LogLevel = 3
+	case "off":
+		params.LogLevel = 4
+	}
+}
+
+var namedDatabaseParams = make(map[string]*DbParams)
+
+var databaseLock sync.Mutex
+
+/*
+*
+获取命名数据库的配置，命名数据库配置在database.<name>下，除了dsn，没有配置的项使用缺省数据库的配置，比如
+
+	database:
+	  drivername: postgres
+	  host: localhost
+	  cache:
+	    orm: xorm
+	    drivername: sqlite3
+	    dsn: ./cache.db
+
+名称为空字符串或者default的时候返回缺省数据库的配置
+名称是<name>@<schema>的时候是schema方式的租户数据库，使用数据库name的配置，Schema是租户的schema
+*/
+func GetDatabaseParams(name string) *DbParams {
+	if name == "" || name == "default" {
+		return &DatabaseParams
+	}
+	databaseLock.Lock()
+	defer databaseLock.Unlock()
+
+	return namedParams(name)
+}
+
+func namedParams(name string) *DbParams {
+	if name == "" || name == "default" {
+		return &DatabaseParams
+	}
+	params, ok := namedDatabaseParams[name]
+	if ok {
+		return params
+	}
+	base, schema, ok := strings.Cut(name, "@")
+	if ok {
+		p := *namedParams(base)
+		p.Name = name
+		p.Schema = schema
+		params = &p
+	} else {
+		// dsn和副本和驱动相关，不使用缺省数据库的
+		defaults := DatabaseParams
+		defaults.Dsn = ""
+		defaults.Replicas = nil
+		params = &DbParams{Name: name}
+		loadDatabaseParams("database."+name, params, &defaults)
+	}
+	namedDatabaseParams[name] = params
+
+	return params
+}
@@ -440,39 +440,84 @@ func decryptCBC(ciphertext []byte, key []byte) []byte {
 	return decrypted
 }
 
-var gcm_nonce, _ = hex.DecodeString("48656c6c6f20476f7068657221")
-
+/*
+*
+GCM每次加密使用随机的nonce，nonce放在密文的前面，解密的时候从密文中取出
+同一个密钥下nonce不能重复，所以不能使用固定的nonce
+*/
 func encryptGCM(plaintext []byte, key []byte) []byte {
-	block, err := aes.NewCipher(key)
+	aesgcm := newGCM(key)
+	nonce := make([]byte, aesgcm.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
 	if err != nil {
 		panic(err)
 	}
-	aesgcm, err := cipher.NewGCM(block)
+
+	return aesgcm.Seal(nonce, nonce, plaintext, nil)
+}
+
+func decryptGCM(ciphertext []byte, key []byte) []byte {
+	aesgcm := newGCM(key)
+	size := aesgcm.NonceSize()
+	if len(ciphertext) < size {
+		panic("CiphertextTooShort")
+	}
+	plaintext, err := aesgcm.Open(nil, ciphertext[:size], ciphertext[size:], nil)
 	if err != nil {
 		panic(err)
 	}
-	ciphertext := aesgcm.Seal(nil, gcm_nonce, plaintext, nil)
 
-	return ciphertext
+	return plaintext
 }
 
-func decryptGCM(ciphertext []byte, key []byte) []byte {
+func newGCM(key []byte) cipher.AEAD {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		panic(err)
 	}
-
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
 		panic(err)
 	}
 
-	plaintext, err := aesgcm.Open(nil, gcm_nonce, ciphertext, nil)
-	if err != nil {
-		panic(err)
+	return aesgcm
+}
+
+/*
+*
+确定性的GCM加密，从key派生加密和nonce两个子密钥，nonce是nonce子密钥对明文的HMAC-SHA256的前12个字节，
+相同的密钥和明文总是得到相同的密文，可以用密文做相等的查询，但是会暴露哪些记录的值相同，只用于需要查询的字段
+nonce和加密不使用同一个密钥，使用DecryptDeterministic(key, ciphertext)解密
+*/
+func EncryptDeterministic(key []byte, plaintext []byte) []byte {
+	encKey, nonceKey := deterministicKeys(key)
+	aesgcm := newGCM(encKey)
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:aesgcm.NonceSize()]
+
+	return aesgcm.Seal(nonce, nonce, plaintext, nil)
+}
+
+func DecryptDeterministic(key []byte, ciphertext []byte) []byte {
+	encKey, _ := deterministicKeys(key)
+
+	return decryptGCM(ciphertext, encKey)
+}
+
+// 子密钥是HMAC(key, "enc")和HMAC(key, "nonce")，长度和key相同，保持AES的密钥长度
+func deterministicKeys(key []byte) ([]byte, []byte) {
+	size := len(key)
+	if size > sha256.Size {
+		size = sha256.Size
+	}
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)[:size]
 	}
 
-	return plaintext
+	return derive("enc"), derive("nonce")
 }
 
 // =================== CFB ======================
@@ -0,0 +1,32 @@
+package entity
+
+const (
+	AuditOperation_Insert string = "Insert"
+	AuditOperation_Update string = "Update"
+	AuditOperation_Delete string = "Delete"
+	AuditOperation_Deny   string = "Deny"
+)
+
+/*
+*
+实体变化的审计记录，每次新增，修改和删除实体的时候记录一条，审计的时间是CreateDate
+EntityType是实体的表名，EntityKey是实体的id
+Diff是变化的字段的json，键是字段名，值是旧值和新值，见FieldDiff
+被数据访问策略拒绝的操作记录一条Deny，Diff是被拒绝的操作
+*/
+type Audit struct {
+	BaseEntity `xorm:"extends"`
+	EntityType string `xorm:"varchar(255) index(idx_audit_entity)" json:"entityType,omitempty"`
+	EntityKey  string `xorm:"varchar(255) index(idx_audit_entity)" json:"entityKey,omitempty"`
+	Operation  string `xorm:"varchar(16)" json:"operation,omitempty"`
+	UserId     string `xorm:"varchar(32)" json:"userId,omitempty"`
+	Diff       string `xorm:"text" json:"diff,omitempty"`
+}
+
+func (Audit) TableName() string {
+	return "bas_audit"
+}
+
+func (Audit) IdName() string {
+	return FieldName_Id
+}
@@ -2,9 +2,13 @@ package entity
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/curltech/go-colla-core/util/collection"
 	"github.com/curltech/go-colla-core/util/reflect"
 	reflect2 "reflect"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -59,10 +63,16 @@ type VersionEntity struct {
 type StatusEntity struct {
 	BaseEntity   `xorm:"extends"`
 	Status       string     `xorm:"varchar(16)" json:"status,omitempty"`
-	StatusReason string     `xorm:"varchar(255)" json:"statusReason,omitempty"`
+	StatusReason string     `xorm:"varchar(255)" json:"statusReason,omitempty" colla:"max=255"`
 	StatusDate   *time.Time `json:"statusDate,omitempty"`
 }
 
+// 共享表的多租户实体，租户字段由服务按照ctx中的租户自动填写和过滤
+type TenantEntity struct {
+	BaseEntity `xorm:"extends"`
+	TenantId   string `xorm:"varchar(32) index" json:"tenantId,omitempty"`
+}
+
 type DeletedEntity struct {
 	BaseEntity `xorm:"extends"` //`gorm:"embedded"`
 	DeleteDate *time.Time       `xorm:"deleted" json:"deleteDate,omitempty"`
@@ -93,26 +103,39 @@ const (
 )
 
 const (
-	FieldName_Id         string = "Id"
-	FieldName_TopId      string = "TopId"
-	FieldName_Kind       string = "Kind"
-	FieldName_SpecId     string = "SpecId"
-	FieldName_ParentId   string = "ParentId"
-	FieldName_SchemaName string = "SchemaName"
-	FieldName_State      string = "State"
-	FieldName_DirtyFlag  string = "DirtyFlag"
+	FieldName_Id           string = "Id"
+	FieldName_TopId        string = "TopId"
+	FieldName_Kind         string = "Kind"
+	FieldName_SpecId       string = "SpecId"
+	FieldName_ParentId     string = "ParentId"
+	FieldName_SchemaName   string = "SchemaName"
+	FieldName_State        string = "State"
+	FieldName_DirtyFlag    string = "DirtyFlag"
+	FieldName_CreateUserId string = "CreateUserId"
+	FieldName_UpdateUserId string = "UpdateUserId"
+	FieldName_UpdateDate   string = "UpdateDate"
+	FieldName_Status       string = "Status"
+	FieldName_StatusReason string = "StatusReason"
+	FieldName_StatusDate   string = "StatusDate"
+	FieldName_TenantId     string = "TenantId"
 )
 
 const (
-	JsonFieldName_Id         string = "id"
-	JsonFieldName_TopId      string = "topId"
-	JsonFieldName_Kind       string = "kind"
-	JsonFieldName_SpecId     string = "specId"
-	JsonFieldName_ParentId   string = "parentId"
-	JsonFieldName_SchemaName string = "schemaName"
-	JsonFieldName_State      string = "state"
-	JsonFieldName_DirtyFlag  string = "dirtyFlag"
-	JsonFieldName_Path       string = "path"
+	JsonFieldName_Id           string = "id"
+	JsonFieldName_TopId        string = "topId"
+	JsonFieldName_Kind         string = "kind"
+	JsonFieldName_SpecId       string = "specId"
+	JsonFieldName_ParentId     string = "parentId"
+	JsonFieldName_SchemaName   string = "schemaName"
+	JsonFieldName_State        string = "state"
+	JsonFieldName_DirtyFlag    string = "dirtyFlag"
+	JsonFieldName_Path         string = "path"
+	JsonFieldName_CreateUserId string = "createUserId"
+	JsonFieldName_UpdateUserId string = "updateUserId"
+	JsonFieldName_Status       string = "status"
+	JsonFieldName_StatusReason string = "statusReason"
+	JsonFieldName_StatusDate   string = "statusDate"
+	JsonFieldName_TenantId     string = "tenantId"
 )
 
 /*
@@ -137,89 +160,361 @@ func NewSnapshot(entity interface{}) *EntitySnapshot {
 	return &snapshot
 }
 
+// 快照的数据，键是字段名
+func (this *EntitySnapshot) Data() map[string]interface{} {
+	return this.data
+}
+
+// 字段的旧值和新值
+type FieldDiff struct {
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+/*
+*
+比较两个快照，返回值不同的字段，键是字段名，快照为nil的时候当作所有字段都为空
+快照忽略了空值的字段，所以字段变为空值的时候新值为nil
+*/
+func DiffSnapshot(old *EntitySnapshot, new *EntitySnapshot) map[string]*FieldDiff {
+	diffs := make(map[string]*FieldDiff)
+	var oldData, newData map[string]interface{}
+	if old != nil {
+		oldData = old.data
+	}
+	if new != nil {
+		newData = new.data
+	}
+	for name, o := range oldData {
+		n, ok := newData[name]
+		if !ok {
+			diffs[name] = &FieldDiff{Old: o}
+		} else if !reflect2.DeepEqual(o, n) {
+			diffs[name] = &FieldDiff{Old: o, New: n}
+		}
+	}
+	for name, n := range newData {
+		_, ok := oldData[name]
+		if !ok {
+			diffs[name] = &FieldDiff{New: n}
+		}
+	}
+
+	return diffs
+}
+
+/*
+*
+实体的变化，state是New，Modified或者Deleted，columns是Modified的时候修改过的字段名
+columns为nil的时候修改所有的字段
+*/
 type EntityDiff struct {
-	data  map[string]interface{}
-	state string
+	entity  interface{}
+	state   string
+	columns []string
+}
+
+func NewEntityDiff(entity interface{}, state string, columns []string) *EntityDiff {
+	return &EntityDiff{entity: entity, state: state, columns: columns}
+}
+
+func (this *EntityDiff) Entity() interface{} {
+	return this.entity
+}
+
+func (this *EntityDiff) State() string {
+	return this.state
+}
+
+func (this *EntityDiff) Columns() []string {
+	return this.columns
 }
 
+/*
+*
+实体的工作单元，登记实体的对象图，记录每个实体登记时候的快照
+对象图中的子实体是指向实现IBaseEntity的结构的指针字段，或者这样的指针的数组字段
+GetSyncInfo重新遍历对象图，和快照比较，得到需要保存的实体的变化
+*/
 type EntityContext struct {
-	diffs     map[string]*EntityDiff
-	snapshots map[string]*EntitySnapshot
+	roots     []interface{}
+	entities  []interface{}
+	snapshots map[interface{}]*EntitySnapshot
+	diffs     map[interface{}]*EntityDiff
 }
 
 func (this *EntityContext) GetEntityDiff(entity interface{}) (*EntityDiff, error) {
-	entityId, err := reflect.GetValue(entity, "entityId")
-	if err != nil {
-		return nil, err
-	}
-	diff := this.diffs[entityId.(string)]
-	if diff == nil {
-		diff = &EntityDiff{}
-		this.diffs[entityId.(string)] = diff
+	if !isEntity(reflect2.TypeOf(entity)) {
+		return nil, errors.New("NotEntity")
 	}
 
-	return diff, nil
+	return this.diffs[entity], nil
 }
 
-func (this *EntityContext) GetSyncInfo(snapshots map[string]*EntitySnapshot) (map[string]*EntityDiff, error) {
-	for _, snapshot := range snapshots {
-		snapshotState := snapshot.state
-		entity := snapshot.entity
-		entityState, err := reflect.GetValue(entity, "state")
-		if err != nil {
-			return nil, err
-		}
-		if entityState != snapshotState {
-			diff, _ := this.GetEntityDiff(entity)
-			diff.state = entityState.(string)
-		}
-		if "NONE" != entityState.(string) {
-			dataDiff := make(map[string]interface{})
-			diff, _ := this.GetEntityDiff(entity)
-			diff.data = dataDiff
-			for name, _ := range snapshot.data {
-				value, _ := reflect.GetValue(entity, name)
-				dataDiff[name] = value
+/*
+*
+计算实体的变化，返回的顺序就是保存的顺序，新增和修改的父实体在子实体之前，删除的子实体在父实体之前
+状态为Deleted或者已经不在对象图中的实体是Deleted
+状态为New或者还没有id的实体是New，没有登记过但是有id的实体是Modified，修改所有的字段
+其他的实体比较快照，有字段修改或者状态为Modified的是Modified
+*/
+func (this *EntityContext) GetSyncInfo() ([]*EntityDiff, error) {
+	this.diffs = make(map[interface{}]*EntityDiff)
+	saves := make([]*EntityDiff, 0)
+	deletes := make([]*EntityDiff, 0)
+	reachable := make(map[interface{}]bool)
+	for _, root := range this.roots {
+		walkEntity(root, reachable, func(entity interface{}) {
+			snapshot := this.snapshots[entity]
+			state := entityState(entity)
+			var diff *EntityDiff
+			switch state {
+			case EntityState_Deleted:
+				if snapshot != nil || !isNewEntity(entity) {
+					diff = &EntityDiff{entity: entity, state: EntityState_Deleted}
+					deletes = append(deletes, diff)
+				}
+			case EntityState_New:
+				diff = &EntityDiff{entity: entity, state: EntityState_New}
+				saves = append(saves, diff)
+			case EntityState_Modified, EntityState_None, "":
+				if isNewEntity(entity) {
+					diff = &EntityDiff{entity: entity, state: EntityState_New}
+					saves = append(saves, diff)
+					break
+				}
+				// 在工作单元之外读取以后挂到对象图中的实体，没有快照可以比较，修改所有的字段
+				if snapshot == nil {
+					diff = &EntityDiff{entity: entity, state: EntityState_Modified}
+					saves = append(saves, diff)
+					break
+				}
+				columns := changedColumns(snapshot.data, trackedData(entity))
+				if len(columns) > 0 {
+					diff = &EntityDiff{entity: entity, state: EntityState_Modified, columns: columns}
+					saves = append(saves, diff)
+				} else if state == EntityState_Modified {
+					diff = &EntityDiff{entity: entity, state: EntityState_Modified}
+					saves = append(saves, diff)
+				}
+			default:
+				diff = &EntityDiff{entity: entity, state: state}
+			}
+			if diff != nil {
+				this.diffs[entity] = diff
 			}
+		})
+	}
+	for entity, diff := range this.diffs {
+		switch diff.state {
+		case EntityState_New, EntityState_Modified, EntityState_Deleted:
+		default:
+			this.diffs = nil
+			return nil, fmt.Errorf("UnknownEntityState: %T %v", entity, diff.state)
+		}
+	}
+	// 已经从对象图中移走的实体
+	for _, entity := range this.entities {
+		if !reachable[entity] {
+			diff := &EntityDiff{entity: entity, state: EntityState_Deleted}
+			this.diffs[entity] = diff
+			deletes = append(deletes, diff)
 		}
 	}
+	for i := len(deletes) - 1; i >= 0; i-- {
+		saves = append(saves, deletes[i])
+	}
 
-	return this.diffs, nil
+	return saves, nil
 }
 
+/*
+*
+登记实体和它的子实体，记录实体现在的快照，entity是结构的指针
+*/
 func (this *EntityContext) RegisterEntity(entity interface{}) {
-	entityId, _ := reflect.GetValue(entity, "entityId")
-	if entityId.(string) == "" {
-		id, _ := reflect.GetValue(entity, FieldName_Id)
-		if id != nil {
-			entityId = id.(string)
+	if !isEntity(reflect2.TypeOf(entity)) {
+		return
+	}
+	if this.snapshots == nil {
+		this.snapshots = make(map[interface{}]*EntitySnapshot)
+	}
+	for _, root := range this.roots {
+		if root == entity {
+			return
+		}
+	}
+	this.roots = append(this.roots, entity)
+	walkEntity(entity, make(map[interface{}]bool), this.snapshot)
+}
+
+func (this *EntityContext) snapshot(entity interface{}) {
+	_, ok := this.snapshots[entity]
+	if !ok {
+		this.entities = append(this.entities, entity)
+	}
+	this.snapshots[entity] = &EntitySnapshot{entity: entity, data: trackedData(entity), state: entityState(entity)}
+}
+
+/*
+*
+保存成功之后调用，去掉已经删除的实体，重新记录对象图中实体的快照，实体的状态改为None
+*/
+func (this *EntityContext) Refresh() {
+	this.entities = nil
+	this.snapshots = make(map[interface{}]*EntitySnapshot)
+	this.diffs = nil
+	roots := make([]interface{}, 0, len(this.roots))
+	for _, root := range this.roots {
+		if entityState(root) != EntityState_Deleted {
+			roots = append(roots, root)
 		}
 	}
-	if entityId.(string) == "" {
-		entityId = "101"
+	this.roots = roots
+	for _, root := range this.roots {
+		walkEntity(root, make(map[interface{}]bool), func(entity interface{}) {
+			if entityState(entity) == EntityState_Deleted {
+				return
+			}
+			reflect.SetValue(entity, FieldName_State, EntityState_None)
+			this.snapshot(entity)
+		})
 	}
-	this.snapshots[entityId.(string)] = &EntitySnapshot{entity: entity}
-	this.diffs[entityId.(string)] = nil
+}
+
+func BuildEntityContext(entities ...interface{}) *EntityContext {
+	context := &EntityContext{
+		snapshots: make(map[interface{}]*EntitySnapshot),
+		diffs:     make(map[interface{}]*EntityDiff),
+	}
+	for _, entity := range entities {
+		context.RegisterEntity(entity)
+	}
+
+	return context
+}
+
+var iBaseEntityType = reflect2.TypeOf((*IBaseEntity)(nil)).Elem()
 
-	typ := reflect2.TypeOf(entity)
+// 实体是实现IBaseEntity的结构的指针
+func isEntity(typ reflect2.Type) bool {
+	return typ != nil && typ.Kind() == reflect2.Ptr && typ.Elem().Kind() == reflect2.Struct && typ.Implements(iBaseEntityType)
+}
+
+// 子实体字段，指向实体的指针或者实体指针的数组
+func IsChild(field reflect2.StructField) bool {
+	if field.Anonymous {
+		return false
+	}
+	typ := field.Type
+	if typ.Kind() == reflect2.Slice {
+		typ = typ.Elem()
+	}
+
+	return isEntity(typ)
+}
+
+// 深度优先遍历对象图，父实体在子实体之前，visited避免循环引用
+func walkEntity(entity interface{}, visited map[interface{}]bool, fn func(entity interface{})) {
 	value := reflect2.ValueOf(entity)
+	if value.IsNil() || visited[entity] {
+		return
+	}
+	visited[entity] = true
+	fn(entity)
+	walkChildren(value.Elem(), visited, fn)
+}
+
+func walkChildren(value reflect2.Value, visited map[interface{}]bool, fn func(entity interface{})) {
+	typ := value.Type()
 	for i := 0; i < typ.NumField(); i++ {
-		filedValue := value.Field(i).Interface()
-		filedValueTyp := reflect.GetType(filedValue)
-		if filedValueTyp == reflect2.Slice {
-			for _, v := range filedValue.([]interface{}) {
-				if v != nil {
-					this.RegisterEntity(v)
-				}
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect2.Struct {
+			walkChildren(value.Field(i), visited, fn)
+			continue
+		}
+		if !IsChild(field) {
+			continue
+		}
+		f := value.Field(i)
+		if f.Kind() == reflect2.Slice {
+			for j := 0; j < f.Len(); j++ {
+				walkEntity(f.Index(j).Interface(), visited, fn)
 			}
-		} else if filedValueTyp == reflect2.Struct {
-			this.RegisterEntity(filedValue)
+		} else {
+			walkEntity(f.Interface(), visited, fn)
 		}
 	}
 }
 
-func BuildEntityContext(entity interface{}) *EntityContext {
-	context := &EntityContext{}
-	context.RegisterEntity(entity)
-	return context
+func entityState(entity interface{}) string {
+	state, _ := reflect.GetValue(entity, FieldName_State)
+	s, _ := state.(string)
+
+	return s
+}
+
+// 没有id的实体还没有保存过
+func isNewEntity(entity interface{}) bool {
+	id, _ := reflect.GetValue(entity, FieldName_Id)
+
+	return id == nil || reflect2.ValueOf(id).IsZero()
+}
+
+/*
+*
+实体中需要比较的字段的值，键是字段名
+不包括子实体，不保存的字段，自动填写的创建时间，修改时间，删除时间和版本号
+*/
+func trackedData(entity interface{}) map[string]interface{} {
+	data := make(map[string]interface{})
+	collectTracked(reflect2.ValueOf(entity).Elem(), data)
+
+	return data
+}
+
+func collectTracked(value reflect2.Value, data map[string]interface{}) {
+	typ := value.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect2.Struct {
+			collectTracked(value.Field(i), data)
+			continue
+		}
+		if IsChild(field) || !tracked(field) {
+			continue
+		}
+		data[field.Name] = value.Field(i).Interface()
+	}
+}
+
+func tracked(field reflect2.StructField) bool {
+	for _, t := range strings.Fields(field.Tag.Get("xorm")) {
+		switch t {
+		case "-", "created", "updated", "deleted", "version":
+			return false
+		}
+	}
+
+	return true
+}
+
+// 比较快照和现在的值，返回修改过的字段名，按照字段名排序
+func changedColumns(old map[string]interface{}, new map[string]interface{}) []string {
+	columns := make([]string, 0)
+	for name, n := range new {
+		o, ok := old[name]
+		if !ok || !reflect2.DeepEqual(o, n) {
+			columns = append(columns, name)
+		}
+	}
+	sort.Strings(columns)
+
+	return columns
 }
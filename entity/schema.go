@@ -0,0 +1,40 @@
+package entity
+
+import "time"
+
+/*
+*
+已经执行的数据库迁移，每个迁移一条记录，Id是迁移的版本号，执行的时间是CreateDate
+Checksum是sql迁移的语句的摘要，go迁移为空
+*/
+type SchemaVersion struct {
+	BaseEntity `xorm:"extends"`
+	Name       string `xorm:"varchar(255)" json:"name,omitempty"`
+	Checksum   string `xorm:"varchar(64)" json:"checksum,omitempty"`
+}
+
+func (SchemaVersion) TableName() string {
+	return "bas_schema_version"
+}
+
+func (SchemaVersion) IdName() string {
+	return FieldName_Id
+}
+
+/*
+*
+数据库迁移的锁，只有一条记录，Owner是持有锁的节点，LockDate是加锁的时间
+*/
+type SchemaLock struct {
+	VersionEntity `xorm:"extends"`
+	Owner         string     `xorm:"varchar(64)" json:"owner,omitempty"`
+	LockDate      *time.Time `json:"lockDate,omitempty"`
+}
+
+func (SchemaLock) TableName() string {
+	return "bas_schema_lock"
+}
+
+func (SchemaLock) IdName() string {
+	return FieldName_Id
+}
@@ -0,0 +1,353 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	baseerror "github.com/curltech/go-colla-core/error"
+	"github.com/curltech/go-colla-core/logger"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+/*
+*
+实体字段的校验规则，写在colla标签中，多个规则用逗号分隔，比如
+Name   string `colla:"required,max=32,pattern=^[a-z]+$"`
+Status string `colla:"status"`
+Level  int    `colla:"range=1:9"`
+规则有：
+required 不能为空值
+min=n，max=n 字符串的最小和最大字符数，数组的最小和最大长度
+pattern=正则表达式 字符串必须匹配，pattern必须是最后一个规则，后面的所有内容都是正则表达式
+status 必须是EntityStatus_开始的常量之一
+enum=a|b|c 必须是列出的值之一
+range=min:max 数字的范围，可以只写一边，比如range=0:
+除了required，空值不做检查，其他不认识的规则忽略
+*/
+const TagName_Colla = "colla"
+
+var entityStatuses = map[string]bool{
+	EntityStatus_Draft:     true,
+	EntityStatus_Effective: true,
+	EntityStatus_Expired:   true,
+	EntityStatus_Deleted:   true,
+	EntityStatus_Canceled:  true,
+	EntityStatus_Checking:  true,
+	EntityStatus_Undefined: true,
+	EntityStatus_Locked:    true,
+	EntityStatus_Checked:   true,
+	EntityStatus_Unchecked: true,
+	EntityStatus_Disable:   true,
+	EntityStatus_Discarded: true,
+	EntityStatus_Merged:    true,
+	EntityStatus_Reversed:  true,
+}
+
+// 一个字段校验失败的原因，Code是error包中的错误码
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+/*
+*
+实体校验的错误，包含所有校验失败的字段，使用errors.As取得
+*/
+type ValidationError struct {
+	Entity string        `json:"entity,omitempty"`
+	Fields []*FieldError `json:"fields,omitempty"`
+}
+
+func (this *ValidationError) Error() string {
+	messages := make([]string, 0, len(this.Fields))
+	for _, field := range this.Fields {
+		messages = append(messages, fmt.Sprintf("%v %v", field.Field, field.Message))
+	}
+
+	return fmt.Sprintf("ValidationError: %v %v", this.Entity, strings.Join(messages, "; "))
+}
+
+type fieldRule struct {
+	name    string
+	arg     string
+	length  int
+	min     *float64
+	max     *float64
+	pattern *regexp.Regexp
+	values  map[string]bool
+}
+
+type fieldRules struct {
+	index []int
+	name  string
+	rules []*fieldRule
+}
+
+// 实体类型的校验规则的缓存，值是[]*fieldRules或者解析规则的错误
+var validateRules sync.Map
+
+/*
+*
+按照colla标签校验实体，md是实体的指针或者实体的数组
+columns不为空的时候只校验这些字段，用于只修改部分字段的时候
+校验失败返回*ValidationError，规则写错的时候返回WrongValidateRule错误
+*/
+func Validate(md interface{}, columns ...string) error {
+	return validate(md, false, columns)
+}
+
+/*
+*
+只校验有值的字段，不检查required，用于按照条件修改的时候实体只是部分字段的值
+*/
+func ValidatePresent(md interface{}) error {
+	return validate(md, true, nil)
+}
+
+func validate(md interface{}, present bool, columns []string) error {
+	value := reflect.Indirect(reflect.ValueOf(md))
+	if value.Kind() == reflect.Slice {
+		for i := 0; i < value.Len(); i++ {
+			err := validate(value.Index(i).Interface(), present, columns)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	rules, err := typeRules(value.Type())
+	if err != nil {
+		return err
+	}
+	var only map[string]bool
+	if len(columns) > 0 {
+		only = make(map[string]bool, len(columns))
+		for _, column := range columns {
+			only[strings.ToLower(column)] = true
+		}
+	}
+	fields := make([]*FieldError, 0)
+	for _, rs := range rules {
+		if only != nil && !only[strings.ToLower(rs.name)] {
+			continue
+		}
+		field, err := value.FieldByIndexErr(rs.index)
+		if err != nil {
+			continue
+		}
+		for _, rule := range rs.rules {
+			if present && rule.name == "required" {
+				continue
+			}
+			fieldError := rule.check(field)
+			if fieldError != nil {
+				fieldError.Field = rs.name
+				fields = append(fields, fieldError)
+				break
+			}
+		}
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Entity: value.Type().Name(), Fields: fields}
+	}
+
+	return nil
+}
+
+func typeRules(typ reflect.Type) ([]*fieldRules, error) {
+	cached, ok := validateRules.Load(typ)
+	if !ok {
+		rules, err := parseRules(typ)
+		if err != nil {
+			cached = err
+		} else {
+			cached = rules
+		}
+		validateRules.Store(typ, cached)
+	}
+	err, ok := cached.(error)
+	if ok {
+		return nil, err
+	}
+
+	return cached.([]*fieldRules), nil
+}
+
+func parseRules(typ reflect.Type) ([]*fieldRules, error) {
+	result := make([]*fieldRules, 0)
+	for _, field := range reflect.VisibleFields(typ) {
+		tag, ok := field.Tag.Lookup(TagName_Colla)
+		if !ok || !field.IsExported() || field.Anonymous {
+			continue
+		}
+		rules := make([]*fieldRule, 0)
+		for _, item := range splitRules(tag) {
+			rule, err := parseRule(item)
+			if err != nil {
+				logger.Sugar.Errorf("%v.%v rule:%v error:%v", typ.Name(), field.Name, item, err.Error())
+				return nil, fmt.Errorf("WrongValidateRule: %v.%v %v", typ.Name(), field.Name, item)
+			}
+			if rule != nil {
+				rules = append(rules, rule)
+			}
+		}
+		if len(rules) > 0 {
+			result = append(result, &fieldRules{index: field.Index, name: field.Name, rules: rules})
+		}
+	}
+
+	return result, nil
+}
+
+// pattern后面的内容可以有逗号，所以整体作为一个规则
+func splitRules(tag string) []string {
+	var pattern string
+	i := strings.Index(tag, "pattern=")
+	if i >= 0 {
+		pattern = tag[i:]
+		tag = tag[:i]
+	}
+	items := make([]string, 0)
+	for _, item := range strings.Split(tag, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	if pattern != "" {
+		items = append(items, pattern)
+	}
+
+	return items
+}
+
+// 不认识的规则返回nil，比如其他功能使用的标签
+func parseRule(item string) (*fieldRule, error) {
+	name, arg, _ := strings.Cut(item, "=")
+	rule := &fieldRule{name: name, arg: arg}
+	var err error
+	switch name {
+	case "required", "status":
+	case "min", "max":
+		rule.length, err = strconv.Atoi(arg)
+	case "pattern":
+		rule.pattern, err = regexp.Compile(arg)
+	case "enum":
+		rule.values = make(map[string]bool)
+		for _, v := range strings.Split(arg, "|") {
+			rule.values[v] = true
+		}
+	case "range":
+		lo, hi, ok := strings.Cut(arg, ":")
+		if !ok {
+			return nil, errors.New("NoRangeSeparator")
+		}
+		rule.min, err = parseBound(lo)
+		if err == nil {
+			rule.max, err = parseBound(hi)
+		}
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+func parseBound(s string) (*float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func (this *fieldRule) check(field reflect.Value) *FieldError {
+	for field.Kind() == reflect.Ptr || field.Kind() == reflect.Interface {
+		if field.IsNil() {
+			break
+		}
+		field = field.Elem()
+	}
+	empty := field.IsZero()
+	if this.name == "required" {
+		if empty {
+			return this.fail(baseerror.Error_NoValue, "is required")
+		}
+		return nil
+	}
+	if empty {
+		return nil
+	}
+	switch this.name {
+	case "min", "max":
+		var n int
+		switch field.Kind() {
+		case reflect.String:
+			n = utf8.RuneCountInString(field.String())
+		case reflect.Slice, reflect.Array, reflect.Map:
+			n = field.Len()
+		default:
+			return nil
+		}
+		if this.name == "min" && n < this.length {
+			return this.fail(baseerror.Error_WrongValue, fmt.Sprintf("length %v less than %v", n, this.length))
+		}
+		if this.name == "max" && n > this.length {
+			return this.fail(baseerror.Error_WrongValue, fmt.Sprintf("length %v greater than %v", n, this.length))
+		}
+	case "pattern":
+		if field.Kind() == reflect.String && !this.pattern.MatchString(field.String()) {
+			return this.fail(baseerror.Error_WrongValue, fmt.Sprintf("not match %v", this.arg))
+		}
+	case "status":
+		if field.Kind() == reflect.String && !entityStatuses[field.String()] {
+			return this.fail(baseerror.Error_WrongValue, fmt.Sprintf("%v is not an entity status", field.String()))
+		}
+	case "enum":
+		if !this.values[fmt.Sprint(field.Interface())] {
+			return this.fail(baseerror.Error_WrongValue, fmt.Sprintf("%v not in %v", field.Interface(), this.arg))
+		}
+	case "range":
+		var f float64
+		switch field.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			f = float64(field.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			f = float64(field.Uint())
+		case reflect.Float32, reflect.Float64:
+			f = field.Float()
+		default:
+			return nil
+		}
+		if (this.min != nil && f < *this.min) || (this.max != nil && f > *this.max) {
+			return this.fail(baseerror.Error_WrongValue, fmt.Sprintf("%v out of range %v", field.Interface(), this.arg))
+		}
+	}
+
+	return nil
+}
+
+func (this *fieldRule) fail(code string, message string) *FieldError {
+	rule := this.name
+	if this.arg != "" {
+		rule = this.name + "=" + this.arg
+	}
+
+	return &FieldError{Rule: rule, Code: code, Message: message}
+}
@@ -0,0 +1,23 @@
+package entity
+
+import "testing"
+
+func TestValidateStatus(t *testing.T) {
+	// StatusEntity的状态由服务的状态机决定，不限制为EntityStatus_的常量
+	md := &StatusEntity{Status: "Approved"}
+	err := Validate(md)
+	if err != nil {
+		t.Fatalf("status entity: %v", err)
+	}
+	type checked struct {
+		Status string `colla:"status"`
+	}
+	err = Validate(&checked{Status: "Approved"})
+	if err == nil {
+		t.Fatalf("status rule accepted Approved")
+	}
+	err = Validate(&checked{Status: EntityStatus_Effective})
+	if err != nil {
+		t.Fatalf("status rule: %v", err)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"github.com/curltech/go-colla-core/logger"
 	utilreflect "github.com/curltech/go-colla-core/util/reflect"
 	"reflect"
+	"sort"
+	"strconv"
 
 	"github.com/360EntSecGroup-Skylar/excelize"
 )
@@ -66,14 +68,74 @@ func Read(filename string, rowsSlicePtrs ...interface{}) error {
 }
 
 func Write(rowsSlicePtr interface{}) ([]byte, error) {
+	writer := NewWriter("result")
+	for _, row := range utilreflect.ToArray(rowsSlicePtr) {
+		err := writer.Append(row)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return writer.Bytes()
+}
+
+/*
+*
+逐行写入的excel，第一行是字段名，格式和Read读取的相同
+数据逐条加入，调用者不需要先把全部数据加载到切片中
+*/
+type Writer struct {
+	file      *excelize.File
+	sheetname string
+	head      []string
+	row       int
+}
+
+func NewWriter(sheetname string) *Writer {
 	f := excelize.NewFile()
-	// Create a new sheet.
-	sheetname := "result"
-	index := f.NewSheet(sheetname)
-	f.SetCellValue(sheetname, "A2", "Hello world.")
-	f.SetCellValue(sheetname, "B2", 100)
-	f.SetActiveSheet(index)
-	buf, err := f.WriteToBuffer()
+	// 新文件缺省有Sheet1，改名后作为唯一的sheet，Read可以直接读取
+	f.SetSheetName("Sheet1", sheetname)
+
+	return &Writer{file: f, sheetname: sheetname, row: 1}
+}
+
+// 加入一条数据，第一条数据的字段名作为表头
+func (this *Writer) Append(md interface{}) error {
+	if this.head == nil {
+		fieldNames, err := utilreflect.GetFieldNames(md, true)
+		if err != nil {
+			return err
+		}
+		this.head = make([]string, 0, len(fieldNames))
+		for name := range fieldNames {
+			this.head = append(this.head, name)
+		}
+		sort.Strings(this.head)
+		this.file.SetSheetRow(this.sheetname, "A1", &this.head)
+	}
+	this.row++
+	values := make([]interface{}, len(this.head))
+	for i, name := range this.head {
+		v, err := utilreflect.GetValue(md, name)
+		if err != nil {
+			continue
+		}
+		value := reflect.ValueOf(v)
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				continue
+			}
+			v = value.Elem().Interface()
+		}
+		values[i] = v
+	}
+	this.file.SetSheetRow(this.sheetname, "A"+strconv.Itoa(this.row), &values)
+
+	return nil
+}
+
+func (this *Writer) Bytes() ([]byte, error) {
+	buf, err := this.file.WriteToBuffer()
 	if err != nil {
 		return nil, err
 	}
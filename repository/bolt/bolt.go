@@ -1,65 +1,656 @@
 package bolt
 
 import (
+	"context"
 	"database/sql"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
-	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/config"
 	"github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-core/repository"
 	"github.com/curltech/go-colla-core/util/message"
 	"github.com/curltech/go-colla-core/util/reflect"
-	_ "github.com/lib/pq"
 	goreflect "reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
-// 每次事务开始时创建新会话
+// 每次事务开始时创建新会话，bolt同一时刻只允许一个写事务
 type BoltSession struct {
-	tx *bolt.Tx
+	db       *bolt.DB
+	tx       *bolt.Tx
+	ctx      context.Context
+	unscoped bool
+	filters  []repository.Filter
 }
 
-var boltdb *bolt.DB
+type BoltEngine struct {
+	DB *bolt.DB
+}
+
+func (this *BoltEngine) NewSession() repository.DbSession {
+	return &BoltSession{db: this.DB}
+}
+
+func (this *BoltEngine) Close() error {
+	return this.DB.Close()
+}
 
 func init() {
-	var err error
-	boltdb, err = bolt.Open("mydb.db", 0600, &bolt.Options{Timeout: 1 * time.Second})
+	repository.RegisterDriver("bolt", Open)
+}
+
+/*
+*
+bolt是嵌入式的kv数据库，不需要cgo，适合边缘节点
+每个实体对应一个bucket，bucket名称是实体的TableName()，键是IdName()对应字段的值，值是实体序列化后的数据
+数据库文件由dsn指定，缺省是dbname加上.db后缀，有schema的时候文件名加上schema的后缀
+*/
+func Open(params *config.DbParams) (repository.DbEngine, error) {
+	path := params.Dsn
+	if path == "" {
+		path = params.Dbname + ".db"
+	}
+	// schema方式的租户数据库使用单独的文件
+	path = repository.SchemaFile(path, params.Schema)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		logger.Sugar.Errorf("open bolt db:%v", err)
+		return nil, err
 	}
+
+	return &BoltEngine{DB: db}, nil
 }
 
-func NewBoltSession() repository.DbSession {
-	tx, err := boltdb.Begin(true)
-	if err != nil {
-		panic(err)
+// 在当前事务中执行读操作，没有事务的时候使用只读事务
+func (this *BoltSession) view(fn func(tx *bolt.Tx) error) error {
+	if this.ctx != nil && this.ctx.Err() != nil {
+		return this.ctx.Err()
+	}
+	if this.tx != nil {
+		return fn(this.tx)
 	}
 
-	return &BoltSession{tx: tx}
+	return this.db.View(fn)
 }
 
-func (this *BoltSession) Sync(bean ...interface{}) error {
+// 在当前事务中执行写操作，没有事务的时候使用自动提交的写事务
+func (this *BoltSession) update(fn func(tx *bolt.Tx) error) error {
+	if this.ctx != nil && this.ctx.Err() != nil {
+		return this.ctx.Err()
+	}
+	if this.tx != nil {
+		if !this.tx.Writable() {
+			return errors.New("TxNotWritable")
+		}
+		return fn(this.tx)
+	}
+
+	return this.db.Update(fn)
+}
+
+// 实体对应的bucket名称，优先使用TableName()
+func bucketName(md interface{}) []byte {
+	names, _ := reflect.Call(md, "TableName", nil)
+	if names != nil && len(names) > 0 {
+		name, ok := names[0].(string)
+		if ok && name != "" {
+			return []byte(name)
+		}
+	}
+	typ := goreflect.TypeOf(md)
+	for typ.Kind() == goreflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	return []byte(strings.ToLower(typ.Name()))
+}
+
+// 主键转换成bolt的键，整数使用大端编码，使得键的顺序和主键的顺序一致
+func keyOf(id interface{}) []byte {
+	switch v := id.(type) {
+	case uint64:
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, v)
+		return key
+	case string:
+		return []byte(v)
+	}
+
+	return []byte(fmt.Sprintf("%v", id))
+}
+
+// 创建和切片元素类型相同的新实体，返回实体的指针
+func newElem(rowsSlicePtr interface{}) (interface{}, error) {
+	sliceValue := goreflect.Indirect(goreflect.ValueOf(rowsSlicePtr))
+	if sliceValue.Kind() != goreflect.Slice {
+		return nil, errors.New("NeedSlicePtr")
+	}
+	elemType := sliceValue.Type().Elem()
+	if elemType.Kind() == goreflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != goreflect.Struct {
+		return nil, errors.New("NeedStructSlice")
+	}
+
+	return goreflect.New(elemType).Interface(), nil
+}
+
+// 把实体指针加入切片，切片元素可以是结构或者结构指针
+func appendElem(rowsSlicePtr interface{}, elem interface{}) {
+	sliceValue := goreflect.Indirect(goreflect.ValueOf(rowsSlicePtr))
+	elemValue := goreflect.ValueOf(elem)
+	if sliceValue.Type().Elem().Kind() != goreflect.Ptr {
+		elemValue = elemValue.Elem()
+	}
+	sliceValue.Set(goreflect.Append(sliceValue, elemValue))
+}
+
+func toArray(md interface{}) []interface{} {
+	kind := reflect.GetIndirectType(md)
+	if kind == goreflect.Slice || kind == goreflect.Array {
+		mds, ok := md.([]interface{})
+		if !ok {
+			mds = reflect.ToArray(md)
+		}
+		return mds
+	}
+
+	return []interface{}{md}
+}
+
+// 查找名称匹配的字段，忽略大小写和下划线，所以字段名和列名都可以使用
+func fieldByName(value goreflect.Value, name string) goreflect.Value {
+	return repository.FieldByColumn(value, name)
+}
+
+// 实体中作为条件的字段，和xorm一样，忽略零值，布尔值和xorm:"-"的字段
+func conditions(md interface{}) map[string]interface{} {
+	conds := make(map[string]interface{})
+	if md == nil {
+		return conds
+	}
+	value := goreflect.Indirect(goreflect.ValueOf(md))
+	if value.Kind() != goreflect.Struct {
+		return conds
+	}
+	collectConditions(value, conds)
+
+	return conds
+}
+
+func collectConditions(value goreflect.Value, conds map[string]interface{}) {
+	typ := value.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		f := value.Field(i)
+		if !f.CanInterface() {
+			continue
+		}
+		tag := field.Tag.Get("xorm")
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous && f.Kind() == goreflect.Struct {
+			collectConditions(f, conds)
+			continue
+		}
+		if f.Kind() == goreflect.Bool || f.IsZero() {
+			continue
+		}
+		conds[field.Name] = f.Interface()
+	}
+}
+
+func match(row interface{}, conds map[string]interface{}) bool {
+	value := goreflect.ValueOf(row)
+	for name, cond := range conds {
+		f := fieldByName(value, name)
+		if !f.IsValid() {
+			return false
+		}
+		if compare(f.Interface(), cond) != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// 比较两个值，返回-1，0，1，nil比任何值都小
+func compare(a interface{}, b interface{}) int {
+	va := goreflect.ValueOf(a)
+	vb := goreflect.ValueOf(b)
+	for va.IsValid() && (va.Kind() == goreflect.Ptr || va.Kind() == goreflect.Interface) {
+		if va.IsNil() {
+			va = goreflect.Value{}
+			break
+		}
+		va = va.Elem()
+	}
+	for vb.IsValid() && (vb.Kind() == goreflect.Ptr || vb.Kind() == goreflect.Interface) {
+		if vb.IsNil() {
+			vb = goreflect.Value{}
+			break
+		}
+		vb = vb.Elem()
+	}
+	if !va.IsValid() || !vb.IsValid() {
+		if va.IsValid() {
+			return 1
+		}
+		if vb.IsValid() {
+			return -1
+		}
+		return 0
+	}
+	ta, oka := va.Interface().(time.Time)
+	tb, okb := vb.Interface().(time.Time)
+	if oka && okb {
+		if ta.Before(tb) {
+			return -1
+		} else if ta.After(tb) {
+			return 1
+		}
+		return 0
+	}
+	switch va.Kind() {
+	case goreflect.Int, goreflect.Int8, goreflect.Int16, goreflect.Int32, goreflect.Int64,
+		goreflect.Uint, goreflect.Uint8, goreflect.Uint16, goreflect.Uint32, goreflect.Uint64,
+		goreflect.Float32, goreflect.Float64:
+		c, ok := compareInteger(va, vb)
+		if ok {
+			return c
+		}
+		fa, oka := toFloat(va)
+		fb, okb := toFloat(vb)
+		if oka && okb {
+			if fa < fb {
+				return -1
+			} else if fa > fb {
+				return 1
+			}
+			return 0
+		}
+	case goreflect.Bool:
+		if vb.Kind() == goreflect.Bool {
+			if va.Bool() == vb.Bool() {
+				return 0
+			} else if !va.Bool() {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return strings.Compare(fmt.Sprintf("%v", va.Interface()), fmt.Sprintf("%v", vb.Interface()))
+}
+
+// 整数按照整数比较，转换成float64在2^53以上会丢失精度，有一个不是整数的时候返回false
+func compareInteger(va goreflect.Value, vb goreflect.Value) (int, bool) {
+	ia, signedA, oka := toInteger(va)
+	ib, signedB, okb := toInteger(vb)
+	if !oka || !okb {
+		return 0, false
+	}
+	// 有符号的负数小于所有无符号的数
+	if signedA && !signedB && int64(ia) < 0 {
+		return -1, true
+	}
+	if signedB && !signedA && int64(ib) < 0 {
+		return 1, true
+	}
+	if signedA && signedB {
+		a, b := int64(ia), int64(ib)
+		if a < b {
+			return -1, true
+		} else if a > b {
+			return 1, true
+		}
+		return 0, true
+	}
+	if ia < ib {
+		return -1, true
+	} else if ia > ib {
+		return 1, true
+	}
+
+	return 0, true
+}
+
+func toInteger(v goreflect.Value) (uint64, bool, bool) {
+	switch v.Kind() {
+	case goreflect.Int, goreflect.Int8, goreflect.Int16, goreflect.Int32, goreflect.Int64:
+		return uint64(v.Int()), true, true
+	case goreflect.Uint, goreflect.Uint8, goreflect.Uint16, goreflect.Uint32, goreflect.Uint64:
+		return v.Uint(), false, true
+	}
+
+	return 0, false, false
+}
+
+func toFloat(v goreflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case goreflect.Int, goreflect.Int8, goreflect.Int16, goreflect.Int32, goreflect.Int64:
+		return float64(v.Int()), true
+	case goreflect.Uint, goreflect.Uint8, goreflect.Uint16, goreflect.Uint32, goreflect.Uint64:
+		return float64(v.Uint()), true
+	case goreflect.Float32, goreflect.Float64:
+		return v.Float(), true
+	}
+
+	return 0, false
+}
+
+type order struct {
+	name string
+	desc bool
+}
+
+// 解析orderby，格式和sql相同，比如"statusdate desc, id"
+func parseOrderBy(orderby string) []order {
+	orders := make([]order, 0)
+	for _, part := range strings.Split(orderby, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		o := order{name: fields[0]}
+		if len(fields) > 1 && strings.EqualFold(fields[1], "desc") {
+			o.desc = true
+		}
+		orders = append(orders, o)
+	}
+
+	return orders
+}
+
+func sortRows(rows []interface{}, orderby string) {
+	orders := parseOrderBy(orderby)
+	if len(orders) == 0 {
+		return
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		vi := goreflect.ValueOf(rows[i])
+		vj := goreflect.ValueOf(rows[j])
+		for _, o := range orders {
+			fi := fieldByName(vi, o.name)
+			fj := fieldByName(vj, o.name)
+			if !fi.IsValid() || !fj.IsValid() {
+				continue
+			}
+			c := compare(fi.Interface(), fj.Interface())
+			if c == 0 {
+				continue
+			}
+			if o.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// 按照xorm的created和updated标签设置时间
+func stampTime(md interface{}, tag string) {
+	value := goreflect.Indirect(goreflect.ValueOf(md))
+	if value.Kind() == goreflect.Struct {
+		stampTimeValue(value, tag, time.Now())
+	}
+}
+
+func stampTimeValue(value goreflect.Value, tag string, now time.Time) {
+	typ := value.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		f := value.Field(i)
+		if field.Anonymous && f.Kind() == goreflect.Struct {
+			stampTimeValue(f, tag, now)
+			continue
+		}
+		if !f.CanSet() {
+			continue
+		}
+		tags := strings.Fields(field.Tag.Get("xorm"))
+		for _, t := range tags {
+			if t == tag && field.Type == goreflect.TypeOf(&now) {
+				t := now
+				f.Set(goreflect.ValueOf(&t))
+			}
+		}
+	}
+}
+
+// 记录的过滤器，条件bean和条件都满足的时候返回true
+type filter func(row interface{}) (bool, error)
+
+// 不是Unscoped的会话忽略已经软删除的记录
+func (this *BoltSession) matcher(conds map[string]interface{}, criteria *repository.Criteria) filter {
+	return func(row interface{}) (bool, error) {
+		ok, err := this.visible(row)
+		if err != nil || !ok {
+			return false, err
+		}
+		if !match(row, conds) {
+			return false, nil
+		}
+		return evaluate(row, criteria)
+	}
+}
+
+// 记录对会话是否可见，已经软删除的记录只对Unscoped的会话可见，过滤器的条件对所有的会话有效
+func (this *BoltSession) visible(row interface{}) (bool, error) {
+	if !this.unscoped && repository.IsDeleted(row) {
+		return false, nil
+	}
+
+	return evaluate(row, repository.FilterCriteria(this.filters, row))
+}
+
+// 在内存中计算条件，null和sql一样不等于任何值
+func evaluate(row interface{}, criteria *repository.Criteria) (bool, error) {
+	if !criteria.HasCondition() {
+		return true, nil
+	}
+	switch criteria.Op {
+	case repository.Op_And:
+		for _, child := range criteria.Children {
+			ok, err := evaluate(row, child)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case repository.Op_Or:
+		for _, child := range criteria.Children {
+			ok, err := evaluate(row, child)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return len(criteria.Children) == 0, nil
+	}
+	f := fieldByName(goreflect.ValueOf(row), criteria.Field)
+	if !f.IsValid() {
+		return false, errors.New("NoField")
+	}
+	if criteria.Op == repository.Op_IsNull {
+		return isNull(f), nil
+	}
+	if isNull(f) {
+		return false, nil
+	}
+	v := f.Interface()
+	switch criteria.Op {
+	case repository.Op_Eq:
+		return compare(v, criteria.Values[0]) == 0, nil
+	case repository.Op_In:
+		for _, value := range criteria.Values {
+			if compare(v, value) == 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	case repository.Op_Between:
+		return compare(v, criteria.Values[0]) >= 0 && compare(v, criteria.Values[1]) <= 0, nil
+	case repository.Op_Gt:
+		return compare(v, criteria.Values[0]) > 0, nil
+	case repository.Op_Ge:
+		return compare(v, criteria.Values[0]) >= 0, nil
+	case repository.Op_Lt:
+		return compare(v, criteria.Values[0]) < 0, nil
+	case repository.Op_Le:
+		return compare(v, criteria.Values[0]) <= 0, nil
+	case repository.Op_Like:
+		pattern, ok := criteria.Values[0].(string)
+		if !ok {
+			return false, errors.New("NeedStringPattern")
+		}
+		return likeRegexp(pattern).MatchString(fmt.Sprintf("%v", goreflect.Indirect(f).Interface())), nil
+	}
+
+	return false, errors.New("NotSupportOp")
+}
+
+func isNull(f goreflect.Value) bool {
+	switch f.Kind() {
+	case goreflect.Ptr, goreflect.Interface, goreflect.Map, goreflect.Slice:
+		return f.IsNil()
+	}
+
+	return false
+}
+
+// sql的like模式转换成正则表达式，%匹配任意多个字符，_匹配一个字符
+func likeRegexp(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+
+	return regexp.MustCompile(expr.String())
+}
+
+// 扫描bucket中所有满足条件的记录，fn返回false的时候停止扫描
+func scan(b *bolt.Bucket, prototype interface{}, accept filter, fn func(k []byte, row interface{}) (bool, error)) error {
+	if b == nil {
+		return nil
+	}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		row := reflect.New(prototype)
+		err := message.Unmarshal(v, row)
+		if err != nil {
+			return err
+		}
+		ok, err := accept(row)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		goon, err := fn(k, row)
+		if err != nil {
+			return err
+		}
+		if !goon {
+			break
+		}
+	}
+
 	return nil
 }
 
+func (this *BoltSession) Sync(bean ...interface{}) error {
+	err := this.update(func(tx *bolt.Tx) error {
+		for _, md := range bean {
+			_, err := tx.CreateBucketIfNotExists(bucketName(md))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
+
+	return err
+}
+
 // Get retrieve one record from database, bean's non-empty fields
 // will be as conditions
 func (this *BoltSession) Get(dest interface{}, locked bool, orderby string, conds string, params ...interface{}) (bool, error) {
-	id, _ := reflect.GetValue(dest, baseentity.FieldName_Id)
-	key := fmt.Sprintf("%v", id)
-	var bucketname string
+	if conds != "" {
+		return false, errors.New("NotSupportConds")
+	}
+
+	return this.get(dest, orderby, this.matcher(conditions(dest), nil))
+}
+
+func (this *BoltSession) GetByCriteria(dest interface{}, locked bool, criteria *repository.Criteria) (bool, error) {
+	return this.get(dest, criteria.OrderBy(), this.matcher(conditions(dest), criteria))
+}
+
+func (this *BoltSession) get(dest interface{}, orderby string, accept filter) (bool, error) {
 	var found bool
-	var err error
-	if id != nil {
-		b := this.tx.Bucket([]byte(bucketname))
-		bs := b.Get([]byte(key))
-		if bs == nil {
-			found = false
+	err := this.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName(dest))
+		if b == nil {
+			return nil
+		}
+		rows := make([]interface{}, 0)
+		id, ok := repository.GetId(dest)
+		if ok {
+			bs := b.Get(keyOf(id))
+			if bs == nil {
+				return nil
+			}
+			row := reflect.New(dest)
+			err := message.Unmarshal(bs, row)
+			if err != nil {
+				return err
+			}
+			ok, err = accept(row)
+			if err != nil {
+				return err
+			}
+			if ok {
+				rows = append(rows, row)
+			}
 		} else {
-			message.Unmarshal(bs, dest)
+			err := scan(b, dest, accept, func(k []byte, row interface{}) (bool, error) {
+				rows = append(rows, row)
+				// 没有排序的时候取第一条
+				return orderby != "", nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if len(rows) > 0 {
+			sortRows(rows, orderby)
 			found = true
+			goreflect.ValueOf(dest).Elem().Set(goreflect.ValueOf(rows[0]).Elem())
 		}
-	}
+		return nil
+	})
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
@@ -68,40 +659,152 @@ func (this *BoltSession) Get(dest interface{}, locked bool, orderby string, cond
 }
 
 // Find retrieve records from table, condiBeans's non-empty fields
-// are conditions. beans could be []Struct, []*Struct, map[int64]Struct
-// map[int64]*Struct everyone := make([]Userinfo, 0)
+// are conditions. beans could be []Struct, []*Struct
+// everyone := make([]Userinfo, 0)
 // err := engine.Find(&everyone)
 func (this *BoltSession) Find(rowsSlicePtr interface{}, md interface{}, orderby string, from int, limit int, conds string, params ...interface{}) error {
-	var err error
+	if conds != "" {
+		return errors.New("NotSupportConds")
+	}
+
+	return this.find(rowsSlicePtr, orderby, from, limit, this.matcher(conditions(md), nil))
+}
+
+func (this *BoltSession) FindByCriteria(rowsSlicePtr interface{}, md interface{}, criteria *repository.Criteria, from int, limit int) error {
+	return this.find(rowsSlicePtr, criteria.OrderBy(), from, limit, this.matcher(conditions(md), criteria))
+}
 
+func (this *BoltSession) find(rowsSlicePtr interface{}, orderby string, from int, limit int, accept filter) error {
+	prototype, err := newElem(rowsSlicePtr)
+	if err != nil {
+		return err
+	}
+	err = this.view(func(tx *bolt.Tx) error {
+		rows := make([]interface{}, 0)
+		err := scan(tx.Bucket(bucketName(prototype)), prototype, accept, func(k []byte, row interface{}) (bool, error) {
+			rows = append(rows, row)
+			// 没有排序的时候可以提前结束扫描
+			return orderby != "" || limit <= 0 || len(rows) < from+limit, nil
+		})
+		if err != nil {
+			return err
+		}
+		sortRows(rows, orderby)
+		if from > len(rows) {
+			from = len(rows)
+		}
+		rows = rows[from:]
+		if limit > 0 && limit < len(rows) {
+			rows = rows[:limit]
+		}
+		for _, row := range rows {
+			appendElem(rowsSlicePtr, row)
+		}
+		return nil
+	})
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
+
 	return err
 }
 
-// insert model data to database
-func (this *BoltSession) Insert(mds ...interface{}) (int64, error) {
-	var err error
-	var affected int64
-	for md := range mds {
-		id, _ := reflect.GetValue(md, baseentity.FieldName_Id)
-		key := fmt.Sprintf("%v", id)
-		var bucketname string
-		if id != nil {
-			b := this.tx.Bucket([]byte(bucketname))
-			buf, err := message.Marshal(md)
+/*
+*
+逐条处理满足条件的记录，md的非空字段也是条件，bolt使用游标读取，忽略batchSize
+有排序的时候需要先读取全部满足条件的记录再排序
+ctx取消的时候停止处理，返回ctx的错误
+*/
+func (this *BoltSession) Iterate(ctx context.Context, md interface{}, criteria *repository.Criteria, batchSize int, fn func(row interface{}) error) error {
+	orderby := criteria.OrderBy()
+	err := this.view(func(tx *bolt.Tx) error {
+		rows := make([]interface{}, 0)
+		err := scan(tx.Bucket(bucketName(md)), md, this.matcher(conditions(md), criteria), func(k []byte, row interface{}) (bool, error) {
+			err := ctx.Err()
+			if err != nil {
+				return false, err
+			}
+			if orderby != "" {
+				rows = append(rows, row)
+				return true, nil
+			}
+			return true, fn(row)
+		})
+		if err != nil {
+			return err
+		}
+		sortRows(rows, orderby)
+		for _, row := range rows {
+			err = ctx.Err()
 			if err != nil {
-				panic(err)
+				return err
 			}
-			err = b.Put([]byte(key), buf)
+			err = fn(row)
 			if err != nil {
-				panic(err)
-			} else {
-				affected++
+				return err
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
+
+	return err
+}
+
+// 保存实体，insert为true的时候和关系数据库一样，主键已经存在就返回DuplicateKey，不覆盖
+func (this *BoltSession) put(b *bolt.Bucket, md interface{}, insert bool) error {
+	id, ok := repository.GetId(md)
+	if !ok {
+		// 整数主键为空的时候使用bucket的序列
+		_, isUint := id.(uint64)
+		if !isUint {
+			return errors.New("NoId")
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if !repository.SetId(md, seq) {
+			return errors.New("NoId")
+		}
+		id = seq
+	}
+	key := keyOf(id)
+	if insert && b.Get(key) != nil {
+		return fmt.Errorf("DuplicateKey: %T id %v", md, id)
 	}
+	buf, err := message.Marshal(md)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(key, buf)
+}
+
+// insert model data to database
+func (this *BoltSession) Insert(mds ...interface{}) (int64, error) {
+	var affected int64
+	err := this.update(func(tx *bolt.Tx) error {
+		for _, md := range mds {
+			for _, m := range toArray(md) {
+				b, err := tx.CreateBucketIfNotExists(bucketName(m))
+				if err != nil {
+					return err
+				}
+				stampTime(m, "created")
+				stampTime(m, "updated")
+				repository.InitVersion(m)
+				err = this.put(b, m, true)
+				if err != nil {
+					return err
+				}
+				affected++
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
@@ -109,41 +812,121 @@ func (this *BoltSession) Insert(mds ...interface{}) (int64, error) {
 	return affected, err
 }
 
+// 在一个写事务中新增一批实体，忽略useCopy
+func (this *BoltSession) BatchInsert(mds []interface{}, useCopy bool) (int64, error) {
+	return this.Insert(mds...)
+}
+
+// 把md中需要更新的字段复制到old中，指定columns的时候只复制指定的字段，否则复制非零值的字段
+func merge(old interface{}, md interface{}, columns []string) {
+	oldValue := goreflect.ValueOf(old)
+	mdValue := goreflect.ValueOf(md)
+	if columns != nil && len(columns) > 0 {
+		for _, column := range columns {
+			f := fieldByName(mdValue, column)
+			o := fieldByName(oldValue, column)
+			if f.IsValid() && o.IsValid() && o.CanSet() {
+				o.Set(f)
+			}
+		}
+		return
+	}
+	for name := range conditions(md) {
+		f := fieldByName(mdValue, name)
+		o := fieldByName(oldValue, name)
+		if o.CanSet() {
+			o.Set(f)
+		}
+	}
+	bools := goreflect.Indirect(mdValue)
+	for i := 0; i < bools.NumField(); i++ {
+		if bools.Field(i).Kind() == goreflect.Bool && bools.Field(i).Bool() {
+			o := fieldByName(oldValue, bools.Type().Field(i).Name)
+			if o.CanSet() {
+				o.SetBool(true)
+			}
+		}
+	}
+}
+
 // update model to database.
 // cols set the columns those want to update.
+// 在数据没有Id的时候，使用第一个参数作为条件bean
 func (this *BoltSession) Update(md interface{}, columns []string, conds string, params ...interface{}) (int64, error) {
-	var err error
+	if conds != "" {
+		return 0, errors.New("NotSupportConds")
+	}
 	var affected int64
-	var mds []interface{}
-	var ok bool
-	kind := reflect.GetIndirectType(md)
-	if kind == goreflect.Slice || kind == goreflect.Array {
-		mds, ok = md.([]interface{})
-		if !ok {
-			mds = reflect.ToArray(md)
-		}
-	} else {
-		mds = make([]interface{}, 1)
-		mds[0] = md
-	}
-	for md := range mds {
-		id, _ := reflect.GetValue(md, baseentity.FieldName_Id)
-		key := fmt.Sprintf("%v", id)
-		var bucketname string
-		if id != nil {
-			b := this.tx.Bucket([]byte(bucketname))
-			buf, err := message.Marshal(md)
-			if err != nil {
-				panic(err)
+	err := this.update(func(tx *bolt.Tx) error {
+		for _, md := range toArray(md) {
+			b := tx.Bucket(bucketName(md))
+			if b == nil {
+				continue
 			}
-			err = b.Put([]byte(key), buf)
-			if err != nil {
-				panic(err)
+			stampTime(md, "updated")
+			olds := make([]interface{}, 0)
+			// 带版本号的实体按照id更新的时候检查版本号，和xorm的version标签的行为一致
+			version, _ := repository.VersionField(md)
+			id, ok := repository.GetId(md)
+			if ok {
+				bs := b.Get(keyOf(id))
+				if bs == nil {
+					if version.IsValid() {
+						return repository.StaleEntity(md, id, version.Int())
+					}
+					continue
+				}
+				old := reflect.New(md)
+				err := message.Unmarshal(bs, old)
+				if err != nil {
+					return err
+				}
+				// 和xorm一样，不更新已经软删除的记录和不满足过滤条件的记录
+				visible, err := this.visible(old)
+				if err != nil {
+					return err
+				}
+				if !visible {
+					if version.IsValid() {
+						return repository.StaleEntity(md, id, version.Int())
+					}
+					continue
+				}
+				if version.IsValid() {
+					oldVersion, _ := repository.VersionField(old)
+					if oldVersion.Int() != version.Int() {
+						return repository.StaleEntity(md, id, version.Int())
+					}
+					version.SetInt(version.Int() + 1)
+				}
+				olds = append(olds, old)
 			} else {
+				if params == nil || len(params) == 0 {
+					return errors.New("NoId")
+				}
+				err := scan(b, md, this.matcher(conditions(params[0]), nil), func(k []byte, row interface{}) (bool, error) {
+					olds = append(olds, row)
+					return true, nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			for _, old := range olds {
+				merge(old, md, columns)
+				if ok && version.IsValid() {
+					oldVersion, _ := repository.VersionField(old)
+					oldVersion.SetInt(version.Int())
+				}
+				err := this.put(b, old, false)
+				if err != nil {
+					return err
+				}
 				affected++
 			}
 		}
-	}
+		return nil
+	})
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
@@ -154,35 +937,88 @@ func (this *BoltSession) Update(md interface{}, columns []string, conds string,
 // delete model in database
 // Delete records, bean's non-empty fields are conditions
 func (this *BoltSession) Delete(md interface{}, conds string, params ...interface{}) (int64, error) {
-	var err error
-	var affected int64
-	var mds []interface{}
-	var ok bool
-	kind := reflect.GetIndirectType(md)
-	if kind == goreflect.Slice || kind == goreflect.Array {
-		mds, ok = md.([]interface{})
-		if !ok {
-			mds = reflect.ToArray(md)
-		}
-	} else {
-		mds = make([]interface{}, 1)
-		mds[0] = md
-	}
-	for md := range mds {
-		id, _ := reflect.GetValue(md, baseentity.FieldName_Id)
-		key := fmt.Sprintf("%v", id)
-		var bucketname string
-		var err error
-		if id != nil {
-			b := this.tx.Bucket([]byte(bucketname))
-			err = b.Put([]byte(key), nil)
-			if err != nil {
+	if conds != "" {
+		return 0, errors.New("NotSupportConds")
+	}
+
+	return this.delete(md, nil)
+}
 
+// md的非空字段和条件一起作为删除的条件，都没有的时候不删除
+func (this *BoltSession) DeleteByCriteria(md interface{}, criteria *repository.Criteria) (int64, error) {
+	return this.delete(md, criteria)
+}
+
+func (this *BoltSession) delete(md interface{}, criteria *repository.Criteria) (int64, error) {
+	var affected int64
+	err := this.update(func(tx *bolt.Tx) error {
+		for _, md := range toArray(md) {
+			b := tx.Bucket(bucketName(md))
+			if b == nil {
+				continue
+			}
+			keys := make([][]byte, 0)
+			id, ok := repository.GetId(md)
+			if ok && !criteria.HasCondition() {
+				key := keyOf(id)
+				bs := b.Get(key)
+				if bs != nil {
+					row := reflect.New(md)
+					err := message.Unmarshal(bs, row)
+					if err != nil {
+						return err
+					}
+					// 已经软删除的记录和不满足过滤条件的记录不删除
+					visible, err := this.visible(row)
+					if err != nil {
+						return err
+					}
+					if visible {
+						keys = append(keys, key)
+					}
+				}
 			} else {
+				cs := conditions(md)
+				// 和xorm一样，不允许没有条件的删除
+				if len(cs) == 0 && !criteria.HasCondition() {
+					return errors.New("NoCondition")
+				}
+				err := scan(b, md, this.matcher(cs, criteria), func(k []byte, row interface{}) (bool, error) {
+					keys = append(keys, append([]byte{}, k...))
+					return true, nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			// 支持软删除的实体只设置删除时间
+			soft := false
+			if !this.unscoped {
+				f, _ := repository.DeletedField(md)
+				soft = f.IsValid()
+			}
+			now := time.Now()
+			for _, key := range keys {
+				var err error
+				if soft {
+					row := reflect.New(md)
+					err = message.Unmarshal(b.Get(key), row)
+					if err != nil {
+						return err
+					}
+					repository.SetDeleted(row, &now)
+					err = this.put(b, row, false)
+				} else {
+					err = b.Delete(key)
+				}
+				if err != nil {
+					return err
+				}
 				affected++
 			}
 		}
-	}
+		return nil
+	})
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
@@ -190,22 +1026,41 @@ func (this *BoltSession) Delete(md interface{}, conds string, params ...interfac
 	return affected, err
 }
 
-// execute sql and get result
+// bolt不支持sql
 func (this *BoltSession) Exec(clause string, params ...interface{}) (sql.Result, error) {
-
-	return nil, nil
+	return nil, errors.New("NotSupport")
 }
 
-// execute sql and get result
+// bolt不支持sql
 func (this *BoltSession) Query(clause string, params ...interface{}) ([]map[string][]byte, error) {
-
-	return nil, nil
+	return nil, errors.New("NotSupport")
 }
 
 func (this *BoltSession) Count(bean interface{}, conds string, params ...interface{}) (int64, error) {
+	if conds != "" {
+		return 0, errors.New("NotSupportConds")
+	}
+
+	return this.count(bean, this.matcher(conditions(bean), nil))
+}
+
+func (this *BoltSession) CountByCriteria(bean interface{}, criteria *repository.Criteria) (int64, error) {
+	return this.count(bean, this.matcher(conditions(bean), criteria))
+}
+
+func (this *BoltSession) count(bean interface{}, accept filter) (int64, error) {
 	var count int64
+	err := this.view(func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(bucketName(bean)), bean, accept, func(k []byte, row interface{}) (bool, error) {
+			count++
+			return true, nil
+		})
+	})
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
 
-	return count, nil
+	return count, err
 }
 
 /*
@@ -213,32 +1068,32 @@ func (this *BoltSession) Count(bean interface{}, conds string, params ...interfa
 
 		Transaction 的 f 参数类型为 一个在事务内处理的函数
 	    因此可以将 f 函数作为参数传入 Transaction 函数中。
-	    return Transaction(func(s *XormSession) error {
+	    return Transaction(func(s *BoltSession) error {
 	        if _,error := session.Insert(User{ID:5,Version:"abc"}); error != nil{
 	            return error
 	        }
 		})
 */
-func (this *BoltSession) Transaction(fc func(s repository.DbSession) error) error {
+func (this *BoltSession) Transaction(fc func(s repository.DbSession) error) (err error) {
 	defer this.Close()
-	tx, err := boltdb.Begin(true)
+	err = this.Begin()
 	if err != nil {
-		logger.Sugar.Errorf("%v", err.Error())
+		return err
 	}
 	defer func() {
 		if p := recover(); p != nil {
 			logger.Sugar.Errorf("recover rollback:%s\r\n", p)
-			tx.Rollback()
+			this.Rollback()
 			panic(p) // re-throw panic after Rollback
 		} else if err != nil {
 			logger.Sugar.Errorf("error rollback:%s\r\n", err)
-			tx.Rollback() // err is non-nil; don't change it
+			this.Rollback() // err is non-nil; don't change it
 		} else {
-			err = tx.Commit() // err is nil; if Commit returns error update err
+			err = this.Commit() // err is nil; if Commit returns error update err
 		}
 	}()
 	// 执行在事务内的处理
-	err = fc(&BoltSession{tx: tx})
+	err = fc(this)
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
@@ -246,18 +1101,54 @@ func (this *BoltSession) Transaction(fc func(s repository.DbSession) error) erro
 	return err
 }
 
+// bolt的操作不能中途取消，只在每个操作开始前检查ctx
+func (this *BoltSession) WithContext(ctx context.Context) repository.DbSession {
+	this.ctx = ctx
+
+	return this
+}
+
+// 包括软删除的记录的会话，删除的时候物理删除，和原来的会话共用事务
+func (this *BoltSession) Unscoped() repository.DbSession {
+	s := *this
+	s.unscoped = true
+
+	return &s
+}
+
+// 加上过滤器的会话，和原来的会话共用事务
+func (this *BoltSession) Filter(filters ...repository.Filter) repository.DbSession {
+	s := *this
+	s.filters = append(append([]repository.Filter{}, this.filters...), filters...)
+
+	return &s
+}
+
+// 去掉过滤器的会话，和原来的会话共用事务
+func (this *BoltSession) Unfiltered() repository.DbSession {
+	s := *this
+	s.filters = nil
+
+	return &s
+}
+
 func (this *BoltSession) Begin() error {
-	tx, err := boltdb.Begin(true)
+	tx, err := this.db.Begin(true)
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
+		return err
 	}
 	this.tx = tx
 
-	return err
+	return nil
 }
 
 func (this *BoltSession) Rollback() error {
+	if this.tx == nil {
+		return nil
+	}
 	err := this.tx.Rollback()
+	this.tx = nil
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
@@ -266,7 +1157,11 @@ func (this *BoltSession) Rollback() error {
 }
 
 func (this *BoltSession) Commit() error {
+	if this.tx == nil {
+		return nil
+	}
 	err := this.tx.Commit()
+	this.tx = nil
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
@@ -274,16 +1169,23 @@ func (this *BoltSession) Commit() error {
 	return err
 }
 
+// 关闭会话，没有提交的事务回滚
 func (this *BoltSession) Close() error {
-	return nil
+	return this.Rollback()
 }
 
 // scan result
 func (this *BoltSession) Scan(dest interface{}) (*BoltSession, error) {
+	_, err := this.Get(dest, false, "", "")
 
-	return this, nil
+	return this, err
 }
 
-func (this *BoltSession) Complex(qb *repository.QueryBuilder, dest []interface{}) error {
-	return nil
+func (this *BoltSession) Complex(qb *repository.QueryBuilder, dest interface{}) error {
+	return errors.New("NotSupport")
+}
+
+// 批量新增或者修改，逐条按照冲突键查找已有的记录，见repository.UpsertEach
+func (this *BoltSession) UpsertBatch(mds []interface{}, conflictColumns []string, updateColumns []string) (int64, int64, error) {
+	return repository.UpsertEach(this, mds, conflictColumns, updateColumns)
 }
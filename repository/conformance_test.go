@@ -0,0 +1,325 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/curltech/go-colla-core/config"
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+	"github.com/curltech/go-colla-core/repository/bolt"
+	"github.com/curltech/go-colla-core/repository/gorm"
+	"github.com/curltech/go-colla-core/repository/xorm"
+)
+
+type conformanceRow struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	Name                  string `xorm:"varchar(32)"`
+	Amount                int64
+}
+
+func (conformanceRow) TableName() string {
+	return "conformance_row"
+}
+
+// 没有创建和修改时间的字段，xorm多行新增的时候逐条回填时间很慢
+type batchRow struct {
+	Id   uint64 `xorm:"pk"`
+	Name string `xorm:"varchar(32)"`
+}
+
+func (batchRow) TableName() string {
+	return "conformance_batch"
+}
+
+// 支持sql条件的驱动
+var sqlDrivers = map[string]repository.DriverFactory{"xorm": xorm.Open, "gorm": gorm.Open}
+
+// 所有的驱动，bolt不支持sql条件和复杂查询
+var allDrivers = map[string]repository.DriverFactory{"xorm": xorm.Open, "gorm": gorm.Open, "bolt": bolt.Open}
+
+// 每个驱动在临时目录的数据库上打开一个引擎，xorm和gorm使用sqlite
+func conformanceEngines(t *testing.T, drivers map[string]repository.DriverFactory) map[string]repository.DbEngine {
+	engines := make(map[string]repository.DbEngine)
+	for name, open := range drivers {
+		params := &config.DbParams{Drivername: "sqlite3", Dsn: filepath.Join(t.TempDir(), name+".db"), MaxOpenConns: 1}
+		engine, err := open(params)
+		if err != nil {
+			t.Fatalf("%v open: %v", name, err)
+		}
+		t.Cleanup(func() { engine.Close() })
+		err = engine.NewSession().Sync(new(conformanceRow))
+		if err != nil {
+			t.Fatalf("%v sync: %v", name, err)
+		}
+		engines[name] = engine
+	}
+
+	return engines
+}
+
+// 新增三条记录，id是1，2，3，Amount是10，20，30
+func seedRows(t *testing.T, engine repository.DbEngine) {
+	for i := 1; i <= 3; i++ {
+		row := &conformanceRow{Name: string(rune('a' + i - 1)), Amount: int64(i * 10)}
+		row.Id = uint64(i)
+		_, err := engine.NewSession().Insert(row)
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+}
+
+type conformanceCase struct {
+	name string
+	run  func(t *testing.T, engine repository.DbEngine)
+}
+
+// 每个用例在每个驱动的新数据库上执行，先新增三条记录
+func runConformance(t *testing.T, drivers map[string]repository.DriverFactory, cases []conformanceCase) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for name, engine := range conformanceEngines(t, drivers) {
+				t.Run(name, func(t *testing.T) {
+					seedRows(t, engine)
+					c.run(t, engine)
+				})
+			}
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	cases := []conformanceCase{
+		{"InsertGet", func(t *testing.T, engine repository.DbEngine) {
+			row := &conformanceRow{}
+			row.Id = 2
+			found, err := engine.NewSession().Get(row, false, "", "")
+			if err != nil || !found || row.Name != "b" || row.Amount != 20 {
+				t.Fatalf("get: %v %v %+v", found, err, row)
+			}
+			row = &conformanceRow{}
+			found, err = engine.NewSession().Get(row, false, "", "amount = ?", 30)
+			if err != nil || !found || row.Id != 3 {
+				t.Fatalf("get by conds: %v %v %+v", found, err, row)
+			}
+			row = &conformanceRow{}
+			row.Id = 9
+			found, err = engine.NewSession().Get(row, false, "", "")
+			if err != nil || found {
+				t.Fatalf("get missing: %v %v", found, err)
+			}
+		}},
+		{"Find", func(t *testing.T, engine repository.DbEngine) {
+			rows := make([]*conformanceRow, 0)
+			err := engine.NewSession().Find(&rows, nil, "amount desc", 0, 2, "amount > ?", 5)
+			if err != nil || len(rows) != 2 || rows[0].Id != 3 || rows[1].Id != 2 {
+				t.Fatalf("find: %v %v", err, rows)
+			}
+			rows = make([]*conformanceRow, 0)
+			err = engine.NewSession().Find(&rows, nil, "amount", 1, 5, "")
+			if err != nil || len(rows) != 2 || rows[0].Id != 2 {
+				t.Fatalf("find offset: %v %v", err, rows)
+			}
+		}},
+		{"FindByCriteria", func(t *testing.T, engine repository.DbEngine) {
+			rows := make([]*conformanceRow, 0)
+			criteria := repository.And(repository.Ge("Amount", 20), repository.In("Name", "a", "b", "c")).Sort("Amount", true)
+			err := engine.NewSession().FindByCriteria(&rows, nil, criteria, 0, 0)
+			if err != nil || len(rows) != 2 || rows[0].Id != 3 {
+				t.Fatalf("find by criteria: %v %v", err, rows)
+			}
+			count, err := engine.NewSession().CountByCriteria(new(conformanceRow), repository.Or(repository.Eq("Name", "a"), repository.Eq("Name", "c")))
+			if err != nil || count != 2 {
+				t.Fatalf("count by criteria: %v %v", count, err)
+			}
+			row := &conformanceRow{}
+			found, err := engine.NewSession().GetByCriteria(row, false, repository.Like("Name", "b%"))
+			if err != nil || !found || row.Id != 2 {
+				t.Fatalf("get by criteria: %v %v %+v", found, err, row)
+			}
+		}},
+		{"Update", func(t *testing.T, engine repository.DbEngine) {
+			row := &conformanceRow{Name: "bb", Amount: 0}
+			row.Id = 2
+			affected, err := engine.NewSession().Update(row, []string{"Name", "Amount"}, "")
+			if err != nil || affected != 1 {
+				t.Fatalf("update: %v %v", affected, err)
+			}
+			got := &conformanceRow{}
+			got.Id = 2
+			engine.NewSession().Get(got, false, "", "")
+			if got.Name != "bb" || got.Amount != 0 {
+				t.Fatalf("updated: %+v", got)
+			}
+		}},
+		{"Delete", func(t *testing.T, engine repository.DbEngine) {
+			row := &conformanceRow{}
+			row.Id = 1
+			affected, err := engine.NewSession().Delete(row, "")
+			if err != nil || affected != 1 {
+				t.Fatalf("delete: %v %v", affected, err)
+			}
+			affected, err = engine.NewSession().DeleteByCriteria(new(conformanceRow), repository.Gt("Amount", 25))
+			if err != nil || affected != 1 {
+				t.Fatalf("delete by criteria: %v %v", affected, err)
+			}
+			count, err := engine.NewSession().Count(new(conformanceRow), "")
+			if err != nil || count != 1 {
+				t.Fatalf("count: %v %v", count, err)
+			}
+		}},
+		{"Count", func(t *testing.T, engine repository.DbEngine) {
+			count, err := engine.NewSession().Count(new(conformanceRow), "amount >= ?", 20)
+			if err != nil || count != 2 {
+				t.Fatalf("count: %v %v", count, err)
+			}
+		}},
+		{"Complex", func(t *testing.T, engine repository.DbEngine) {
+			type total struct {
+				Name   string
+				Amount int64
+			}
+			totals := make([]*total, 0)
+			qb := &repository.QueryBuilder{
+				Select:  "name, sum(amount) AS amount",
+				From:    new(conformanceRow),
+				Where:   "amount > ?",
+				Args:    []interface{}{10},
+				GroupBy: "name",
+				OrderBy: "name",
+				Limit:   5,
+			}
+			err := engine.NewSession().Complex(qb, &totals)
+			if err != nil || len(totals) != 2 || totals[0].Name != "b" || totals[1].Amount != 30 {
+				t.Fatalf("complex: %v %v", err, totals)
+			}
+		}},
+		{"OffsetWithoutLimit", func(t *testing.T, engine repository.DbEngine) {
+			rows := make([]*conformanceRow, 0)
+			err := engine.NewSession().Complex(&repository.QueryBuilder{From: new(conformanceRow), OrderBy: "id", Offset: 1}, &rows)
+			if err != nil || len(rows) != 2 || rows[0].Id != 2 {
+				t.Fatalf("offset: %v %v", err, rows)
+			}
+		}},
+		{"InvalidField", func(t *testing.T, engine repository.DbEngine) {
+			rows := make([]*conformanceRow, 0)
+			err := engine.NewSession().FindByCriteria(&rows, nil, repository.Eq("name = name OR 1", 1), 0, 0)
+			if !errors.Is(err, repository.ErrInvalidField) {
+				t.Fatalf("field: %v %v", err, rows)
+			}
+			err = engine.NewSession().FindByCriteria(&rows, nil, repository.Sort("(SELECT 1)", false), 0, 0)
+			if !errors.Is(err, repository.ErrInvalidField) {
+				t.Fatalf("sort: %v %v", err, rows)
+			}
+		}},
+		{"WithContext", func(t *testing.T, engine repository.DbEngine) {
+			session := engine.NewSession().WithContext(context.Background())
+			rows := make([]*conformanceRow, 0)
+			err := session.Find(&rows, nil, "", 0, 0, "")
+			if err != nil || len(rows) != 3 {
+				t.Fatalf("find: %v %v", err, rows)
+			}
+			// 没有事务的时候关闭会话不回滚
+			err = session.Close()
+			if err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err = engine.NewSession().WithContext(ctx).Find(&rows, nil, "", 0, 0, "")
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("canceled: %v", err)
+			}
+		}},
+		{"BatchInsert", func(t *testing.T, engine repository.DbEngine) {
+			err := engine.NewSession().Sync(new(batchRow))
+			if err != nil {
+				t.Fatalf("sync: %v", err)
+			}
+			// 参数个数超过一条语句的上限，要分批插入
+			mds := make([]interface{}, 40000)
+			for i := range mds {
+				mds[i] = &batchRow{Id: uint64(i + 1), Name: "batch"}
+			}
+			affected, err := engine.NewSession().BatchInsert(mds, false)
+			if err != nil || affected != int64(len(mds)) {
+				t.Fatalf("batch insert: %v %v", affected, err)
+			}
+			count, _ := engine.NewSession().Count(new(batchRow), "")
+			if count != int64(len(mds)) {
+				t.Fatalf("count after batch insert: %v", count)
+			}
+			_, err = engine.NewSession().BatchInsert([]interface{}{&batchRow{}, &conformanceRow{}}, false)
+			if err == nil {
+				t.Fatalf("batch of different types")
+			}
+		}},
+		{"Transaction", func(t *testing.T, engine repository.DbEngine) {
+			failure := errors.New("rollback")
+			err := engine.NewSession().Transaction(func(s repository.DbSession) error {
+				row := &conformanceRow{Name: "d"}
+				row.Id = 4
+				_, err := s.Insert(row)
+				if err != nil {
+					return err
+				}
+				return failure
+			})
+			if !errors.Is(err, failure) {
+				t.Fatalf("rollback: %v", err)
+			}
+			err = engine.NewSession().Transaction(func(s repository.DbSession) error {
+				row := &conformanceRow{Name: "e"}
+				row.Id = 5
+				_, err := s.Insert(row)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("commit: %v", err)
+			}
+			count, _ := engine.NewSession().Count(new(conformanceRow), "")
+			if count != 4 {
+				t.Fatalf("count after transactions: %v", count)
+			}
+		}},
+	}
+	runConformance(t, sqlDrivers, cases)
+}
+
+// 所有的驱动包括bolt都要遵守的约定
+func TestDriverConformance(t *testing.T) {
+	cases := []conformanceCase{
+		{"DuplicateInsert", func(t *testing.T, engine repository.DbEngine) {
+			row := &conformanceRow{Name: "x"}
+			row.Id = 2
+			_, err := engine.NewSession().Insert(row)
+			if err == nil {
+				t.Fatalf("insert duplicate key")
+			}
+			mds := []interface{}{&conformanceRow{Name: "y"}, &conformanceRow{Name: "z"}}
+			mds[0].(*conformanceRow).Id = 4
+			mds[1].(*conformanceRow).Id = 3
+			_, err = engine.NewSession().BatchInsert(mds, false)
+			if err == nil {
+				t.Fatalf("batch insert duplicate key")
+			}
+			// 已有的记录没有被覆盖，失败的一批没有新增
+			got := &conformanceRow{}
+			got.Id = 2
+			found, err := engine.NewSession().Get(got, false, "", "")
+			if err != nil || !found || got.Name != "b" {
+				t.Fatalf("overwritten: %v %v %+v", found, err, got)
+			}
+			got = &conformanceRow{}
+			got.Id = 4
+			found, err = engine.NewSession().Get(got, false, "", "")
+			if err != nil || found {
+				t.Fatalf("partial batch: %v %v", found, err)
+			}
+		}},
+	}
+	runConformance(t, allDrivers, cases)
+}
@@ -0,0 +1,272 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+const (
+	Op_Eq      string = "Eq"
+	Op_In      string = "In"
+	Op_Between string = "Between"
+	Op_Like    string = "Like"
+	Op_IsNull  string = "IsNull"
+	Op_Gt      string = "Gt"
+	Op_Ge      string = "Ge"
+	Op_Lt      string = "Lt"
+	Op_Le      string = "Le"
+	Op_And     string = "And"
+	Op_Or      string = "Or"
+)
+
+type Order struct {
+	Field string
+	Desc  bool
+}
+
+/*
+*
+类型化的查询条件，和具体的数据库无关，由各个DbSession自己翻译，比如
+
+	criteria := repository.Eq("status", entity.EntityStatus_Effective).
+		And(repository.Like("name", "a%"), repository.Or(repository.IsNull("statusdate"), repository.Between("lifetime", 1, 10))).
+		Sort("createdate", true)
+
+Field是列名，bolt忽略大小写和下划线匹配实体的字段，见FieldByColumn
+Like的模式和sql相同，%匹配任意多个字符，_匹配一个字符
+*/
+type Criteria struct {
+	Op       string
+	Field    string
+	Values   []interface{}
+	Children []*Criteria
+	Orders   []Order
+}
+
+func Eq(field string, value interface{}) *Criteria {
+	return &Criteria{Op: Op_Eq, Field: field, Values: []interface{}{value}}
+}
+
+// 参数可以是多个值，也可以是一个切片
+func In(field string, values ...interface{}) *Criteria {
+	if len(values) == 1 {
+		v := reflect.ValueOf(values[0])
+		if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+			values = make([]interface{}, v.Len())
+			for i := 0; i < v.Len(); i++ {
+				values[i] = v.Index(i).Interface()
+			}
+		}
+	}
+
+	return &Criteria{Op: Op_In, Field: field, Values: values}
+}
+
+func Between(field string, from interface{}, to interface{}) *Criteria {
+	return &Criteria{Op: Op_Between, Field: field, Values: []interface{}{from, to}}
+}
+
+func Like(field string, pattern string) *Criteria {
+	return &Criteria{Op: Op_Like, Field: field, Values: []interface{}{pattern}}
+}
+
+func IsNull(field string) *Criteria {
+	return &Criteria{Op: Op_IsNull, Field: field}
+}
+
+func Gt(field string, value interface{}) *Criteria {
+	return &Criteria{Op: Op_Gt, Field: field, Values: []interface{}{value}}
+}
+
+func Ge(field string, value interface{}) *Criteria {
+	return &Criteria{Op: Op_Ge, Field: field, Values: []interface{}{value}}
+}
+
+func Lt(field string, value interface{}) *Criteria {
+	return &Criteria{Op: Op_Lt, Field: field, Values: []interface{}{value}}
+}
+
+func Le(field string, value interface{}) *Criteria {
+	return &Criteria{Op: Op_Le, Field: field, Values: []interface{}{value}}
+}
+
+// 忽略为nil的条件
+func And(criterias ...*Criteria) *Criteria {
+	return group(Op_And, criterias)
+}
+
+// 忽略为nil的条件
+func Or(criterias ...*Criteria) *Criteria {
+	return group(Op_Or, criterias)
+}
+
+func group(op string, criterias []*Criteria) *Criteria {
+	children := make([]*Criteria, 0, len(criterias))
+	for _, c := range criterias {
+		if c != nil && c.Op != "" {
+			children = append(children, c)
+		}
+	}
+
+	return &Criteria{Op: op, Children: children}
+}
+
+// 只有排序没有条件
+func Sort(field string, desc bool) *Criteria {
+	return (&Criteria{}).Sort(field, desc)
+}
+
+// 和其他条件组成And，排序保留在返回的条件上
+func (this *Criteria) And(criterias ...*Criteria) *Criteria {
+	c := And(append([]*Criteria{this}, criterias...)...)
+	c.Orders = this.Orders
+
+	return c
+}
+
+// 和其他条件组成Or，排序保留在返回的条件上
+func (this *Criteria) Or(criterias ...*Criteria) *Criteria {
+	c := Or(append([]*Criteria{this}, criterias...)...)
+	c.Orders = this.Orders
+
+	return c
+}
+
+// 增加排序字段，返回自己，可以连续调用
+func (this *Criteria) Sort(field string, desc bool) *Criteria {
+	this.Orders = append(this.Orders, Order{Field: field, Desc: desc})
+
+	return this
+}
+
+// 是否有条件，只有排序的条件返回false
+func (this *Criteria) HasCondition() bool {
+	return this != nil && this.Op != ""
+}
+
+// 去掉排序的条件，用于计数和删除
+func (this *Criteria) Unordered() *Criteria {
+	if this == nil {
+		return nil
+	}
+	c := *this
+	c.Orders = nil
+
+	return &c
+}
+
+// 排序转换成orderby的字符串，比如"createdate desc, id"
+func (this *Criteria) OrderBy() string {
+	if this == nil {
+		return ""
+	}
+	orders := make([]string, 0, len(this.Orders))
+	for _, o := range this.Orders {
+		if o.Desc {
+			orders = append(orders, o.Field+" desc")
+		} else {
+			orders = append(orders, o.Field)
+		}
+	}
+
+	return strings.Join(orders, ", ")
+}
+
+func (this *Criteria) String() string {
+	if this == nil || this.Op == "" {
+		return ""
+	}
+	switch this.Op {
+	case Op_And, Op_Or:
+		children := make([]string, len(this.Children))
+		for i, c := range this.Children {
+			children[i] = c.String()
+		}
+		return fmt.Sprintf("%v(%v)", this.Op, strings.Join(children, ", "))
+	}
+
+	return fmt.Sprintf("%v(%v %v)", this.Op, this.Field, this.Values)
+}
+
+// 条件或者排序的字段名不合法
+var ErrInvalidField = errors.New("InvalidField")
+
+// 字段名会拼接到sql中，只允许字母，数字，下划线和表别名的点
+var fieldPattern = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+
+/*
+*
+检查条件和排序中的字段名，有不合法的字段名的时候返回ErrInvalidField，翻译成sql之前调用
+*/
+func (this *Criteria) Check() error {
+	if this == nil {
+		return nil
+	}
+	if this.Op != "" && this.Op != Op_And && this.Op != Op_Or && !fieldPattern.MatchString(this.Field) {
+		return fmt.Errorf("%w: %v", ErrInvalidField, this.Field)
+	}
+	for _, o := range this.Orders {
+		if !fieldPattern.MatchString(o.Field) {
+			return fmt.Errorf("%w: %v", ErrInvalidField, o.Field)
+		}
+	}
+	for _, c := range this.Children {
+		err := c.Check()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 查找列名对应的字段，忽略大小写和下划线，所以字段名和列名都可以使用
+func FieldByColumn(value reflect.Value, column string) reflect.Value {
+	value = reflect.Indirect(value)
+	if value.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	column = normalize(column)
+	return value.FieldByNameFunc(func(n string) bool {
+		return normalize(n) == column
+	})
+}
+
+// 查找带指定xorm标签的字段，包括匿名嵌入的结构中的字段，accept判断字段的类型
+func taggedField(value reflect.Value, tag string, accept func(typ reflect.Type) bool) (reflect.Value, string) {
+	typ := value.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		f := value.Field(i)
+		if field.Anonymous && f.Kind() == reflect.Struct {
+			v, name := taggedField(f, tag, accept)
+			if v.IsValid() {
+				return v, name
+			}
+			continue
+		}
+		if !accept(field.Type) {
+			continue
+		}
+		for _, t := range strings.Fields(field.Tag.Get("xorm")) {
+			if t == tag && f.CanSet() {
+				return f, field.Name
+			}
+		}
+	}
+
+	return reflect.Value{}, ""
+}
+
+func normalize(name string) string {
+	name = strings.TrimSpace(name)
+	// 去掉表的别名
+	i := strings.LastIndex(name, ".")
+	if i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
@@ -1,44 +1,204 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	baseentity "github.com/curltech/go-colla-core/entity"
 	"github.com/curltech/go-colla-core/util/reflect"
+	"math"
+	"strings"
 )
 
+/*
+*
+复杂查询的构造器，Clause不为空的时候直接执行Clause，Args是Clause的参数，忽略其他部分
+From可以是表名，实体或者作为子查询的*QueryBuilder，Alias是From的别名，子查询必须有别名
+Join是连接的列表，比如
+Join: []JoinClause{{Type: "LEFT", Table: "bas_sessiondata d", On: "d.sessionid = s.sessionid"}}
+Args是Where的参数，HavingArgs是Having的参数
+Union的查询依次用UNION连接，UnionAll为true的时候使用UNION ALL，OrderBy，Limit和Offset作用于整个结果
+*/
 type QueryBuilder struct {
 	Clause     string
 	Select     string
 	Distinct   []string
 	From       interface{}
-	Join       []string
-	On         string
+	Alias      string
+	Join       []JoinClause
 	Where      string
 	OrderBy    string
 	GroupBy    string
+	Having     string
+	HavingArgs []interface{}
+	Union      []*QueryBuilder
+	UnionAll   bool
 	Limit      int
 	Offset     int
 	Args       []interface{}
 	Containers []interface{}
 }
 
+// 连接，Type是INNER，LEFT，RIGHT，FULL等，缺省是INNER，Args是On的参数
+type JoinClause struct {
+	Type  string
+	Table string
+	On    string
+	Args  []interface{}
+}
+
+/*
+*
+生成带?参数的sql和参数，tableName把作为From的实体转换成表名
+*/
+func (this *QueryBuilder) ToSql(tableName func(bean interface{}) string) (string, []interface{}, error) {
+	if this.Clause != "" {
+		return this.Clause, this.Args, nil
+	}
+	sql, args, err := this.selectSql(tableName)
+	if err != nil {
+		return "", nil, err
+	}
+	var buf strings.Builder
+	buf.WriteString(sql)
+	for _, union := range this.Union {
+		s, a, err := union.selectSql(tableName)
+		if err != nil {
+			return "", nil, err
+		}
+		if this.UnionAll {
+			buf.WriteString(" UNION ALL ")
+		} else {
+			buf.WriteString(" UNION ")
+		}
+		buf.WriteString(s)
+		args = append(args, a...)
+	}
+	if this.OrderBy != "" {
+		buf.WriteString(" ORDER BY ")
+		buf.WriteString(this.OrderBy)
+	}
+	if this.Limit > 0 {
+		buf.WriteString(fmt.Sprintf(" LIMIT %v", this.Limit))
+	} else if this.Offset > 0 {
+		// sqlite和mysql的OFFSET必须跟在LIMIT后面，用最大的整数表示不限制
+		buf.WriteString(fmt.Sprintf(" LIMIT %v", int64(math.MaxInt64)))
+	}
+	if this.Offset > 0 {
+		buf.WriteString(fmt.Sprintf(" OFFSET %v", this.Offset))
+	}
+
+	return buf.String(), args, nil
+}
+
+// 生成不包括Union，OrderBy，Limit和Offset的部分
+func (this *QueryBuilder) selectSql(tableName func(bean interface{}) string) (string, []interface{}, error) {
+	args := make([]interface{}, 0)
+	var buf strings.Builder
+	buf.WriteString("SELECT ")
+	if len(this.Distinct) > 0 {
+		buf.WriteString("DISTINCT ")
+		buf.WriteString(strings.Join(this.Distinct, ", "))
+		if this.Select != "" {
+			buf.WriteString(", ")
+			buf.WriteString(this.Select)
+		}
+	} else if this.Select != "" {
+		buf.WriteString(this.Select)
+	} else {
+		buf.WriteString("*")
+	}
+	buf.WriteString(" FROM ")
+	switch from := this.From.(type) {
+	case nil:
+		return "", nil, errors.New("NoFrom")
+	case string:
+		buf.WriteString(from)
+	case *QueryBuilder:
+		if this.Alias == "" {
+			return "", nil, errors.New("SubqueryNeedAlias")
+		}
+		s, a, err := from.ToSql(tableName)
+		if err != nil {
+			return "", nil, err
+		}
+		buf.WriteString("(")
+		buf.WriteString(s)
+		buf.WriteString(")")
+		args = append(args, a...)
+	default:
+		buf.WriteString(tableName(from))
+	}
+	if this.Alias != "" {
+		buf.WriteString(" ")
+		buf.WriteString(this.Alias)
+	}
+	for _, join := range this.Join {
+		joinType := join.Type
+		if joinType == "" {
+			joinType = "INNER"
+		}
+		buf.WriteString(fmt.Sprintf(" %v JOIN %v ON %v", strings.ToUpper(joinType), join.Table, join.On))
+		args = append(args, join.Args...)
+	}
+	if this.Where != "" {
+		buf.WriteString(" WHERE ")
+		buf.WriteString(this.Where)
+		args = append(args, this.Args...)
+	}
+	if this.GroupBy != "" {
+		buf.WriteString(" GROUP BY ")
+		buf.WriteString(this.GroupBy)
+	}
+	if this.Having != "" {
+		buf.WriteString(" HAVING ")
+		buf.WriteString(this.Having)
+		args = append(args, this.HavingArgs...)
+	}
+
+	return buf.String(), args, nil
+}
+
 type DbSession interface {
 	Sync(bean ...interface{}) error
 	Get(dest interface{}, locked bool, orderby string, conds string, params ...interface{}) (bool, error)
 	Find(rowsSlicePtr interface{}, md interface{}, orderby string, from int, limit int, conds string, params ...interface{}) error
 	Insert(mds ...interface{}) (int64, error)
+	BatchInsert(mds []interface{}, useCopy bool) (int64, error)
 	Update(md interface{}, columns []string, conds string, params ...interface{}) (int64, error)
+	UpsertBatch(mds []interface{}, conflictColumns []string, updateColumns []string) (int64, int64, error)
 	Delete(md interface{}, conds string, params ...interface{}) (int64, error)
 	Exec(clause string, params ...interface{}) (sql.Result, error)
 	Query(clause string, params ...interface{}) ([]map[string][]byte, error)
 	Count(bean interface{}, conds string, params ...interface{}) (int64, error)
+	Complex(qb *QueryBuilder, dest interface{}) error
+	GetByCriteria(dest interface{}, locked bool, criteria *Criteria) (bool, error)
+	FindByCriteria(rowsSlicePtr interface{}, md interface{}, criteria *Criteria, from int, limit int) error
+	CountByCriteria(bean interface{}, criteria *Criteria) (int64, error)
+	DeleteByCriteria(md interface{}, criteria *Criteria) (int64, error)
+	Iterate(ctx context.Context, md interface{}, criteria *Criteria, batchSize int, fn func(row interface{}) error) error
 	Transaction(fc func(s DbSession) error) error
+	WithContext(ctx context.Context) DbSession
+	Unscoped() DbSession
+	Filter(filters ...Filter) DbSession
+	Unfiltered() DbSession
 	Begin() error
 	Rollback() error
 	Commit() error
 	Close() error
 }
 
+/*
+*
+支持保存点的会话实现这个接口，嵌套的事务使用保存点实现部分回滚
+*/
+type Savepointer interface {
+	Savepoint(name string) error
+	RollbackTo(name string) error
+	ReleaseSavepoint(name string) error
+}
+
 func GetId(md interface{}) (interface{}, bool) {
 	var id interface{}
 	idnames, _ := reflect.Call(md, "IdName", nil)
@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestQueryBuilderToSql(t *testing.T) {
+	tableName := func(bean interface{}) string { return "t" }
+	cases := []struct {
+		name string
+		qb   *QueryBuilder
+		sql  string
+		args int
+	}{
+		{"limit", &QueryBuilder{From: "t", Limit: 10, Offset: 20}, "SELECT * FROM t LIMIT 10 OFFSET 20", 0},
+		{"offset without limit", &QueryBuilder{From: "t", Offset: 20}, "SELECT * FROM t LIMIT 9223372036854775807 OFFSET 20", 0},
+		{"no paging", &QueryBuilder{From: "t", Where: "a = ?", Args: []interface{}{1}}, "SELECT * FROM t WHERE a = ?", 1},
+		{"subquery", &QueryBuilder{From: &QueryBuilder{From: "t", Where: "a = ?", Args: []interface{}{1}}, Alias: "s", Where: "b = ?", Args: []interface{}{2}},
+			"SELECT * FROM (SELECT * FROM t WHERE a = ?) s WHERE b = ?", 2},
+		{"union", &QueryBuilder{From: "t", Union: []*QueryBuilder{{From: "u"}}, UnionAll: true, OrderBy: "id", Offset: 5},
+			"SELECT * FROM t UNION ALL SELECT * FROM u ORDER BY id LIMIT 9223372036854775807 OFFSET 5", 0},
+	}
+	for _, c := range cases {
+		sql, args, err := c.qb.ToSql(tableName)
+		if err != nil || sql != c.sql || len(args) != c.args {
+			t.Errorf("%v: %v %v %v", c.name, sql, args, err)
+		}
+	}
+	_, _, err := (&QueryBuilder{From: &QueryBuilder{From: "t"}}).ToSql(tableName)
+	if err == nil || !strings.Contains(err.Error(), "SubqueryNeedAlias") {
+		t.Errorf("subquery without alias: %v", err)
+	}
+}
+
+func TestCriteriaCheck(t *testing.T) {
+	valid := []*Criteria{
+		nil,
+		Eq("name", 1),
+		And(Eq("s.name", 1), Or(IsNull("Delete_Date"), In("id", 1, 2))).Sort("createdate", true),
+		Sort("id", false),
+	}
+	for _, c := range valid {
+		if err := c.Check(); err != nil {
+			t.Errorf("%v: %v", c, err)
+		}
+	}
+	invalid := []*Criteria{
+		Eq("name = 1 OR 1", 1),
+		And(Eq("name", 1), Like("name;--", "a")),
+		Eq("name", 1).Sort("id; DROP TABLE t", false),
+		{Op: Op_Eq, Values: []interface{}{1}},
+	}
+	for _, c := range invalid {
+		if err := c.Check(); !errors.Is(err, ErrInvalidField) {
+			t.Errorf("%v: %v", c, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"reflect"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+/*
+*
+软删除的删除时间字段和字段名，也就是带xorm:"deleted"标签的时间字段，比如DeletedEntity的DeleteDate
+删除的时候只设置删除时间，查询的时候忽略已经删除的记录，Unscoped的会话包括已经删除的记录，删除的时候物理删除
+md可以是结构数组的指针，这时返回的Value属于一个新的元素，只用于判断是否支持软删除和取得字段名
+*/
+func DeletedField(md interface{}) (reflect.Value, string) {
+	value := reflect.Indirect(reflect.ValueOf(md))
+	if value.Kind() == reflect.Slice || value.Kind() == reflect.Array {
+		typ := value.Type().Elem()
+		for typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		value = reflect.New(typ).Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return reflect.Value{}, ""
+	}
+
+	return taggedField(value, "deleted", func(typ reflect.Type) bool {
+		return typ == timeType || typ == reflect.PtrTo(timeType)
+	})
+}
+
+// 记录是否已经被软删除，不支持软删除的实体返回false
+func IsDeleted(md interface{}) bool {
+	f, _ := DeletedField(md)
+	if !f.IsValid() {
+		return false
+	}
+	if f.Kind() == reflect.Ptr {
+		return !f.IsNil() && !f.Elem().Interface().(time.Time).IsZero()
+	}
+
+	return !f.Interface().(time.Time).IsZero()
+}
+
+// 设置删除时间，t为nil的时候清除删除时间，用于恢复已经删除的记录
+func SetDeleted(md interface{}, t *time.Time) {
+	f, _ := DeletedField(md)
+	if !f.IsValid() {
+		return
+	}
+	if f.Kind() == reflect.Ptr {
+		if t == nil {
+			f.Set(reflect.Zero(f.Type()))
+		} else {
+			v := *t
+			f.Set(reflect.ValueOf(&v))
+		}
+		return
+	}
+	if t == nil {
+		f.Set(reflect.ValueOf(time.Time{}))
+	} else {
+		f.Set(reflect.ValueOf(*t))
+	}
+}
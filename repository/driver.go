@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// 数据库引擎，每个命名数据库对应一个引擎，由引擎创建会话
+type DbEngine interface {
+	NewSession() DbSession
+	Close() error
+}
+
+// 根据数据库的配置打开引擎
+type DriverFactory func(params *config.DbParams) (DbEngine, error)
+
+var drivers = make(map[string]DriverFactory)
+
+var engines = make(map[string]DbEngine)
+
+var engineLock sync.Mutex
+
+/*
+*
+注册驱动，名称和数据库配置的orm对应，比如xorm，gorm，bolt
+各个驱动在自己的init中注册
+*/
+func RegisterDriver(name string, factory DriverFactory) {
+	engineLock.Lock()
+	defer engineLock.Unlock()
+	_, ok := drivers[name]
+	if ok {
+		logger.Sugar.Warnf("driver:%v exist", name)
+		return
+	}
+	drivers[name] = factory
+}
+
+/*
+*
+获取命名数据库的引擎，引擎在第一次使用的时候才打开
+名称为空字符串的时候是缺省数据库
+*/
+func GetEngine(dbname string) (DbEngine, error) {
+	engineLock.Lock()
+	defer engineLock.Unlock()
+	params := config.GetDatabaseParams(dbname)
+	engine, ok := engines[params.Name]
+	if ok {
+		return engine, nil
+	}
+	if params.Schema != "" && !schemaPattern.MatchString(params.Schema) {
+		logger.Sugar.Errorf("database:%v schema:%v invalid", dbname, params.Schema)
+		return nil, errors.New("InvalidSchema")
+	}
+	factory, ok := drivers[params.Orm]
+	if !ok {
+		logger.Sugar.Errorf("database:%v orm:%v driver no regist", dbname, params.Orm)
+		return nil, errors.New("DriverNotRegist")
+	}
+	engine, err := factory(params)
+	if err != nil {
+		logger.Sugar.Errorf("database:%v open engine failure:%v", dbname, err.Error())
+		return nil, err
+	}
+	engines[params.Name] = engine
+
+	return engine, nil
+}
+
+// 创建命名数据库的新会话
+func NewSession(dbname string) (DbSession, error) {
+	engine, err := GetEngine(dbname)
+	if err != nil {
+		return nil, err
+	}
+
+	return engine.NewSession(), nil
+}
+
+/*
+*
+创建命名数据库的读会话，引擎支持读写分离的时候连接只读副本，否则和NewSession相同
+*/
+func NewReadSession(dbname string) (DbSession, error) {
+	engine, err := GetEngine(dbname)
+	if err != nil {
+		return nil, err
+	}
+	readEngine, ok := engine.(ReadEngine)
+	if ok {
+		return readEngine.NewReadSession(), nil
+	}
+
+	return engine.NewSession(), nil
+}
+
+// 关闭所有已经打开的引擎
+func CloseEngines() error {
+	engineLock.Lock()
+	defer engineLock.Unlock()
+	var err error
+	for name, engine := range engines {
+		e := engine.Close()
+		if e != nil {
+			logger.Sugar.Errorf("database:%v close engine failure:%v", name, e.Error())
+			err = e
+		}
+		delete(engines, name)
+	}
+
+	return err
+}
+
+// schema会拼接到sql和文件名中，只允许字母，数字和下划线
+var schemaPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+/*
+*
+使用schema的连接串，schema方式的多租户每个租户使用自己的schema
+postgres在连接的search_path上设置schema，sqlite这样的文件数据库在文件名上加上schema作为后缀
+*/
+func SchemaDsn(drivername string, dsn string, schema string) (string, error) {
+	if schema == "" {
+		return dsn, nil
+	}
+	switch drivername {
+	case "postgres", "pgx":
+		if strings.Contains(dsn, "://") {
+			u, err := url.Parse(dsn)
+			if err != nil {
+				return "", err
+			}
+			q := u.Query()
+			q.Set("search_path", schema)
+			u.RawQuery = q.Encode()
+			return u.String(), nil
+		}
+		return fmt.Sprintf("%v search_path=%v", dsn, schema), nil
+	case "sqlite3", "sqlite":
+		path, query, ok := strings.Cut(dsn, "?")
+		path = SchemaFile(path, schema)
+		if ok {
+			return path + "?" + query, nil
+		}
+		return path, nil
+	}
+
+	return "", errors.New("NotSupportSchema")
+}
+
+// 在文件名的扩展名前面加上schema，比如colla.db变成colla_tenant1.db
+func SchemaFile(path string, schema string) string {
+	if schema == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+
+	return strings.TrimSuffix(path, ext) + "_" + schema + ext
+}
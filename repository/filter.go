@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"reflect"
+)
+
+/*
+*
+会话的过滤器，根据实体返回附加的查询条件，不需要过滤的实体返回nil
+过滤条件加在会话的Get，Find，Count，Update，Delete和Iterate上，比如多租户的租户条件
+md是实体的指针，数组的时候是一个新的元素，只用于判断实体的类型和字段
+*/
+type Filter func(md interface{}) *Criteria
+
+/*
+*
+所有过滤器对实体的条件的And，没有条件的时候返回nil
+*/
+func FilterCriteria(filters []Filter, md interface{}) *Criteria {
+	if len(filters) == 0 {
+		return nil
+	}
+	md = prototype(md)
+	if md == nil {
+		return nil
+	}
+	criterias := make([]*Criteria, 0, len(filters))
+	for _, filter := range filters {
+		criterias = append(criterias, filter(md))
+	}
+	criteria := And(criterias...)
+	if !criteria.HasCondition() || len(criteria.Children) == 0 {
+		return nil
+	}
+
+	return criteria
+}
+
+// 实体数组的指针返回一个新元素的指针，实体返回实体的指针
+func prototype(md interface{}) interface{} {
+	if md == nil {
+		return nil
+	}
+	value := reflect.ValueOf(md)
+	if value.Kind() == reflect.Ptr && value.IsNil() {
+		return nil
+	}
+	value = reflect.Indirect(value)
+	if value.Kind() == reflect.Slice || value.Kind() == reflect.Array {
+		typ := value.Type().Elem()
+		for typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct {
+			return nil
+		}
+		return reflect.New(typ).Interface()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	if reflect.TypeOf(md).Kind() != reflect.Ptr {
+		p := reflect.New(value.Type())
+		p.Elem().Set(value)
+		return p.Interface()
+	}
+
+	return md
+}
@@ -1,7 +1,9 @@
 package gorm
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/curltech/go-colla-core/config"
 	"github.com/curltech/go-colla-core/logger"
@@ -9,46 +11,156 @@ import (
 	"github.com/curltech/go-colla-core/util/reflect"
 	_ "github.com/lib/pq"
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	gormlogger "gorm.io/gorm/logger"
 	goreflect "reflect"
+	"strings"
 	"time"
 )
 
 type GormSession struct {
-	Session *gorm.DB
+	Session  *gorm.DB
+	db       *gorm.DB //没有事务的会话，事务结束后恢复
+	unscoped bool
+	filters  []repository.Filter
 }
 
-var engine *gorm.DB
+type GormEngine struct {
+	Engine   *gorm.DB
+	Replicas []*gorm.DB //只读副本
+	replicas *repository.ReplicaSet
+}
+
+func (this *GormEngine) NewSession() repository.DbSession {
+	s := this.Engine
+
+	return &GormSession{Session: s, db: s}
+}
+
+// 读会话连接健康的副本，没有副本或者副本都不可用的时候连接主库
+func (this *GormEngine) NewReadSession() repository.DbSession {
+	if this.replicas == nil {
+		return this.NewSession()
+	}
+	i := this.replicas.Pick()
+	if i < 0 {
+		return this.NewSession()
+	}
+	s := this.Replicas[i]
+
+	return &GormSession{Session: s, db: s}
+}
+
+func (this *GormEngine) Close() error {
+	if this.replicas != nil {
+		this.replicas.Close()
+	}
+	var err error
+	for _, db := range append([]*gorm.DB{this.Engine}, this.Replicas...) {
+		sqlDB, e := db.DB()
+		if e == nil {
+			e = sqlDB.Close()
+		}
+		if e != nil {
+			logger.Sugar.Errorf("%v", e.Error())
+			err = e
+		}
+	}
+
+	return err
+}
 
 func init() {
-	if config.DatabaseParams.Orm != "gorm" {
-		return
-	}
-	//drivername := config.DatabaseParams.Drivername
-	host := config.DatabaseParams.Host
-	port := config.DatabaseParams.Port
-	dbname := config.DatabaseParams.Dbname
-	user := config.DatabaseParams.User
-	password := config.DatabaseParams.Password
-	sslmode := config.DatabaseParams.Sslmode
-	//timeZone, _ := config.GetString("database.timeZone")
-	maxIdleConns := config.DatabaseParams.MaxIdleConns
-	maxOpenConns := config.DatabaseParams.MaxOpenConns
-	connMaxLifetime := config.DatabaseParams.ConnMaxLifetime
-	//showSQL := config.DatabaseParams.ShowSQL
-	//logLevel := config.DatabaseParams.LogLevel
+	repository.RegisterDriver("gorm", Open)
+}
+
+// 支持postgres和sqlite，sqlite的dsn是数据库文件的路径
+func Open(params *config.DbParams) (repository.DbEngine, error) {
+	drivername := params.Drivername
+	dsn := params.Dsn
+	host := params.Host
+	port := params.Port
+	dbname := params.Dbname
+	user := params.User
+	password := params.Password
+	sslmode := params.Sslmode
+	//timeZone := params.TimeZone
 
+	if drivername != "postgres" && drivername != "sqlite3" && drivername != "sqlite" {
+		return nil, errors.New("NotSupportDriver")
+	}
 	//dsn := fmt.Sprintf("host=%v port=%v dbname=%v user=%v password=%v sslmode=%v timeZone=%v", host, port, dbname, user, password, sslmode, timeZone)
-	dsn := fmt.Sprintf("host=%v port=%v dbname=%v user=%v password=%v sslmode=%v", host, port, dbname, user, password, sslmode)
-	var err error
-	engine, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: gormlogger.Default.LogMode(gormlogger.Info),
+	if dsn == "" && drivername == "postgres" {
+		dsn = fmt.Sprintf("host=%v port=%v dbname=%v user=%v password=%v sslmode=%v", host, port, dbname, user, password, sslmode)
+	}
+	dsn, err := repository.SchemaDsn(drivername, dsn, params.Schema)
+	if err != nil {
+		return nil, err
+	}
+	engine, err := openDB(dsn, params)
+	if err != nil {
+		return nil, err
+	}
+	if params.Schema != "" && drivername == "postgres" {
+		err = engine.Exec(fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%v"`, params.Schema)).Error
+		if err != nil {
+			logger.Sugar.Errorf("create schema:%v error:%v", params.Schema, err.Error())
+			return nil, err
+		}
+	}
+	if len(params.Replicas) == 0 {
+		return &GormEngine{Engine: engine}, nil
+	}
+	result := &GormEngine{Engine: engine, Replicas: make([]*gorm.DB, 0, len(params.Replicas))}
+	pings := make([]func(ctx context.Context) error, 0, len(params.Replicas))
+	for _, replica := range params.Replicas {
+		replica, err := repository.SchemaDsn(drivername, strings.TrimSpace(replica), params.Schema)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		db, err := openDB(replica, params)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		sqlDB, err := db.DB()
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		result.Replicas = append(result.Replicas, db)
+		pings = append(pings, sqlDB.PingContext)
+	}
+	result.replicas = repository.NewReplicaSet(pings, time.Duration(params.ReplicaCheck)*time.Second)
+
+	return result, nil
+}
+
+func openDB(dsn string, params *config.DbParams) (*gorm.DB, error) {
+	maxIdleConns := params.MaxIdleConns
+	maxOpenConns := params.MaxOpenConns
+	connMaxLifetime := params.ConnMaxLifetime
+	dialector := postgres.Open(dsn)
+	if params.Drivername != "postgres" {
+		dialector = sqlite.Open(dsn)
+	}
+	logLevel := gormlogger.Warn
+	if params.ShowSQL {
+		logLevel = gormlogger.Info
+	}
+	engine, err := gorm.Open(dialector, &gorm.Config{
+		Logger: gormlogger.Default.LogMode(logLevel),
 	})
 	if err != nil {
-		panic("failed to connect database")
+		return nil, err
 	}
 	sqlDB, err := engine.DB()
+	if err != nil {
+		return nil, err
+	}
 	// SetMaxIdleConns sets the maximum number of connections in the idle connection pool.
 	sqlDB.SetMaxIdleConns(maxIdleConns)
 	// SetMaxOpenConns sets the maximum number of open connections to the database.
@@ -56,16 +168,12 @@ func init() {
 
 	// SetConnMaxLifetime sets the maximum amount of time a connection may be reused.
 	sqlDB.SetConnMaxLifetime(time.Duration(connMaxLifetime) * time.Hour)
-}
 
-func NewGormSession() repository.DbSession {
-	s := engine
-
-	return &GormSession{Session: s}
+	return engine, nil
 }
 
 func (this *GormSession) Sync(bean ...interface{}) error {
-	err := engine.AutoMigrate(bean...)
+	err := this.Session.AutoMigrate(bean...)
 	if err != nil {
 		logger.Sugar.Errorf("%v", err)
 	}
@@ -83,17 +191,28 @@ func (this *GormSession) Get(dest interface{}, locked bool, orderby string, cond
 		session = session.Where(conds, params...)
 	}
 	if locked == true {
-		//session = session.Clauses(clause.Locking{Strength: "UPDATE"})
+		session = session.Clauses(clause.Locking{Strength: "UPDATE"})
 	}
 	if orderby != "" {
 		session = session.Order(orderby)
 	}
-	result := session.First(dest)
+	result := this.scope(session, dest).First(dest)
+	found, err = firstResult(result)
+
+	return found, err
+}
+
+// First没有找到记录的时候返回ErrRecordNotFound，转换成没有找到
+func firstResult(result *gorm.DB) (bool, error) {
 	if result.Error != nil {
-		logger.Sugar.Errorf("%v", err.Error())
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		logger.Sugar.Errorf("%v", result.Error.Error())
+		return false, result.Error
 	}
 
-	return found, err
+	return true, nil
 }
 
 // Find retrieve records from table, condiBeans's non-empty fields
@@ -111,6 +230,7 @@ func (this *GormSession) Find(rowsSlicePtr interface{}, md interface{}, orderby
 	if orderby != "" {
 		session = session.Order(orderby)
 	}
+	session = this.scope(session, rowsSlicePtr)
 	if md == nil {
 		session = session.Find(rowsSlicePtr)
 	} else {
@@ -122,8 +242,58 @@ func (this *GormSession) Find(rowsSlicePtr interface{}, md interface{}, orderby
 
 // insert model data to database
 func (this *GormSession) Insert(mds ...interface{}) (int64, error) {
-	var session = this.Session
-	session = session.Create(&mds)
+	var affected int64
+	for _, md := range mds {
+		ms := reflect.ToArray(md)
+		if ms == nil {
+			ms = []interface{}{md}
+		}
+		// gorm不能从[]interface{}新增，逐个实体新增
+		for _, m := range ms {
+			repository.InitVersion(m)
+			session := this.Session.Create(m)
+			if session.Error != nil {
+				logger.Sugar.Errorf("%v", session.Error.Error())
+				return affected, session.Error
+			}
+			affected = affected + session.RowsAffected
+		}
+	}
+
+	return affected, nil
+}
+
+// 一条语句的参数个数的上限，sqlite是32766，postgres是65535
+const maxBatchParams = 32766
+
+/*
+*
+一条语句新增一批实体，mds是同一个类型的实体的指针，使用gorm的多行INSERT，不支持COPY，忽略useCopy
+*/
+func (this *GormSession) BatchInsert(mds []interface{}, useCopy bool) (int64, error) {
+	if len(mds) == 0 {
+		return 0, nil
+	}
+	typ := goreflect.TypeOf(mds[0])
+	if typ.Kind() != goreflect.Ptr {
+		return 0, errors.New("DestinationNeedPtr")
+	}
+	rows := goreflect.MakeSlice(goreflect.SliceOf(typ), 0, len(mds))
+	for _, md := range mds {
+		if goreflect.TypeOf(md) != typ {
+			return 0, errors.New("BatchNeedSameType")
+		}
+		repository.InitVersion(md)
+		rows = goreflect.Append(rows, goreflect.ValueOf(md))
+	}
+	stmt := &gorm.Statement{DB: this.Session}
+	err := stmt.Parse(mds[0])
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return 0, err
+	}
+	// 按照参数个数的上限分批插入
+	session := this.Session.CreateInBatches(rows.Interface(), maxBatchParams/len(stmt.Schema.DBNames))
 	if session.Error != nil {
 		logger.Sugar.Errorf("%v", session.Error.Error())
 	}
@@ -136,7 +306,6 @@ func (this *GormSession) Insert(mds ...interface{}) (int64, error) {
 // 不支持指定this.Session.Table(new(User))来指定表名，而是通过结构数组来指定，因此不支持map更新
 // 在数据没有Id的时候，使用第三个参数条件bean作为条件
 func (this *GormSession) Update(md interface{}, columns []string, conds string, params ...interface{}) (int64, error) {
-	var session = this.Session
 	var mds []interface{}
 	var ok bool
 	kind := reflect.GetIndirectType(md)
@@ -149,32 +318,77 @@ func (this *GormSession) Update(md interface{}, columns []string, conds string,
 		mds = make([]interface{}, 1)
 		mds[0] = md
 	}
+	var affected int64
+	var err error
 	for _, md := range mds {
-		if (columns != nil && len(columns) > 0) || conds != "" {
-			session = session.Model(md)
-			if columns != nil && len(columns) > 0 {
-				session = session.Select(columns)
-			}
-			if conds != "" {
-				session = session.Where(conds, params...)
-			}
-			session = session.Updates(md)
+		var n int64
+		id, ok := repository.GetId(md)
+		version, name := repository.VersionField(md)
+		if ok && version.IsValid() {
+			n, err = this.updateVersion(md, id, version, name, columns)
 		} else {
-			session = session.Save(md)
+			session := this.Session
+			if (columns != nil && len(columns) > 0) || conds != "" {
+				session = this.scope(session.Model(md), md)
+				if columns != nil && len(columns) > 0 {
+					session = session.Select(columns)
+				}
+				if conds != "" {
+					session = session.Where(conds, params...)
+				}
+				session = session.Updates(md)
+			} else if repository.FilterCriteria(this.filters, md) != nil {
+				// Save在没有更新记录的时候会插入，有过滤条件的时候只能更新
+				session = this.scope(session.Model(md), md).Select("*").Updates(md)
+			} else {
+				session = session.Save(md)
+			}
+			n, err = session.RowsAffected, session.Error
 		}
+		if err != nil {
+			break
+		}
+		affected = affected + n
+	}
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
+
+	return affected, err
+}
+
+/*
+*
+带版本号的实体按照id和原来的版本号更新，同时增加版本号，和xorm的version标签的行为一致
+没有更新任何记录的时候返回ErrStaleEntity，不能使用Save，Save在没有更新记录的时候会插入
+*/
+func (this *GormSession) updateVersion(md interface{}, id interface{}, version goreflect.Value, name string, columns []string) (int64, error) {
+	column := this.Session.NamingStrategy.ColumnName("", name)
+	v := version.Int()
+	version.SetInt(v + 1)
+	session := this.scope(this.Session.Model(md), md).Where(column+" = ?", v)
+	if columns != nil && len(columns) > 0 {
+		session = session.Select(append(columns, column))
+	} else {
+		session = session.Select("*")
 	}
+	session = session.Updates(md)
 	if session.Error != nil {
-		logger.Sugar.Errorf("%v", session.Error.Error())
+		version.SetInt(v)
+		return 0, session.Error
+	}
+	if session.RowsAffected == 0 {
+		version.SetInt(v)
+		return 0, repository.StaleEntity(md, id, v)
 	}
 
-	return session.RowsAffected, session.Error
+	return session.RowsAffected, nil
 }
 
 // 第一个参数是删除的数据数组，当传入的为结构体指针时，非空和0的field会被作为删除的条件
 // 不支持指定this.Session.Table(new(User))来指定表名，而是通过结构数组来指定，因此不支持map删除
 // 在数据没有Id的时候，使用第二个参数作为条件
 func (this *GormSession) Delete(md interface{}, conds string, params ...interface{}) (int64, error) {
-	var session = this.Session
 	var mds []interface{}
 	var ok bool
 	kind := reflect.GetIndirectType(md)
@@ -187,23 +401,50 @@ func (this *GormSession) Delete(md interface{}, conds string, params ...interfac
 		mds = make([]interface{}, 1)
 		mds[0] = md
 	}
+	var affected int64
+	var err error
 	for _, md := range mds {
+		var session = this.filter(this.Session, md)
 		id, ok := repository.GetId(md)
-		if !ok {
-			if conds != "" && len(conds) > 0 {
-				session = session.Where(conds, params...).Delete(md)
-			} else {
-				session = session.Delete(md)
+		if !ok && conds != "" {
+			session = session.Where(conds, params...)
+		}
+		if !this.unscoped && this.softDeletable(md) {
+			if !ok && conds == "" {
+				err = errors.New("NoCondition")
+				break
 			}
-		} else {
+			session = this.softDelete(session.Model(md), md)
+		} else if ok {
 			session = session.Delete(md, id)
+		} else {
+			session = session.Delete(md)
 		}
+		err = session.Error
+		if err != nil {
+			break
+		}
+		affected = affected + session.RowsAffected
 	}
-	if session.Error != nil {
-		logger.Sugar.Errorf("%v", session.Error.Error())
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
 	}
 
-	return session.RowsAffected, session.Error
+	return affected, err
+}
+
+func (this *GormSession) softDeletable(md interface{}) bool {
+	f, _ := repository.DeletedField(md)
+
+	return f.IsValid()
+}
+
+// 软删除只设置删除时间，已经删除的记录不再更新
+func (this *GormSession) softDelete(session *gorm.DB, md interface{}) *gorm.DB {
+	_, name := repository.DeletedField(md)
+	column := this.column(name)
+
+	return session.Where(column+" IS NULL").Update(column, time.Now())
 }
 
 // execute sql and get result
@@ -218,20 +459,55 @@ func (this *GormSession) Exec(clause string, params ...interface{}) (sql.Result,
 }
 
 // execute sql and get result
+// 每条记录是列名到值的映射，值和xorm一样转换成字节数组，NULL是nil
 func (this *GormSession) Query(clause string, params ...interface{}) ([]map[string][]byte, error) {
-	var session = this.Session
-	session = session.Raw(clause, params...)
-	if session.Error != nil {
-		logger.Sugar.Errorf("%v", session.Error.Error())
+	rows, err := this.Session.Raw(clause, params...).Rows()
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return nil, err
+	}
+	results := make([]map[string][]byte, 0)
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(dest...)
+		if err != nil {
+			logger.Sugar.Errorf("%v", err.Error())
+			return nil, err
+		}
+		result := make(map[string][]byte, len(columns))
+		for i, column := range columns {
+			if values[i] != nil {
+				// RawBytes在下一次Scan的时候失效，需要复制
+				result[column] = append([]byte{}, values[i]...)
+			} else {
+				result[column] = nil
+			}
+		}
+		results = append(results, result)
+	}
+	err = rows.Err()
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return nil, err
 	}
 
-	return nil, session.Error
+	return results, nil
 }
 
 func (this *GormSession) Count(bean interface{}, conds string, params ...interface{}) (int64, error) {
 	var session = this.Session
 	var count int64
-	session = session.Model(bean)
+	session = this.scope(session.Model(bean), bean)
 	if conds != "" && len(conds) > 0 {
 		session = session.Where(conds, params...).Count(&count)
 	} else {
@@ -255,36 +531,26 @@ func (this *GormSession) Count(bean interface{}, conds string, params ...interfa
 	        }
 		})
 */
-func (this *GormSession) Transaction(fc func(s repository.DbSession) error) error {
+func (this *GormSession) Transaction(fc func(s repository.DbSession) error) (err error) {
 	defer this.Close()
-	var session = this.Session
-	session = session.Begin()
-	if session.Error != nil {
-		logger.Sugar.Errorf("%v", session.Error.Error())
+	err = this.Begin()
+	if err != nil {
+		return err
 	}
 	defer func() {
 		if p := recover(); p != nil {
 			logger.Sugar.Errorf("recover rollback:%s\r\n", p)
-			session.Rollback()
-			if session.Error != nil {
-				logger.Sugar.Errorf("%v", session.Error.Error())
-			}
+			this.Rollback()
 			panic(p) // re-throw panic after Rollback
-		} else if session.Error != nil {
-			logger.Sugar.Errorf("error rollback:%s\r\n", session.Error)
-			session.Rollback() // err is non-nil; don't change it
-			if session.Error != nil {
-				logger.Sugar.Errorf("%v", session.Error.Error())
-			}
+		} else if err != nil {
+			logger.Sugar.Errorf("error rollback:%s\r\n", err)
+			this.Rollback() // err is non-nil; don't change it
 		} else {
-			session = session.Commit() // err is nil; if Commit returns error update err
-			if session.Error != nil {
-				logger.Sugar.Errorf("%v", session.Error.Error())
-			}
+			err = this.Commit() // err is nil; if Commit returns error update err
 		}
 	}()
 	// 执行在事务内的处理
-	err := fc(this)
+	err = fc(this)
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
@@ -292,19 +558,133 @@ func (this *GormSession) Transaction(fc func(s repository.DbSession) error) erro
 	return err
 }
 
+/*
+*
+返回使用ctx的新会话，ctx取消或者超时的时候中止正在执行的sql
+没有事务的时候Session和db必须是同一个，Rollback和Commit用它判断是否在事务中
+*/
+func (this *GormSession) WithContext(ctx context.Context) repository.DbSession {
+	db := this.db.WithContext(ctx)
+	session := db
+	if this.Session != this.db {
+		session = this.Session.WithContext(ctx)
+	}
+
+	return &GormSession{Session: session, db: db, unscoped: this.unscoped, filters: this.filters}
+}
+
+/*
+*
+包括软删除的记录的会话，删除的时候物理删除，和原来的会话共用事务
+gorm只支持gorm.DeletedAt的软删除，所以带xorm:"deleted"标签的字段由GormSession自己处理
+*/
+func (this *GormSession) Unscoped() repository.DbSession {
+	return &GormSession{Session: this.Session, db: this.db, unscoped: true, filters: this.filters}
+}
+
+// 加上过滤器的会话，和原来的会话共用事务
+func (this *GormSession) Filter(filters ...repository.Filter) repository.DbSession {
+	fs := append(append([]repository.Filter{}, this.filters...), filters...)
+
+	return &GormSession{Session: this.Session, db: this.db, unscoped: this.unscoped, filters: fs}
+}
+
+// 去掉过滤器的会话，和原来的会话共用事务
+func (this *GormSession) Unfiltered() repository.DbSession {
+	return &GormSession{Session: this.Session, db: this.db, unscoped: this.unscoped}
+}
+
+// 开始事务，后续的操作都在事务中执行，直到提交或者回滚
 func (this *GormSession) Begin() error {
+	tx := this.Session.Begin()
+	if tx.Error != nil {
+		logger.Sugar.Errorf("%v", tx.Error.Error())
+		return tx.Error
+	}
+	this.Session = tx
+
+	return nil
+}
+
+func (this *GormSession) Rollback() error {
+	if this.Session == this.db {
+		return nil
+	}
+	result := this.Session.Rollback()
+	this.Session = this.db
+	if result.Error != nil {
+		logger.Sugar.Errorf("%v", result.Error.Error())
+	}
+
+	return result.Error
+}
+
+func (this *GormSession) Commit() error {
+	if this.Session == this.db {
+		return nil
+	}
+	result := this.Session.Commit()
+	this.Session = this.db
+	if result.Error != nil {
+		logger.Sugar.Errorf("%v", result.Error.Error())
+	}
+
+	return result.Error
+}
+
+func (this *GormSession) Savepoint(name string) error {
+	_, err := this.Exec("SAVEPOINT " + name)
+
+	return err
+}
+
+func (this *GormSession) RollbackTo(name string) error {
+	_, err := this.Exec("ROLLBACK TO SAVEPOINT " + name)
+
+	return err
+}
+
+func (this *GormSession) ReleaseSavepoint(name string) error {
+	_, err := this.Exec("RELEASE SAVEPOINT " + name)
+
+	return err
+}
+
+// 关闭会话，没有提交的事务回滚
+func (this *GormSession) Close() error {
+	return this.Rollback()
+}
+
+// scan result
+func (this *GormSession) Scan(dest interface{}) (*GormSession, error) {
 	var session = this.Session
-	session = session.Begin()
+	session = session.Model(dest).Limit(1).Scan(dest)
 	if session.Error != nil {
 		logger.Sugar.Errorf("%v", session.Error.Error())
 	}
 
-	return session.Error
+	return this, session.Error
 }
 
-func (this *GormSession) Rollback() error {
-	var session = this.Session
-	session = session.Rollback()
+/*
+*
+按照QueryBuilder构造查询，结果扫描到dest，dest可以是结构的指针，结构数组的指针或者[]map[string]interface{}的指针
+*/
+func (this *GormSession) Complex(qb *repository.QueryBuilder, dest interface{}) error {
+	clause, args, err := qb.ToSql(func(bean interface{}) string {
+		stmt := &gorm.Statement{DB: this.Session}
+		err := stmt.Parse(bean)
+		if err != nil {
+			logger.Sugar.Errorf("%v", err.Error())
+			return ""
+		}
+		return stmt.Schema.Table
+	})
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return err
+	}
+	session := this.Session.Raw(clause, args...).Scan(dest)
 	if session.Error != nil {
 		logger.Sugar.Errorf("%v", session.Error.Error())
 	}
@@ -312,9 +692,155 @@ func (this *GormSession) Rollback() error {
 	return session.Error
 }
 
-func (this *GormSession) Commit() error {
-	var session = this.Session
-	session = session.Commit()
+/*
+*
+把条件翻译成带?参数的sql条件，没有条件的时候返回空字符串，结构的字段名转换成列名
+*/
+func (this *GormSession) toSql(criteria *repository.Criteria) (string, []interface{}, error) {
+	if !criteria.HasCondition() {
+		return "", nil, nil
+	}
+	field := this.column(criteria.Field)
+	switch criteria.Op {
+	case repository.Op_Eq:
+		return field + " = ?", criteria.Values[:1], nil
+	case repository.Op_In:
+		if len(criteria.Values) == 0 {
+			return "1 = 0", nil, nil
+		}
+		marks := strings.TrimSuffix(strings.Repeat("?,", len(criteria.Values)), ",")
+		return field + " IN (" + marks + ")", criteria.Values, nil
+	case repository.Op_Between:
+		return field + " BETWEEN ? AND ?", criteria.Values[:2], nil
+	case repository.Op_Like:
+		return field + " LIKE ?", criteria.Values[:1], nil
+	case repository.Op_Gt:
+		return field + " > ?", criteria.Values[:1], nil
+	case repository.Op_Ge:
+		return field + " >= ?", criteria.Values[:1], nil
+	case repository.Op_Lt:
+		return field + " < ?", criteria.Values[:1], nil
+	case repository.Op_Le:
+		return field + " <= ?", criteria.Values[:1], nil
+	case repository.Op_IsNull:
+		return field + " IS NULL", nil, nil
+	case repository.Op_And, repository.Op_Or:
+		clauses := make([]string, 0, len(criteria.Children))
+		args := make([]interface{}, 0)
+		for _, child := range criteria.Children {
+			c, a, err := this.toSql(child)
+			if err != nil {
+				return "", nil, err
+			}
+			if c != "" {
+				clauses = append(clauses, "("+c+")")
+				args = append(args, a...)
+			}
+		}
+		if len(clauses) == 0 {
+			return "", nil, nil
+		}
+		if criteria.Op == repository.Op_And {
+			return strings.Join(clauses, " AND "), args, nil
+		}
+		return strings.Join(clauses, " OR "), args, nil
+	}
+
+	return "", nil, errors.New("NotSupportOp")
+}
+
+// 结构的字段名转换成gorm的列名，比如DeleteDate转换成delete_date，列名和带表别名的列不变
+func (this *GormSession) column(name string) string {
+	if strings.ContainsAny(name, ". ") || strings.ToLower(name) == name {
+		return name
+	}
+
+	return this.Session.NamingStrategy.ColumnName("", name)
+}
+
+// 软删除的实体在查询的时候加上删除时间为空的条件，Unscoped的会话包括已经删除的记录，过滤条件总是加上
+func (this *GormSession) scope(session *gorm.DB, md interface{}) *gorm.DB {
+	session = this.filter(session, md)
+	if this.unscoped {
+		return session
+	}
+	_, name := repository.DeletedField(md)
+	if name == "" {
+		return session
+	}
+
+	return session.Where(this.column(name) + " IS NULL")
+}
+
+// 加上会话的过滤器对实体的条件，条件错误的时候不返回任何记录
+func (this *GormSession) filter(session *gorm.DB, md interface{}) *gorm.DB {
+	criteria := repository.FilterCriteria(this.filters, md)
+	if criteria == nil {
+		return session
+	}
+	err := criteria.Check()
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return session.Where("1 = 0")
+	}
+	conds, args, err := this.toSql(criteria)
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return session.Where("1 = 0")
+	}
+
+	return session.Where(conds, args...)
+}
+
+// 在会话上加上条件和排序
+func (this *GormSession) criteriaSession(session *gorm.DB, criteria *repository.Criteria) (*gorm.DB, error) {
+	err := criteria.Check()
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return nil, err
+	}
+	conds, args, err := this.toSql(criteria)
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return nil, err
+	}
+	if conds != "" {
+		session = session.Where(conds, args...)
+	}
+	orderby := criteria.OrderBy()
+	if orderby != "" {
+		session = session.Order(orderby)
+	}
+
+	return session, nil
+}
+
+func (this *GormSession) GetByCriteria(dest interface{}, locked bool, criteria *repository.Criteria) (bool, error) {
+	session, err := this.criteriaSession(this.Session, criteria)
+	if err != nil {
+		return false, err
+	}
+	if locked == true {
+		session = session.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+
+	return firstResult(this.scope(session, dest).First(dest))
+}
+
+func (this *GormSession) FindByCriteria(rowsSlicePtr interface{}, md interface{}, criteria *repository.Criteria, from int, limit int) error {
+	session, err := this.criteriaSession(this.Session, criteria)
+	if err != nil {
+		return err
+	}
+	if limit != 0 || from != 0 {
+		session = session.Limit(limit).Offset(from)
+	}
+	session = this.scope(session, rowsSlicePtr)
+	if md == nil {
+		session = session.Find(rowsSlicePtr)
+	} else {
+		session = session.Find(rowsSlicePtr, md)
+	}
 	if session.Error != nil {
 		logger.Sugar.Errorf("%v", session.Error.Error())
 	}
@@ -322,21 +848,193 @@ func (this *GormSession) Commit() error {
 	return session.Error
 }
 
-func (this *GormSession) Close() error {
-	//err := this.Session.Close()
-	//if err != nil {
-	//	panic(err)
-	//}
+func (this *GormSession) CountByCriteria(bean interface{}, criteria *repository.Criteria) (int64, error) {
+	var count int64
+	session, err := this.criteriaSession(this.scope(this.Session.Model(bean), bean), criteria.Unordered())
+	if err != nil {
+		return 0, err
+	}
+	session = session.Count(&count)
+	if session.Error != nil {
+		logger.Sugar.Errorf("%v", session.Error.Error())
+	}
 
-	return nil
+	return count, session.Error
 }
 
-// scan result
-func (this *GormSession) Scan(dest interface{}) (*GormSession, error) {
+// md的主键和条件一起作为删除的条件，都没有的时候gorm拒绝删除
+func (this *GormSession) DeleteByCriteria(md interface{}, criteria *repository.Criteria) (int64, error) {
+	session, err := this.criteriaSession(this.filter(this.Session, md), criteria.Unordered())
+	if err != nil {
+		return 0, err
+	}
+	if !this.unscoped && this.softDeletable(md) {
+		_, ok := repository.GetId(md)
+		if !ok && !criteria.HasCondition() {
+			return 0, errors.New("NoCondition")
+		}
+		session = this.softDelete(session.Model(md), md)
+	} else {
+		session = session.Delete(md)
+	}
+	if session.Error != nil {
+		logger.Sugar.Errorf("%v", session.Error.Error())
+	}
 
-	return this, nil
+	return session.RowsAffected, session.Error
 }
 
-func (this *GormSession) Complex(qb *repository.QueryBuilder, dest []interface{}) error {
-	return nil
+/*
+*
+逐条处理满足条件的记录，md的非空字段也是条件，使用FindInBatches按照主键分批查询，每批batchSize条记录
+ctx取消的时候停止处理，返回ctx的错误
+*/
+func (this *GormSession) Iterate(ctx context.Context, md interface{}, criteria *repository.Criteria, batchSize int, fn func(row interface{}) error) error {
+	session, err := this.criteriaSession(this.scope(this.Session.WithContext(ctx).Where(md), md), criteria)
+	if err != nil {
+		return err
+	}
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	typ := goreflect.TypeOf(md)
+	for typ.Kind() == goreflect.Ptr {
+		typ = typ.Elem()
+	}
+	rows := goreflect.New(goreflect.SliceOf(typ))
+	session = session.FindInBatches(rows.Interface(), batchSize, func(tx *gorm.DB, batch int) error {
+		for i := 0; i < rows.Elem().Len(); i++ {
+			err := ctx.Err()
+			if err != nil {
+				return err
+			}
+			err = fn(rows.Elem().Index(i).Addr().Interface())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if session.Error != nil {
+		logger.Sugar.Errorf("%v", session.Error.Error())
+	}
+
+	return session.Error
+}
+
+/*
+*
+批量新增或者修改，使用INSERT ... ON CONFLICT DO UPDATE，返回新增和修改的记录数
+conflictColumns必须是唯一索引或者主键，updateColumns为空的时候修改repository.UpsertColumns返回的字段
+会话的过滤条件加在DO UPDATE的WHERE上，被排除的已有记录不修改，也不计数
+新增的记录数是实体数减去执行之前在同一个事务中查询到的已有记录数，修改的记录数是影响的记录数减去新增的记录数
+实体的id只用于新增，已有记录的id不变
+*/
+func (this *GormSession) UpsertBatch(mds []interface{}, conflictColumns []string, updateColumns []string) (int64, int64, error) {
+	if len(mds) == 0 {
+		return 0, 0, nil
+	}
+	keys, err := repository.ConflictKeys(mds, conflictColumns)
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return 0, 0, err
+	}
+	typ := goreflect.TypeOf(mds[0])
+	if typ.Kind() != goreflect.Ptr {
+		return 0, 0, errors.New("DestinationNeedPtr")
+	}
+	rows := goreflect.MakeSlice(goreflect.SliceOf(typ), 0, len(mds))
+	for _, md := range mds {
+		if goreflect.TypeOf(md) != typ {
+			return 0, 0, errors.New("UpsertNeedSameType")
+		}
+		repository.InitVersion(md)
+		rows = goreflect.Append(rows, goreflect.ValueOf(md))
+	}
+	stmt := &gorm.Statement{DB: this.Session}
+	err = stmt.Parse(mds[0])
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return 0, 0, err
+	}
+	table := stmt.Schema.Table
+	if len(updateColumns) == 0 {
+		updateColumns = repository.UpsertColumns(mds[0], conflictColumns)
+	}
+	conflict := clause.OnConflict{}
+	names := make([]string, len(conflictColumns))
+	for i, name := range conflictColumns {
+		names[i] = this.column(name)
+		conflict.Columns = append(conflict.Columns, clause.Column{Name: names[i]})
+	}
+	if len(updateColumns) == 0 {
+		conflict.DoNothing = true
+	} else {
+		// gorm不认识xorm的updated和deleted标签，修改时间总是修改，软删除的记录恢复
+		_, updated := repository.UpdatedField(mds[0])
+		_, deleted := repository.DeletedField(mds[0])
+		columns := make([]string, 0, len(updateColumns))
+		for _, name := range updateColumns {
+			column := this.column(name)
+			if updated != "" && column == this.column(updated) || deleted != "" && column == this.column(deleted) {
+				continue
+			}
+			columns = append(columns, column)
+		}
+		conflict.DoUpdates = clause.AssignmentColumns(columns)
+		if updated != "" {
+			conflict.DoUpdates = append(conflict.DoUpdates, clause.Assignment{Column: clause.Column{Name: this.column(updated)}, Value: time.Now()})
+		}
+		if deleted != "" {
+			conflict.DoUpdates = append(conflict.DoUpdates, clause.Assignment{Column: clause.Column{Name: this.column(deleted)}, Value: nil})
+		}
+		_, name := repository.VersionField(mds[0])
+		if name != "" {
+			column := clause.Column{Table: table, Name: this.column(name)}
+			conflict.DoUpdates = append(conflict.DoUpdates, clause.Assignment{Column: clause.Column{Name: column.Name}, Value: gorm.Expr("? + 1", column)})
+		}
+		criteria := repository.FilterCriteria(this.filters, mds[0])
+		if criteria != nil {
+			err := criteria.Check()
+			if err != nil {
+				logger.Sugar.Errorf("%v", err.Error())
+				return 0, 0, err
+			}
+			conds, args, err := this.toSql(this.qualify(criteria, table))
+			if err != nil {
+				logger.Sugar.Errorf("%v", err.Error())
+				return 0, 0, err
+			}
+			conflict.Where = clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: conds, Vars: args}}}
+		}
+	}
+	// 已经存在的冲突键的数量，包括过滤条件排除的记录
+	var existing int64
+	session := this.Session.Table(table).Where("("+strings.Join(names, ",")+") IN ?", keys).Count(&existing)
+	if session.Error != nil {
+		logger.Sugar.Errorf("%v", session.Error.Error())
+		return 0, 0, session.Error
+	}
+	session = this.Session.Clauses(conflict).Create(rows.Interface())
+	if session.Error != nil {
+		logger.Sugar.Errorf("%v", session.Error.Error())
+		return 0, 0, session.Error
+	}
+	inserted := int64(len(mds)) - existing
+
+	return inserted, session.RowsAffected - inserted, nil
+}
+
+// 条件的字段转换成带表名的列名，避免和excluded的列混淆
+func (this *GormSession) qualify(criteria *repository.Criteria, table string) *repository.Criteria {
+	c := *criteria
+	if criteria.Field != "" && !strings.Contains(criteria.Field, ".") {
+		c.Field = table + "." + this.column(criteria.Field)
+	}
+	c.Children = make([]*repository.Criteria, len(criteria.Children))
+	for i, child := range criteria.Children {
+		c.Children[i] = this.qualify(child, table)
+	}
+
+	return &c
 }
@@ -0,0 +1,568 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/repository"
+	"github.com/curltech/go-colla-core/util/security"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*
+一个版本的数据库迁移，可以是go迁移，也可以是sql迁移
+go迁移的Up和Down在事务中执行，可以用会话做改名，删除字段，回填数据等任何操作
+sql迁移的UpSql和DownSql按照顺序执行，两种都有的时候先执行sql再执行go
+迁移和版本记录在同一个事务中，mysql的ddl会隐式提交，这个时候失败的迁移需要手工处理
+*/
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      func(session repository.DbSession) error
+	Down    func(session repository.DbSession) error
+	UpSql   []string
+	DownSql []string
+}
+
+func (this *Migration) checksum() string {
+	if len(this.UpSql) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(this.UpSql, ";\n")))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// 迁移的锁被其他节点持有
+var ErrLocked = errors.New("MigrationLocked")
+
+const schemaLockId uint64 = 1
+
+var migrations = make(map[string][]*Migration)
+
+var migrationLock sync.Mutex
+
+/*
+*
+登记命名数据库的迁移，一般在包的init中调用，名称为空字符串的时候是缺省数据库
+*/
+func Regist(dbName string, ms ...*Migration) {
+	migrationLock.Lock()
+	defer migrationLock.Unlock()
+	migrations[dbName] = append(migrations[dbName], ms...)
+}
+
+/*
+*
+从目录读取sql迁移，文件名是<版本号>_<名称>.up.sql和<版本号>_<名称>.down.sql
+语句之间用行尾的分号分隔，--开始的行是注释
+*/
+func LoadSql(dir string) ([]*Migration, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return nil, err
+	}
+	pattern := regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+	ms := make(map[uint64]*Migration)
+	for _, file := range files {
+		matches := pattern.FindStringSubmatch(file.Name())
+		if file.IsDir() || matches == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(matches[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		content, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := ms[version]
+		if !ok {
+			m = &Migration{Version: version, Name: matches[2]}
+			ms[version] = m
+		}
+		if matches[3] == "up" {
+			m.UpSql = splitSql(string(content))
+		} else {
+			m.DownSql = splitSql(string(content))
+		}
+	}
+	result := make([]*Migration, 0, len(ms))
+	for _, m := range ms {
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+
+	return result, nil
+}
+
+func splitSql(content string) []string {
+	statements := make([]string, 0)
+	var buf strings.Builder
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = appendStatement(statements, buf.String())
+			buf.Reset()
+		}
+	}
+
+	return appendStatement(statements, buf.String())
+}
+
+func appendStatement(statements []string, statement string) []string {
+	statement = strings.TrimSuffix(strings.TrimSpace(statement), ";")
+	if statement == "" {
+		return statements
+	}
+
+	return append(statements, statement)
+}
+
+/*
+*
+命名数据库的迁移执行器，版本记录在bas_schema_version中，执行之前在bas_schema_lock中加锁，保证只有一个节点在迁移
+DryRun的时候不加锁，不执行修改，只把要执行的sql和修改操作写到Out
+LockTimeout之后锁可以被其他节点抢占，需要大于最长的迁移的执行时间
+*/
+type Migrator struct {
+	DbName      string
+	DryRun      bool
+	Out         io.Writer
+	LockTimeout time.Duration
+	migrations  []*Migration
+}
+
+// dbName是<name>@<schema>的时候迁移租户的schema，使用数据库name登记的迁移
+func NewMigrator(dbName string) *Migrator {
+	migrationLock.Lock()
+	defer migrationLock.Unlock()
+	name, _, _ := strings.Cut(dbName, "@")
+	ms := make([]*Migration, len(migrations[name]))
+	copy(ms, migrations[name])
+
+	return &Migrator{DbName: dbName, Out: os.Stdout, LockTimeout: 10 * time.Minute, migrations: ms}
+}
+
+// 增加迁移，只对这个执行器有效
+func (this *Migrator) Add(ms ...*Migration) *Migrator {
+	this.migrations = append(this.migrations, ms...)
+
+	return this
+}
+
+// 按照版本号排序的迁移，版本号为0或者重复的时候返回错误
+func (this *Migrator) sorted() ([]*Migration, error) {
+	ms := make([]*Migration, len(this.migrations))
+	copy(ms, this.migrations)
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].Version < ms[j].Version
+	})
+	for i, m := range ms {
+		if m.Version == 0 {
+			return nil, errors.New("NoMigrationVersion")
+		}
+		if i > 0 && ms[i-1].Version == m.Version {
+			return nil, fmt.Errorf("DuplicateMigration: %v", m.Version)
+		}
+	}
+
+	return ms, nil
+}
+
+/*
+*
+已经执行的迁移，按照版本号排序
+*/
+func (this *Migrator) Applied() ([]*entity.SchemaVersion, error) {
+	session, err := repository.NewSession(this.DbName)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	versions := make([]*entity.SchemaVersion, 0)
+	err = session.Find(&versions, nil, "", 0, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Id < versions[j].Id
+	})
+
+	return versions, nil
+}
+
+/*
+*
+执行版本号不大于target的所有还没有执行的迁移，target为0的时候执行所有的迁移，返回执行的迁移的数目
+*/
+func (this *Migrator) Up(target uint64) (int, error) {
+	ms, err := this.sorted()
+	if err != nil {
+		return 0, err
+	}
+	release, err := this.prepare()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	applied, err := this.applied()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, m := range ms {
+		if target != 0 && m.Version > target {
+			break
+		}
+		version, ok := applied[m.Version]
+		if ok {
+			if version.Checksum != m.checksum() {
+				logger.Sugar.Warnf("migration:%v %v has changed after applied", m.Version, m.Name)
+			}
+			continue
+		}
+		err = this.run(m, true)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+/*
+*
+按照版本号从大到小回退版本号大于target的所有已经执行的迁移，返回回退的迁移的数目
+已经执行的迁移没有登记或者没有Down的时候返回错误
+*/
+func (this *Migrator) Down(target uint64) (int, error) {
+	ms, err := this.sorted()
+	if err != nil {
+		return 0, err
+	}
+	release, err := this.prepare()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	applied, err := this.applied()
+	if err != nil {
+		return 0, err
+	}
+	registed := make(map[uint64]*Migration)
+	for _, m := range ms {
+		registed[m.Version] = m
+	}
+	versions := make([]uint64, 0, len(applied))
+	for version := range applied {
+		if version > target {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] > versions[j]
+	})
+	count := 0
+	for _, version := range versions {
+		m, ok := registed[version]
+		if !ok {
+			return count, fmt.Errorf("NoMigration: %v", version)
+		}
+		if m.Down == nil && len(m.DownSql) == 0 {
+			return count, fmt.Errorf("NoDownMigration: %v", version)
+		}
+		err = this.run(m, false)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// 建立版本表和锁表并且加锁，返回释放锁的函数，DryRun的时候什么都不做
+func (this *Migrator) prepare() (func(), error) {
+	if this.DryRun {
+		return func() {}, nil
+	}
+	session, err := repository.NewSession(this.DbName)
+	if err != nil {
+		return nil, err
+	}
+	err = session.Sync(new(entity.SchemaVersion), new(entity.SchemaLock))
+	session.Close()
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return nil, err
+	}
+	owner, err := this.lock()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		this.unlock(owner)
+	}, nil
+}
+
+// DryRun的时候版本表可能还不存在，当作没有执行过任何迁移
+func (this *Migrator) applied() (map[uint64]*entity.SchemaVersion, error) {
+	versions, err := this.Applied()
+	if err != nil {
+		if this.DryRun {
+			versions = nil
+		} else {
+			return nil, err
+		}
+	}
+	applied := make(map[uint64]*entity.SchemaVersion, len(versions))
+	for _, version := range versions {
+		applied[version.Id] = version
+	}
+
+	return applied, nil
+}
+
+// 在一个事务中执行迁移并且修改版本记录
+func (this *Migrator) run(m *Migration, up bool) error {
+	statements, fn := m.DownSql, m.Down
+	if up {
+		statements, fn = m.UpSql, m.Up
+	}
+	session, err := repository.NewSession(this.DbName)
+	if err != nil {
+		return err
+	}
+	if this.DryRun {
+		direction := "down"
+		if up {
+			direction = "up"
+		}
+		fmt.Fprintf(this.Out, "-- migration %v %v %v\n", m.Version, m.Name, direction)
+		session = &dryRunSession{DbSession: session, out: this.Out}
+		defer session.Close()
+	}
+	err = session.Transaction(func(s repository.DbSession) error {
+		for _, statement := range statements {
+			_, err := s.Exec(statement)
+			if err != nil {
+				return err
+			}
+		}
+		if fn != nil {
+			err := fn(s)
+			if err != nil {
+				return err
+			}
+		}
+		version := &entity.SchemaVersion{Name: m.Name, Checksum: m.checksum()}
+		version.Id = m.Version
+		if up {
+			_, err = s.Insert(version)
+		} else {
+			_, err = s.Delete(version, "")
+		}
+		return err
+	})
+	if err != nil {
+		logger.Sugar.Errorf("migration:%v %v failure:%v", m.Version, m.Name, err.Error())
+		return err
+	}
+	if !this.DryRun {
+		logger.Sugar.Infof("migration:%v %v up:%v", m.Version, m.Name, up)
+	}
+
+	return nil
+}
+
+/*
+*
+加锁，锁不存在的时候插入，锁已经超时的时候抢占，锁的版本号保证并发抢占的时候只有一个成功
+返回持有锁的标识
+*/
+func (this *Migrator) lock() (string, error) {
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%v:%v:%v", hostname, os.Getpid(), security.UUID())
+	if len(owner) > 64 {
+		owner = owner[len(owner)-64:]
+	}
+	session, err := repository.NewSession(this.DbName)
+	if err != nil {
+		return "", err
+	}
+	err = session.Transaction(func(s repository.DbSession) error {
+		now := time.Now()
+		lock := &entity.SchemaLock{}
+		lock.Id = schemaLockId
+		found, err := s.Get(lock, false, "", "")
+		if err != nil {
+			return err
+		}
+		if !found {
+			lock = &entity.SchemaLock{Owner: owner, LockDate: &now}
+			lock.Id = schemaLockId
+			_, err = s.Insert(lock)
+			return err
+		}
+		if lock.LockDate != nil && now.Sub(*lock.LockDate) < this.LockTimeout {
+			return fmt.Errorf("%w: %v", ErrLocked, lock.Owner)
+		}
+		logger.Sugar.Warnf("migration lock of %v timeout, taken over", lock.Owner)
+		lock.Owner = owner
+		lock.LockDate = &now
+		_, err = s.Update(lock, nil, "")
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, ErrLocked) {
+			err = fmt.Errorf("%w: %v", ErrLocked, err.Error())
+		}
+		logger.Sugar.Errorf("%v", err.Error())
+		return "", err
+	}
+
+	return owner, nil
+}
+
+// 释放自己持有的锁
+func (this *Migrator) unlock(owner string) {
+	session, err := repository.NewSession(this.DbName)
+	if err != nil {
+		return
+	}
+	err = session.Transaction(func(s repository.DbSession) error {
+		lock := &entity.SchemaLock{}
+		lock.Id = schemaLockId
+		found, err := s.Get(lock, false, "", "")
+		if err != nil || !found || lock.Owner != owner {
+			return err
+		}
+		_, err = s.Delete(lock, "")
+		return err
+	})
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
+}
+
+/*
+*
+DryRun的会话，读操作正常执行，修改操作和sql只写到out，不执行
+*/
+type dryRunSession struct {
+	repository.DbSession
+	out io.Writer
+}
+
+func (this *dryRunSession) Sync(beans ...interface{}) error {
+	for _, bean := range beans {
+		fmt.Fprintf(this.out, "-- sync %T\n", bean)
+	}
+	return nil
+}
+
+func (this *dryRunSession) Insert(mds ...interface{}) (int64, error) {
+	for _, md := range mds {
+		fmt.Fprintf(this.out, "-- insert %T\n", md)
+	}
+	return 0, nil
+}
+
+func (this *dryRunSession) Update(md interface{}, columns []string, conds string, params ...interface{}) (int64, error) {
+	fmt.Fprintf(this.out, "-- update %T %v %v %v\n", md, columns, conds, params)
+	return 0, nil
+}
+
+func (this *dryRunSession) Delete(md interface{}, conds string, params ...interface{}) (int64, error) {
+	fmt.Fprintf(this.out, "-- delete %T %v %v\n", md, conds, params)
+	return 0, nil
+}
+
+func (this *dryRunSession) DeleteByCriteria(md interface{}, criteria *repository.Criteria) (int64, error) {
+	fmt.Fprintf(this.out, "-- delete %T by criteria\n", md)
+	return 0, nil
+}
+
+func (this *dryRunSession) Exec(clause string, params ...interface{}) (sql.Result, error) {
+	if len(params) > 0 {
+		fmt.Fprintf(this.out, "%v; -- %v\n", clause, params)
+	} else {
+		fmt.Fprintf(this.out, "%v;\n", clause)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (this *dryRunSession) BatchInsert(mds []interface{}, useCopy bool) (int64, error) {
+	if len(mds) > 0 {
+		fmt.Fprintf(this.out, "-- batch insert %v %T\n", len(mds), mds[0])
+	}
+	return 0, nil
+}
+
+func (this *dryRunSession) UpsertBatch(mds []interface{}, conflictColumns []string, updateColumns []string) (int64, int64, error) {
+	if len(mds) > 0 {
+		fmt.Fprintf(this.out, "-- upsert %v %T %v %v\n", len(mds), mds[0], conflictColumns, updateColumns)
+	}
+	return 0, 0, nil
+}
+
+// Clause可以是任意的sql，所以复杂查询也只输出sql
+func (this *dryRunSession) Complex(qb *repository.QueryBuilder, dest interface{}) error {
+	clause, params, err := qb.ToSql(func(bean interface{}) string {
+		return fmt.Sprintf("%T", bean)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = this.Exec(clause, params...)
+
+	return err
+}
+
+func (this *dryRunSession) Transaction(fc func(s repository.DbSession) error) error {
+	return fc(this)
+}
+
+// 返回新会话的方法也要返回DryRun的会话，否则修改操作会被执行
+func (this *dryRunSession) WithContext(ctx context.Context) repository.DbSession {
+	return &dryRunSession{DbSession: this.DbSession.WithContext(ctx), out: this.out}
+}
+
+func (this *dryRunSession) Unscoped() repository.DbSession {
+	return &dryRunSession{DbSession: this.DbSession.Unscoped(), out: this.out}
+}
+
+func (this *dryRunSession) Filter(filters ...repository.Filter) repository.DbSession {
+	return &dryRunSession{DbSession: this.DbSession.Filter(filters...), out: this.out}
+}
+
+func (this *dryRunSession) Unfiltered() repository.DbSession {
+	return &dryRunSession{DbSession: this.DbSession.Unfiltered(), out: this.out}
+}
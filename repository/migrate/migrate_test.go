@@ -0,0 +1,80 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+	"github.com/curltech/go-colla-core/repository/xorm"
+)
+
+func TestDryRunSession(t *testing.T) {
+	engine, err := xorm.Open(&config.DbParams{Drivername: "sqlite3", Dsn: filepath.Join(t.TempDir(), "dryrun.db"), MaxOpenConns: 1})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer engine.Close()
+	err = engine.NewSession().Sync(new(entity.SchemaVersion))
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	version := func(id uint64) *entity.SchemaVersion {
+		v := &entity.SchemaVersion{Name: "v"}
+		v.Id = id
+		return v
+	}
+	out := &bytes.Buffer{}
+	var session repository.DbSession = &dryRunSession{DbSession: engine.NewSession(), out: out}
+	// 返回新会话的方法都要返回DryRun的会话
+	sessions := map[string]repository.DbSession{
+		"session":     session,
+		"WithContext": session.WithContext(context.Background()),
+		"Unscoped":    session.Unscoped(),
+		"Filter":      session.Filter(),
+		"Unfiltered":  session.Unfiltered(),
+	}
+	for name, s := range sessions {
+		_, ok := s.(*dryRunSession)
+		if !ok {
+			t.Fatalf("%v: %T", name, s)
+		}
+		writes := []func() error{
+			func() error { _, err := s.Insert(version(1)); return err },
+			func() error { _, err := s.BatchInsert([]interface{}{version(2), version(3)}, false); return err },
+			func() error {
+				_, _, err := s.UpsertBatch([]interface{}{version(4)}, []string{"id"}, nil)
+				return err
+			},
+			func() error { _, err := s.Update(version(1), []string{"Name"}, ""); return err },
+			func() error { _, err := s.Delete(version(1), ""); return err },
+			func() error {
+				_, err := s.DeleteByCriteria(new(entity.SchemaVersion), repository.Ge("id", 0))
+				return err
+			},
+			func() error { _, err := s.Exec("DELETE FROM bas_schema_version"); return err },
+			func() error {
+				return s.Complex(&repository.QueryBuilder{Clause: "DELETE FROM bas_schema_version WHERE id > ?", Args: []interface{}{0}}, nil)
+			},
+		}
+		for i, write := range writes {
+			err := write()
+			if err != nil {
+				t.Fatalf("%v write %v: %v", name, i, err)
+			}
+		}
+	}
+	count, err := engine.NewSession().Count(new(entity.SchemaVersion), "")
+	if err != nil || count != 0 {
+		t.Fatalf("dry run wrote: %v %v", count, err)
+	}
+	for _, want := range []string{"-- insert", "-- batch insert 2", "-- upsert 1", "-- update", "-- delete", "DELETE FROM bas_schema_version WHERE id > ?; -- [0]"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("output without %q:\n%v", want, out.String())
+		}
+	}
+}
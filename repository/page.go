@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"reflect"
+	"strings"
+)
+
+const (
+	Cursor_Next string = "next"
+	Cursor_Prev string = "prev"
+)
+
+/*
+*
+游标分页的结果，Data是结构数组的指针
+NextCursor和PrevCursor是下一页和上一页的游标，没有的时候是空字符串
+*/
+type Page struct {
+	Data       interface{}
+	NextCursor string
+	PrevCursor string
+}
+
+// 游标的内容，Values是一条记录的排序列的值，Direction是翻页的方向
+type cursor struct {
+	Direction string            `json:"d"`
+	Values    []json.RawMessage `json:"v"`
+}
+
+/*
+*
+游标分页的排序，在条件的排序后面加上主键，保证排序是唯一的
+*/
+func KeysetOrders(criteria *Criteria) []Order {
+	orders := make([]Order, 0)
+	hasId := false
+	if criteria != nil {
+		for _, o := range criteria.Orders {
+			orders = append(orders, o)
+			if normalize(o.Field) == normalize(baseentity.FieldName_Id) {
+				hasId = true
+			}
+		}
+	}
+	if !hasId {
+		orders = append(orders, Order{Field: strings.ToLower(baseentity.FieldName_Id)})
+	}
+
+	return orders
+}
+
+/*
+*
+从记录的排序列的值生成游标
+*/
+func EncodeCursor(row interface{}, orders []Order, direction string) (string, error) {
+	c := cursor{Direction: direction, Values: make([]json.RawMessage, len(orders))}
+	value := reflect.ValueOf(row)
+	for i, o := range orders {
+		f := FieldByColumn(value, o.Field)
+		if !f.IsValid() {
+			return "", errors.New("NoField")
+		}
+		bs, err := json.Marshal(f.Interface())
+		if err != nil {
+			return "", err
+		}
+		c.Values[i] = bs
+	}
+	bs, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+/*
+*
+把游标翻译成条件，返回查询的条件和方向，向前翻页的时候排序是相反的，查询的结果需要倒过来
+prototype是实体，用于把游标中的值转换成字段的类型
+条件是(o1 > v1) or (o1 = v1 and o2 > v2) ...，降序的列使用<
+*/
+func KeysetCriteria(prototype interface{}, criteria *Criteria, orders []Order, encoded string) (*Criteria, string, error) {
+	var c *Criteria
+	if criteria.HasCondition() {
+		c = criteria.Unordered()
+	}
+	direction := Cursor_Next
+	if encoded != "" {
+		bs, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, "", errors.New("InvalidCursor")
+		}
+		var cur cursor
+		err = json.Unmarshal(bs, &cur)
+		if err != nil || len(cur.Values) != len(orders) {
+			return nil, "", errors.New("InvalidCursor")
+		}
+		direction = cur.Direction
+		if direction != Cursor_Next && direction != Cursor_Prev {
+			return nil, "", errors.New("InvalidCursor")
+		}
+		values := make([]interface{}, len(orders))
+		value := reflect.ValueOf(prototype)
+		for i, o := range orders {
+			f := FieldByColumn(value, o.Field)
+			if !f.IsValid() {
+				return nil, "", errors.New("NoField")
+			}
+			typ := f.Type()
+			if typ.Kind() == reflect.Ptr {
+				typ = typ.Elem()
+			}
+			v := reflect.New(typ)
+			err = json.Unmarshal(cur.Values[i], v.Interface())
+			if err != nil {
+				return nil, "", errors.New("InvalidCursor")
+			}
+			values[i] = v.Elem().Interface()
+		}
+		keyset := make([]*Criteria, len(orders))
+		for i, o := range orders {
+			eqs := make([]*Criteria, 0, i+1)
+			for j := 0; j < i; j++ {
+				eqs = append(eqs, Eq(orders[j].Field, values[j]))
+			}
+			// 向后翻页的时候升序的列取大于，向前翻页的时候相反
+			if o.Desc == (direction == Cursor_Prev) {
+				eqs = append(eqs, Gt(o.Field, values[i]))
+			} else {
+				eqs = append(eqs, Lt(o.Field, values[i]))
+			}
+			keyset[i] = And(eqs...)
+		}
+		if c == nil {
+			c = Or(keyset...)
+		} else {
+			c = c.And(Or(keyset...))
+		}
+	}
+	if c == nil {
+		c = &Criteria{}
+	}
+	for _, o := range orders {
+		if direction == Cursor_Prev {
+			c.Sort(o.Field, !o.Desc)
+		} else {
+			c.Sort(o.Field, o.Desc)
+		}
+	}
+
+	return c, direction, nil
+}
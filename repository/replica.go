@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"github.com/curltech/go-colla-core/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+*
+支持读写分离的引擎实现这个接口，读会话连接健康的副本，没有健康的副本的时候连接主库
+*/
+type ReadEngine interface {
+	NewReadSession() DbSession
+}
+
+/*
+*
+只读副本的集合，定时检查副本是否可用，轮流选择可用的副本
+*/
+type ReplicaSet struct {
+	pings   []func(ctx context.Context) error
+	healthy []atomic.Bool
+	next    atomic.Uint64
+	stop    chan struct{}
+	once    sync.Once
+}
+
+/*
+*
+创建副本集合，pings检查每个副本是否可用，interval是检查的间隔
+创建的时候所有副本都认为是可用的，然后立即开始检查
+*/
+func NewReplicaSet(pings []func(ctx context.Context) error, interval time.Duration) *ReplicaSet {
+	rs := &ReplicaSet{pings: pings, healthy: make([]atomic.Bool, len(pings)), stop: make(chan struct{})}
+	for i := range rs.healthy {
+		rs.healthy[i].Store(true)
+	}
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	go rs.check(interval)
+
+	return rs
+}
+
+func (this *ReplicaSet) check(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for i, ping := range this.pings {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := ping(ctx)
+			cancel()
+			if err != nil {
+				if this.healthy[i].Swap(false) {
+					logger.Sugar.Errorf("replica:%v unhealthy:%v", i, err.Error())
+				}
+			} else if !this.healthy[i].Swap(true) {
+				logger.Sugar.Infof("replica:%v recovered", i)
+			}
+		}
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 轮流选择可用的副本，返回副本的序号，没有可用的副本的时候返回-1
+func (this *ReplicaSet) Pick() int {
+	n := len(this.healthy)
+	if n == 0 {
+		return -1
+	}
+	start := int(this.next.Add(1) % uint64(n))
+	for i := 0; i < n; i++ {
+		j := (start + i) % n
+		if this.healthy[j].Load() {
+			return j
+		}
+	}
+
+	return -1
+}
+
+// 停止健康检查
+func (this *ReplicaSet) Close() {
+	this.once.Do(func() {
+		close(this.stop)
+	})
+}
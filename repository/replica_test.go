@@ -0,0 +1,113 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+func TestReplicaRouting(t *testing.T) {
+	for name, open := range sqlDrivers {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			replica := filepath.Join(dir, "replica.db")
+			// 副本和主库是不同的数据库文件，分别写入不同的记录
+			for i, params := range []*config.DbParams{
+				{Drivername: "sqlite3", Dsn: replica, MaxOpenConns: 1},
+				{Drivername: "sqlite3", Dsn: filepath.Join(dir, "primary.db"), MaxOpenConns: 1},
+			} {
+				engine, err := open(params)
+				if err != nil {
+					t.Fatalf("open: %v", err)
+				}
+				err = engine.NewSession().Sync(new(conformanceRow))
+				if err != nil {
+					t.Fatalf("sync: %v", err)
+				}
+				row := &conformanceRow{Name: []string{"replica", "primary"}[i]}
+				row.Id = uint64(i + 1)
+				_, err = engine.NewSession().Insert(row)
+				if err != nil {
+					t.Fatalf("insert: %v", err)
+				}
+				engine.Close()
+			}
+			engine, err := open(&config.DbParams{Drivername: "sqlite3", Dsn: filepath.Join(dir, "primary.db"), MaxOpenConns: 1, Replicas: []string{replica}})
+			if err != nil {
+				t.Fatalf("open with replica: %v", err)
+			}
+			defer engine.Close()
+			query := func(session repository.DbSession) string {
+				results, err := session.Query("SELECT id, name FROM conformance_row")
+				if err != nil || len(results) != 1 {
+					t.Fatalf("query: %v %v", results, err)
+				}
+				return string(results[0]["name"])
+			}
+			if got := query(engine.(repository.ReadEngine).NewReadSession()); got != "replica" {
+				t.Fatalf("read session: %v", got)
+			}
+			if got := query(engine.NewSession()); got != "primary" {
+				t.Fatalf("write session: %v", got)
+			}
+			rows := make([]*conformanceRow, 0)
+			err = engine.(repository.ReadEngine).NewReadSession().Find(&rows, nil, "", 0, 0, "")
+			if err != nil || len(rows) != 1 || rows[0].Id != 1 {
+				t.Fatalf("find on replica: %v %v", rows, err)
+			}
+		})
+	}
+}
+
+func TestQueryValues(t *testing.T) {
+	for name, engine := range conformanceEngines(t, sqlDrivers) {
+		t.Run(name, func(t *testing.T) {
+			seedRows(t, engine)
+			results, err := engine.NewSession().Query("SELECT id, name, amount FROM conformance_row WHERE id >= ? ORDER BY id", 2)
+			if err != nil || len(results) != 2 {
+				t.Fatalf("query: %v %v", results, err)
+			}
+			got := results[1]
+			if string(got["id"]) != "3" || string(got["name"]) != "c" || string(got["amount"]) != "30" {
+				t.Fatalf("values: %q", got)
+			}
+		})
+	}
+}
+
+func TestReplicaSetPick(t *testing.T) {
+	failure := errors.New("down")
+	ok := func(ctx context.Context) error { return nil }
+	down := func(ctx context.Context) error { return failure }
+	rs := repository.NewReplicaSet([]func(ctx context.Context) error{down, ok}, 10*time.Millisecond)
+	defer rs.Close()
+	// 检查以后只选择可用的副本
+	deadline := time.Now().Add(time.Second)
+	for {
+		picked := map[int]bool{}
+		for i := 0; i < 4; i++ {
+			picked[rs.Pick()] = true
+		}
+		if len(picked) == 1 && picked[1] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("picked: %v", picked)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	none := repository.NewReplicaSet([]func(ctx context.Context) error{down}, 10*time.Millisecond)
+	defer none.Close()
+	deadline = time.Now().Add(time.Second)
+	for none.Pick() != -1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unhealthy replica picked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
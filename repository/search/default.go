@@ -1,6 +1,7 @@
 package search
 
 import (
+	"context"
 	"github.com/curltech/go-colla-core/config"
 	"github.com/curltech/go-colla-core/repository/search/elastic"
 )
@@ -31,6 +32,23 @@ func GetSearchSession() SearchSession {
 	return nil
 }
 
+/*
+*
+获取使用ctx的搜索会话，请求在ctx取消或者超时的时候中止
+*/
+func GetSearchSessionWithContext(ctx context.Context) SearchSession {
+	if config.SearchParams.Mode == "elastic" {
+		elastic.ElasticSearchSession.Start()
+
+		return elastic.ElasticSearchSession.WithContext(ctx)
+	} else if config.SearchParams.Mode == "default" {
+		elastic.DefaultSearchSession.Start()
+
+		return elastic.DefaultSearchSession.WithContext(ctx)
+	}
+	return nil
+}
+
 func init() {
 
 }
@@ -16,12 +16,29 @@ import (
 )
 
 type defaultSearchSession struct {
-	es *elastic.Client
+	es  *elastic.Client
+	ctx context.Context
 }
 
 var DefaultSearchSession *defaultSearchSession = &defaultSearchSession{}
 
 // 初始化
+/*
+*
+返回使用ctx的会话，请求在ctx取消或者超时的时候中止，共享同一个客户端
+*/
+func (this *defaultSearchSession) WithContext(ctx context.Context) *defaultSearchSession {
+	return &defaultSearchSession{es: this.es, ctx: ctx}
+}
+
+func (this *defaultSearchSession) context() context.Context {
+	if this.ctx != nil {
+		return this.ctx
+	}
+
+	return context.Background()
+}
+
 func (this *defaultSearchSession) Start() {
 	if this.es != nil {
 		return
@@ -35,7 +52,7 @@ func (this *defaultSearchSession) Start() {
 }
 
 func (this *defaultSearchSession) Info() {
-	info, code, err := this.es.Ping(config.SearchParams.Address[0]).Do(context.Background())
+	info, code, err := this.es.Ping(config.SearchParams.Address[0]).Do(this.context())
 	if err != nil {
 		logger.Sugar.Errorf("Error ping: %s", err)
 	}
@@ -64,7 +81,7 @@ func (this *defaultSearchSession) Index(indexName string, mds ...interface{}) er
 				Index(indexName).
 				Id(id).
 				BodyJson(md).
-				Do(context.Background())
+				Do(this.context())
 			if err != nil {
 				logger.Sugar.Errorf("%v", err)
 				return
@@ -90,7 +107,7 @@ func (this *defaultSearchSession) Delete(indexName string, ids ...string) error
 			defer wg.Done()
 			res, err := this.es.Delete().Index(indexName).
 				Id(id).
-				Do(context.Background())
+				Do(this.context())
 			if err != nil {
 				logger.Sugar.Errorf("%v", err)
 
@@ -121,7 +138,7 @@ func (this *defaultSearchSession) Update(indexName string, mds ...interface{}) e
 				Index(indexName).
 				Id(id).
 				Doc(md).
-				Do(context.Background())
+				Do(this.context())
 			if err != nil {
 				logger.Sugar.Errorf("%v", err)
 				return
@@ -137,7 +154,7 @@ func (this *defaultSearchSession) Update(indexName string, mds ...interface{}) e
 // 查找
 func (this *defaultSearchSession) Get(indexName string, id string) (map[string]interface{}, error) {
 	//通过id查找
-	result, err := this.es.Get().Index(indexName).Id(id).Do(context.Background())
+	result, err := this.es.Get().Index(indexName).Id(id).Do(this.context())
 	if err != nil {
 		return nil, err
 	}
@@ -158,7 +175,7 @@ func (this *defaultSearchSession) Query(indexName string, query string, from int
 
 	//字段相等
 	q := elastic.NewRawStringQuery(query)
-	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(context.Background())
+	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(this.context())
 	if err != nil {
 		logger.Sugar.Errorf("%v", err)
 	}
@@ -171,7 +188,7 @@ func (this *defaultSearchSession) StringQuery(indexName string, query string, fr
 	q := elastic.NewQueryStringQuery(query)
 	var res *elastic.SearchResult
 	var err error
-	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(context.Background())
+	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(this.context())
 	if err != nil {
 		logger.Sugar.Errorf("%v", err)
 	}
@@ -187,7 +204,7 @@ func (this *defaultSearchSession) MatchQuery(indexName string, query map[string]
 	var res *elastic.SearchResult
 	var err error
 	//q.Filter(elastic.NewRangeQuery("age").Gt(30))
-	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(context.Background())
+	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(this.context())
 	if err != nil {
 		logger.Sugar.Errorf("%v", err)
 	}
@@ -202,7 +219,7 @@ func (this *defaultSearchSession) MatchPhraseQuery(indexName string, query map[s
 	}
 	var res *elastic.SearchResult
 	var err error
-	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(context.Background())
+	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(this.context())
 	if err != nil {
 		logger.Sugar.Errorf("%v", err)
 	}
@@ -217,7 +234,7 @@ func (this *defaultSearchSession) FuzzyQuery(indexName string, query map[string]
 	}
 	var res *elastic.SearchResult
 	var err error
-	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(context.Background())
+	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(this.context())
 	if err != nil {
 		logger.Sugar.Errorf("%v", err)
 	}
@@ -232,7 +249,7 @@ func (this *defaultSearchSession) TermQuery(indexName string, query map[string]i
 	}
 	var res *elastic.SearchResult
 	var err error
-	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(context.Background())
+	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(this.context())
 	if err != nil {
 		logger.Sugar.Errorf("%v", err)
 	}
@@ -247,7 +264,7 @@ func (this *defaultSearchSession) WildcardQuery(indexName string, query map[stri
 	}
 	var res *elastic.SearchResult
 	var err error
-	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(context.Background())
+	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(this.context())
 	if err != nil {
 		logger.Sugar.Errorf("%v", err)
 	}
@@ -262,7 +279,7 @@ func (this *defaultSearchSession) PrefixQuery(indexName string, query map[string
 	}
 	var res *elastic.SearchResult
 	var err error
-	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(context.Background())
+	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(this.context())
 	if err != nil {
 		logger.Sugar.Errorf("%v", err)
 	}
@@ -285,7 +302,7 @@ func (this *defaultSearchSession) RangeQuery(indexName string, query map[string]
 	}
 	var res *elastic.SearchResult
 	var err error
-	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(context.Background())
+	res, err = this.es.Search(indexName).Size(limit).From(from).Query(q).Do(this.context())
 	if err != nil {
 		logger.Sugar.Errorf("%v", err)
 	}
@@ -297,7 +314,7 @@ func (this *defaultSearchSession) TermsAggregation(indexName string, field strin
 	aggs := elastic.NewTermsAggregation().Field(field)
 	var res *elastic.SearchResult
 	var err error
-	res, err = this.es.Search(indexName).Size(limit).From(from).Aggregation(value, aggs).Do(context.Background())
+	res, err = this.es.Search(indexName).Size(limit).From(from).Aggregation(value, aggs).Do(this.context())
 	if err != nil {
 		logger.Sugar.Errorf("%v", err)
 	}
@@ -29,11 +29,28 @@ import (
 )
 
 type elasticSearchSession struct {
-	es *elastic.Client
+	es  *elastic.Client
+	ctx context.Context
 }
 
 var ElasticSearchSession *elasticSearchSession = &elasticSearchSession{}
 
+/*
+*
+返回使用ctx的会话，请求在ctx取消或者超时的时候中止，共享同一个客户端
+*/
+func (this *elasticSearchSession) WithContext(ctx context.Context) *elasticSearchSession {
+	return &elasticSearchSession{es: this.es, ctx: ctx}
+}
+
+func (this *elasticSearchSession) context() context.Context {
+	if this.ctx != nil {
+		return this.ctx
+	}
+
+	return context.Background()
+}
+
 func (this *elasticSearchSession) Start() {
 	if this.es != nil {
 		return
@@ -143,7 +160,7 @@ func (this *elasticSearchSession) Index(indexName string, mds ...interface{}) er
 			}
 
 			// Perform the request with the client.
-			res, err := req.Do(context.Background(), this.es)
+			res, err := req.Do(this.context(), this.es)
 			if err != nil {
 				logger.Sugar.Errorf("Error getting response: %s", err)
 				return
@@ -195,7 +212,7 @@ func (this *elasticSearchSession) Query(indexName string, query string, from int
 
 	// Perform the search request.
 	res, err := this.es.Search(
-		this.es.Search.WithContext(context.Background()),
+		this.es.Search.WithContext(this.context()),
 		this.es.Search.WithIndex(indexName),
 		this.es.Search.WithBody(&buf),
 		this.es.Search.WithTrackTotalHits(true),
@@ -281,7 +298,7 @@ func (this *elasticSearchSession) BulkIndex(indexName string, mds ...interface{}
 		// Add an item to the BulkIndexer
 		id, _ := reflect.GetValue(md, baseentity.FieldName_Id)
 		err = bi.Add(
-			context.Background(),
+			this.context(),
 			esutil.BulkIndexerItem{
 				// Action field configures the operation to perform (index, create, delete, update)
 				Action: "index",
@@ -312,7 +329,7 @@ func (this *elasticSearchSession) BulkIndex(indexName string, mds ...interface{}
 		}
 	}
 	// Close the indexer
-	if err := bi.Close(context.Background()); err != nil {
+	if err := bi.Close(this.context()); err != nil {
 		logger.Sugar.Errorf("Unexpected error: %s", err)
 	}
 
@@ -349,7 +366,7 @@ func (this *elasticSearchSession) Delete(indexName string, ids ...string) error
 			}
 
 			// Perform the request with the client.
-			res, err := req.Do(context.Background(), this.es)
+			res, err := req.Do(this.context(), this.es)
 			if err != nil {
 				logger.Sugar.Errorf("Error getting response: %s", err)
 				return
@@ -376,7 +393,7 @@ func (this *elasticSearchSession) Get(indexName string, id string) (map[string]i
 	}
 
 	// Perform the request with the client.
-	res, err := req.Do(context.Background(), this.es)
+	res, err := req.Do(this.context(), this.es)
 	if err != nil {
 		logger.Sugar.Errorf("Error getting response: %s", err)
 
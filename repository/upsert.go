@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"reflect"
+	"strings"
+)
+
+// 一批实体中有冲突键相同的实体，同一条语句不能新增和修改同一条记录
+var ErrDuplicateConflictKey = errors.New("DuplicateConflictKey")
+
+/*
+*
+实体的冲突键的值，conflictColumns是字段名或者列名，一批实体中冲突键重复的时候返回ErrDuplicateConflictKey
+*/
+func ConflictKeys(mds []interface{}, conflictColumns []string) ([][]interface{}, error) {
+	if len(conflictColumns) == 0 {
+		return nil, errors.New("NoConflictColumn")
+	}
+	keys := make([][]interface{}, len(mds))
+	seen := make(map[string]bool, len(mds))
+	for i, md := range mds {
+		value := reflect.ValueOf(md)
+		key := make([]interface{}, len(conflictColumns))
+		for j, column := range conflictColumns {
+			f := FieldByColumn(value, column)
+			if !f.IsValid() {
+				return nil, fmt.Errorf("InvalidConflictColumn: %v", column)
+			}
+			key[j] = reflect.Indirect(f).Interface()
+		}
+		s := fmt.Sprintf("%v", key)
+		if seen[s] {
+			return nil, fmt.Errorf("%w: %v", ErrDuplicateConflictKey, s)
+		}
+		seen[s] = true
+		keys[i] = key
+	}
+
+	return keys, nil
+}
+
+/*
+*
+逐条的批量新增或者修改，用于不支持ON CONFLICT的数据库，返回新增和修改的记录数
+按照冲突键查找已有的记录，包括软删除的记录，找到的时候按照已有记录的id修改updateColumns，否则新增
+软删除的已有记录修改的时候清除删除时间，和ON CONFLICT的行为一致
+updateColumns为空的时候修改UpsertColumns返回的字段，被会话的过滤条件排除的已有记录不修改，也不计数
+实体的id只用于新增，修改的时候使用已有记录的id，修改完恢复实体原来的id
+*/
+func UpsertEach(session DbSession, mds []interface{}, conflictColumns []string, updateColumns []string) (int64, int64, error) {
+	keys, err := ConflictKeys(mds, conflictColumns)
+	if err != nil {
+		return 0, 0, err
+	}
+	var inserted, updated int64
+	for i, md := range mds {
+		criterias := make([]*Criteria, len(conflictColumns))
+		for j, column := range conflictColumns {
+			criterias[j] = Eq(column, keys[i][j])
+		}
+		existing := reflect.New(reflect.Indirect(reflect.ValueOf(md)).Type()).Interface()
+		found, err := session.Unscoped().GetByCriteria(existing, false, And(criterias...))
+		if err == nil && !found {
+			// 被过滤条件排除的已有记录不修改
+			found, err = session.Unfiltered().Unscoped().GetByCriteria(existing, false, And(criterias...))
+			if err == nil && found {
+				continue
+			}
+		}
+		if err != nil {
+			return inserted, updated, err
+		}
+		if !found {
+			_, err = session.Insert(md)
+			if err != nil {
+				return inserted, updated, err
+			}
+			inserted++
+			continue
+		}
+		columns := updateColumns
+		if len(columns) == 0 {
+			columns = UpsertColumns(md, conflictColumns)
+		}
+		if IsDeleted(existing) {
+			_, name := DeletedField(md)
+			SetDeleted(md, nil)
+			columns = append(append(make([]string, 0, len(columns)+1), columns...), name)
+		}
+		// 已有的记录可能已经软删除，按照id修改的时候也要包括软删除的记录
+		n, err := updateExisting(session.Unscoped(), md, existing, columns)
+		if err != nil {
+			return inserted, updated, err
+		}
+		updated += n
+	}
+
+	return inserted, updated, nil
+}
+
+// 按照已有记录的id和版本号修改实体，修改完恢复实体原来的id
+func updateExisting(session DbSession, md interface{}, existing interface{}, updateColumns []string) (int64, error) {
+	old, _ := GetId(md)
+	id, _ := GetId(existing)
+	SetId(md, id)
+	if old != nil {
+		defer SetId(md, old)
+	}
+	version, _ := VersionField(md)
+	if version.IsValid() {
+		current, _ := VersionField(existing)
+		version.SetInt(current.Int())
+	}
+
+	return session.Update(md, updateColumns, "")
+}
+
+// 修改时间字段和字段名，也就是带xorm:"updated"标签的时间字段，比如BaseEntity的UpdateDate，没有的时候返回无效的Value
+func UpdatedField(md interface{}) (reflect.Value, string) {
+	value := reflect.Indirect(reflect.ValueOf(md))
+	if value.Kind() != reflect.Struct {
+		return reflect.Value{}, ""
+	}
+
+	return taggedField(value, "updated", func(typ reflect.Type) bool {
+		return typ == timeType || typ == reflect.PtrTo(timeType)
+	})
+}
+
+/*
+*
+没有指定修改的字段的时候修改的字段，也就是冲突键，主键，创建时间，创建人，删除时间和版本号以外的所有字段
+*/
+func UpsertColumns(md interface{}, conflictColumns []string) []string {
+	typ := reflect.TypeOf(md)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	conflicts := make(map[string]bool, len(conflictColumns))
+	for _, column := range conflictColumns {
+		conflicts[normalize(column)] = true
+	}
+	columns := make([]string, 0)
+	for _, field := range reflect.VisibleFields(typ) {
+		if field.Anonymous || !field.IsExported() || conflicts[normalize(field.Name)] || field.Name == baseentity.FieldName_CreateUserId {
+			continue
+		}
+		skip := false
+		for _, t := range strings.Fields(field.Tag.Get("xorm")) {
+			switch t {
+			case "-", "<-", "pk", "created", "deleted", "version", "extends":
+				skip = true
+			}
+		}
+		if !skip {
+			columns = append(columns, field.Name)
+		}
+	}
+
+	return columns
+}
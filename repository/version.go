@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+/*
+*
+乐观锁的冲突，按照id更新带版本号的实体时没有更新任何记录，说明版本号已经被其他事务修改，或者记录已经被删除
+各个DbSession返回的错误都包装了ErrStaleEntity，使用errors.Is(err, repository.ErrStaleEntity)判断
+*/
+var ErrStaleEntity = errors.New("StaleEntity")
+
+func StaleEntity(md interface{}, id interface{}, version int64) error {
+	return fmt.Errorf("%w: %T id %v version %v", ErrStaleEntity, md, id, version)
+}
+
+// 实体的版本号字段和字段名，也就是带xorm:"version"标签的整数字段，没有的时候返回无效的Value
+func VersionField(md interface{}) (reflect.Value, string) {
+	value := reflect.Indirect(reflect.ValueOf(md))
+	if value.Kind() != reflect.Struct {
+		return reflect.Value{}, ""
+	}
+
+	return taggedField(value, "version", func(typ reflect.Type) bool {
+		switch typ.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return true
+		}
+		return false
+	})
+}
+
+// 新增的实体版本号为0的时候从1开始，和xorm的行为一致
+func InitVersion(md interface{}) {
+	version, _ := VersionField(md)
+	if version.IsValid() && version.Int() == 0 {
+		version.SetInt(1)
+	}
+}
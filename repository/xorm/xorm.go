@@ -1,27 +1,75 @@
 package xorm
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/curltech/go-colla-core/config"
 	"github.com/curltech/go-colla-core/logger"
 	_ "github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-core/repository"
 	"github.com/curltech/go-colla-core/util/reflect"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	goreflect "reflect"
+	"strconv"
 	"strings"
 	"time"
+	"xorm.io/builder"
 	"xorm.io/xorm"
+	"xorm.io/xorm/convert"
 	"xorm.io/xorm/log"
+	"xorm.io/xorm/schemas"
 )
 
 type XormSession struct {
-	Session *xorm.Session
+	Session  *xorm.Session
+	engine   *xorm.Engine
+	unscoped bool
+	filters  []repository.Filter
+	ctx      context.Context //WithContext设置的ctx，xorm不直接执行的语句使用
 }
 
-var engine *xorm.Engine
+type XormEngine struct {
+	Engine   *xorm.Engine
+	Group    *xorm.EngineGroup //配置了只读副本的时候是主库和副本组成的引擎组
+	replicas *repository.ReplicaSet
+	policy   xorm.GroupPolicyHandler
+}
+
+func (this *XormEngine) NewSession() repository.DbSession {
+	s := this.Engine.NewSession()
+
+	return &XormSession{Session: s, engine: this.Engine}
+}
+
+// 读会话连接健康的副本，没有副本或者副本都不可用的时候连接主库
+func (this *XormEngine) NewReadSession() repository.DbSession {
+	if this.Group == nil {
+		return this.NewSession()
+	}
+	engine := this.policy.Slave(this.Group)
+	s := engine.NewSession()
+
+	return &XormSession{Session: s, engine: engine}
+}
+
+func (this *XormEngine) Close() error {
+	if this.Group != nil {
+		this.replicas.Close()
+		return this.Group.Close()
+	}
+
+	return this.Engine.Close()
+}
+
+func init() {
+	repository.RegisterDriver("xorm", Open)
+	repository.RegisterDriver("memory", OpenMemory)
+}
 
 /*
 *
@@ -47,24 +95,15 @@ extends Person
 		DeletedAt time.Time `xorm:"deleted"`
 	}
 */
-func init() {
-	if config.DatabaseParams.Orm != "xorm" {
-		return
-	}
-	drivername := config.DatabaseParams.Drivername
-	dsn := config.DatabaseParams.Dsn
-	host := config.DatabaseParams.Host
-	port := config.DatabaseParams.Port
-	dbname := config.DatabaseParams.Dbname
-	user := config.DatabaseParams.User
-	password := config.DatabaseParams.Password
-	sslmode := config.DatabaseParams.Sslmode
-	//timeZone, _ := config.GetString("database.timeZone")
-	maxIdleConns := config.DatabaseParams.MaxIdleConns
-	maxOpenConns := config.DatabaseParams.MaxOpenConns
-	connMaxLifetime := config.DatabaseParams.ConnMaxLifetime
-	showSQL := config.DatabaseParams.ShowSQL
-	//logLevel := config.DatabaseParams.LogLevel
+func Open(params *config.DbParams) (repository.DbEngine, error) {
+	drivername := params.Drivername
+	dsn := params.Dsn
+	host := params.Host
+	port := params.Port
+	dbname := params.Dbname
+	user := params.User
+	password := params.Password
+	sslmode := params.Sslmode
 
 	//dsn := fmt.Sprintf("host=%v port=%v dbname=%v user=%v password=%v sslmode=%v timeZone=%v", host, port, dbname, user, password, sslmode, timeZone)
 	if dsn == "" {
@@ -73,13 +112,101 @@ func init() {
 	/**
 	如果用sqlite3，则xorm.NewEngine("sqlite3", "./test.db")
 	*/
-	engine, _ = xorm.NewEngine(drivername, dsn)
+	dsn, err := repository.SchemaDsn(drivername, dsn, params.Schema)
+	if err != nil {
+		return nil, err
+	}
+	engine, err := newEngine(drivername, dsn, params)
+	if err != nil {
+		return nil, err
+	}
+	err = createSchema(engine, params.Schema)
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	if len(params.Replicas) == 0 {
+		return &XormEngine{Engine: engine}, nil
+	}
+	slaves := make([]*xorm.Engine, 0, len(params.Replicas))
+	pings := make([]func(ctx context.Context) error, 0, len(params.Replicas))
+	for _, replica := range params.Replicas {
+		replica, err := repository.SchemaDsn(drivername, strings.TrimSpace(replica), params.Schema)
+		var slave *xorm.Engine
+		if err == nil {
+			slave, err = newEngine(drivername, replica, params)
+		}
+		if err != nil {
+			engine.Close()
+			for _, s := range slaves {
+				s.Close()
+			}
+			return nil, err
+		}
+		slaves = append(slaves, slave)
+		pings = append(pings, slave.PingContext)
+	}
+	replicas := repository.NewReplicaSet(pings, time.Duration(params.ReplicaCheck)*time.Second)
+	policy := healthyPolicy(replicas)
+	group, err := xorm.NewEngineGroup(engine, slaves, policy)
+	if err != nil {
+		replicas.Close()
+		return nil, err
+	}
+
+	return &XormEngine{Engine: engine, Group: group, replicas: replicas, policy: policy}, nil
+}
+
+// postgres的schema不存在的时候创建
+func createSchema(engine *xorm.Engine, schema string) error {
+	if schema == "" || engine.Dialect().URI().DBType != schemas.POSTGRES {
+		return nil
+	}
+	_, err := engine.Exec(fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%v"`, schema))
+	if err != nil {
+		logger.Sugar.Errorf("create schema:%v error:%v", schema, err.Error())
+	}
+
+	return err
+}
+
+/*
+*
+轮流选择健康的副本，副本都不可用的时候使用主库
+xorm在只有一个副本的时候不调用策略，所以NewReadSession直接使用这个策略
+*/
+func healthyPolicy(replicas *repository.ReplicaSet) xorm.GroupPolicyHandler {
+	return func(group *xorm.EngineGroup) *xorm.Engine {
+		i := replicas.Pick()
+		if i < 0 {
+			return group.Master()
+		}
+		return group.Slaves()[i]
+	}
+}
+
+func newEngine(drivername string, dsn string, params *config.DbParams) (*xorm.Engine, error) {
+	//timeZone := params.TimeZone
+	maxIdleConns := params.MaxIdleConns
+	maxOpenConns := params.MaxOpenConns
+	connMaxLifetime := params.ConnMaxLifetime
+	showSQL := params.ShowSQL
+	//logLevel := params.LogLevel
+
+	engine, err := xorm.NewEngine(drivername, dsn)
+	if err != nil {
+		return nil, err
+	}
 	engine.ShowSQL(showSQL)
 	engine.Logger().SetLevel(log.LOG_ERR)
 	//engine.Logger().SetLevel(core.LOG_DEBUG)
 	//engine.SetMapper(names.GonicMapper{})
 	//engine.SetTableMapper(LowerMapper{})
 	engine.SetColumnMapper(LowerMapper{})
+	// xorm使用schema查询表的元数据和加在表名前面
+	if params.Schema != "" && engine.Dialect().URI().DBType == schemas.POSTGRES {
+		engine.SetSchema(params.Schema)
+	}
 
 	//tbMapper := names.NewPrefixMapper(names.SnakeMapper{}, "prefix_")
 	//engine.SetTableMapper(tbMapper)
@@ -97,6 +224,30 @@ func init() {
 	//engine.DatabaseTZ, _ = time.LoadLocation(timeZone)
 	engine.TZLocation = time.UTC
 	engine.DatabaseTZ = time.UTC
+
+	return engine, nil
+}
+
+/*
+*
+内存数据库，使用sqlite3的共享缓存内存模式，同名的数据库在进程内共享，进程退出后数据丢失
+*/
+func OpenMemory(params *config.DbParams) (repository.DbEngine, error) {
+	p := *params
+	p.Drivername = "sqlite3"
+	name := p.Name
+	if name == "" {
+		name = "default"
+	}
+	p.Dsn = fmt.Sprintf("file:%v?mode=memory&cache=shared", name)
+	// 最后一个连接关闭的时候内存数据库就会被删除，所以至少保留一个空闲连接
+	if p.MaxIdleConns < 1 {
+		p.MaxIdleConns = 1
+	}
+	p.ConnMaxLifetime = 0
+	p.Replicas = nil
+
+	return Open(&p)
 }
 
 // LowerMapper implements IMapper and provides lower name between struct and
@@ -112,14 +263,8 @@ func (m LowerMapper) Table2Obj(t string) string {
 	return t
 }
 
-func NewXormSession() repository.DbSession {
-	s := engine.NewSession()
-
-	return &XormSession{Session: s}
-}
-
 func (this *XormSession) Sync(bean ...interface{}) error {
-	err := engine.Sync2(bean...)
+	err := this.engine.Sync2(bean...)
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
@@ -132,17 +277,24 @@ func (this *XormSession) Sync(bean ...interface{}) error {
 func (this *XormSession) Get(dest interface{}, locked bool, orderby string, conds string, params ...interface{}) (bool, error) {
 	var found bool
 	var err error
-	var session = this.Session
-	if conds != "" {
-		session = session.Where(conds, params...)
+	get := func(forUpdate bool) (bool, error) {
+		var session = this.session(dest)
+		if conds != "" {
+			session = session.Where(conds, params...)
+		}
+		if forUpdate {
+			session = session.ForUpdate()
+		}
+		if orderby != "" {
+			session = session.OrderBy(orderby)
+		}
+		return session.Get(dest)
 	}
 	if locked == true {
-		session = session.ForUpdate()
-	}
-	if orderby != "" {
-		session = session.OrderBy(orderby)
+		found, err = this.lockedGet(dest, get)
+	} else {
+		found, err = get(false)
 	}
-	found, err = session.Get(dest)
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
@@ -156,7 +308,7 @@ func (this *XormSession) Get(dest interface{}, locked bool, orderby string, cond
 // err := engine.Find(&everyone)
 func (this *XormSession) Find(rowsSlicePtr interface{}, md interface{}, orderby string, from int, limit int, conds string, params ...interface{}) error {
 	var err error
-	var session = this.Session
+	var session = this.session(rowsSlicePtr)
 	if limit != 0 || from != 0 {
 		session = session.Limit(limit, from)
 	}
@@ -188,6 +340,107 @@ func (this *XormSession) Insert(mds ...interface{}) (int64, error) {
 	return affected, err
 }
 
+/*
+*
+一条语句新增一批实体，mds是同一个类型的实体的指针，使用xorm的多行INSERT，超过参数个数上限的时候分成多条语句
+useCopy为true并且是postgres的时候使用COPY，在当前的事务中执行，不能转换成COPY的值的字段改用多行INSERT
+*/
+func (this *XormSession) BatchInsert(mds []interface{}, useCopy bool) (int64, error) {
+	if len(mds) == 0 {
+		return 0, nil
+	}
+	typ := goreflect.TypeOf(mds[0])
+	if typ.Kind() != goreflect.Ptr {
+		return 0, errors.New("DestinationNeedPtr")
+	}
+	for _, md := range mds {
+		if goreflect.TypeOf(md) != typ {
+			return 0, errors.New("BatchNeedSameType")
+		}
+	}
+	if useCopy && this.engine.Dialect().URI().DBType == schemas.POSTGRES {
+		affected, err := this.copyIn(mds)
+		if !errors.Is(err, errNotConvertible) {
+			if err != nil {
+				logger.Sugar.Errorf("%v", err.Error())
+			}
+			return affected, err
+		}
+	}
+	table, err := this.engine.TableInfo(mds[0])
+	if err != nil {
+		return 0, err
+	}
+	// 按照参数个数的上限分批插入
+	size := maxUpsertParams / len(insertColumns(table))
+	var affected int64
+	for start := 0; start < len(mds); start += size {
+		end := start + size
+		if end > len(mds) {
+			end = len(mds)
+		}
+		rows := goreflect.MakeSlice(goreflect.SliceOf(typ), 0, end-start)
+		for _, md := range mds[start:end] {
+			rows = goreflect.Append(rows, goreflect.ValueOf(md))
+		}
+		n, err := this.Session.Insert(rows.Interface())
+		affected += n
+		if err != nil {
+			logger.Sugar.Errorf("%v", err.Error())
+			return affected, err
+		}
+	}
+
+	return affected, nil
+}
+
+// 使用postgres的COPY新增，和xorm新增的时候一样填写创建时间，修改时间和版本号
+func (this *XormSession) copyIn(mds []interface{}) (int64, error) {
+	tx := this.Session.Tx()
+	if tx == nil {
+		return 0, errors.New("CopyNeedTransaction")
+	}
+	table, err := this.engine.TableInfo(mds[0])
+	if err != nil {
+		return 0, err
+	}
+	columns := insertColumns(table)
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+	}
+	rows := make([][]interface{}, len(mds))
+	now := time.Now()
+	for i, md := range mds {
+		rows[i], err = this.columnValues(columns, md, now)
+		if err != nil {
+			return 0, err
+		}
+	}
+	query := pq.CopyIn(table.Name, names...)
+	schema := this.engine.Dialect().URI().Schema
+	if schema != "" {
+		query = pq.CopyInSchema(schema, table.Name, names...)
+	}
+	stmt, err := tx.Tx.PrepareContext(this.context(), query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		_, err = stmt.ExecContext(this.context(), row...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = stmt.ExecContext(this.context())
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(mds)), nil
+}
+
 // 第一个参数是更新的数据数组，当传入的为结构体指针时，只有非空和0的field才会被作为更新的字段
 // 第二个参数指定要被更新的字段名称，即使非空和0的field也会被更新
 // 不支持指定this.Session.Table(new(User))来指定表名，而是通过结构数组来指定，因此不支持map更新
@@ -208,26 +461,40 @@ func (this *XormSession) Update(md interface{}, columns []string, conds string,
 		mds[0] = md
 	}
 	for _, md := range mds {
-		var session = this.Session
+		var session = this.session(md)
 		if columns != nil && len(columns) > 0 {
 			session = session.Cols(columns...)
 		}
 		if conds != "" {
 			session = session.Where(conds, params...)
 		}
+		var n int64
 		id, ok := repository.GetId(md)
 		if !ok {
 			if conds == "" && params != nil && len(params) > 0 {
-				affected, err = this.Session.Update(md, params...)
+				n, err = this.Session.Update(md, params...)
 			} else {
-				affected, err = this.Session.Update(md)
+				n, err = this.Session.Update(md)
 			}
 		} else {
-			affected, err = this.Session.ID(id).Update(md)
+			// 带版本号的实体，xorm在条件中加上版本号，没有更新记录说明版本号已经改变
+			version, _ := repository.VersionField(md)
+			if version.IsValid() {
+				v := version.Int()
+				n, err = this.Session.ID(id).Update(md)
+				if err == nil && n == 0 {
+					// xorm更新之后总是增加实体的版本号，冲突的时候恢复
+					version.SetInt(v)
+					err = repository.StaleEntity(md, id, v)
+				}
+			} else {
+				n, err = this.Session.ID(id).Update(md)
+			}
 		}
-		if err == nil {
-			affected++
+		if err != nil {
+			break
 		}
+		affected = affected + n
 	}
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
@@ -257,14 +524,14 @@ func (this *XormSession) Delete(md interface{}, conds string, params ...interfac
 		id, ok := repository.GetId(md)
 		if !ok {
 			if conds != "" && len(conds) > 0 {
-				affected, err = this.Session.Where(conds, params...).Delete(md)
+				affected, err = this.session(md).Where(conds, params...).Delete(md)
 			} else {
-				affected, err = this.Session.Delete(md)
+				affected, err = this.session(md).Delete(md)
 			}
 		} else {
 			blank := reflect.New(md)
 			if blank != nil {
-				affected, err = this.Session.ID(id).Delete(blank)
+				affected, err = this.session(md).ID(id).Delete(blank)
 			}
 		}
 	}
@@ -310,9 +577,9 @@ func (this *XormSession) Count(bean interface{}, conds string, params ...interfa
 	var count int64
 	var err error
 	if conds != "" && len(conds) > 0 {
-		count, err = this.Session.Where(conds, params...).Count(bean)
+		count, err = this.session(bean).Where(conds, params...).Count(bean)
 	} else {
-		count, err = this.Session.Count(bean)
+		count, err = this.session(bean).Count(bean)
 	}
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
@@ -332,9 +599,9 @@ func (this *XormSession) Count(bean interface{}, conds string, params ...interfa
 	        }
 		})
 */
-func (this *XormSession) Transaction(fc func(s repository.DbSession) error) error {
+func (this *XormSession) Transaction(fc func(s repository.DbSession) error) (err error) {
 	defer this.Close()
-	err := this.Session.Begin()
+	err = this.Session.Begin()
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
 	}
@@ -359,6 +626,67 @@ func (this *XormSession) Transaction(fc func(s repository.DbSession) error) erro
 	return err
 }
 
+// 会话的后续操作都使用ctx，ctx取消或者超时的时候中止正在执行的sql
+func (this *XormSession) WithContext(ctx context.Context) repository.DbSession {
+	this.Session.Context(ctx)
+	this.ctx = ctx
+
+	return this
+}
+
+func (this *XormSession) context() context.Context {
+	if this.ctx == nil {
+		return context.Background()
+	}
+
+	return this.ctx
+}
+
+/*
+*
+包括软删除的记录的会话，删除的时候物理删除，和原来的会话共用连接和事务
+xorm的Unscoped只对下一条语句有效，所以每条语句开始的时候都要重新设置
+*/
+func (this *XormSession) Unscoped() repository.DbSession {
+	return &XormSession{Session: this.Session, engine: this.engine, unscoped: true, filters: this.filters, ctx: this.ctx}
+}
+
+// 加上过滤器的会话，和原来的会话共用连接和事务，过滤条件在每条语句开始的时候加上
+func (this *XormSession) Filter(filters ...repository.Filter) repository.DbSession {
+	fs := append(append([]repository.Filter{}, this.filters...), filters...)
+
+	return &XormSession{Session: this.Session, engine: this.engine, unscoped: this.unscoped, filters: fs, ctx: this.ctx}
+}
+
+// 去掉过滤器的会话，和原来的会话共用连接和事务
+func (this *XormSession) Unfiltered() repository.DbSession {
+	return &XormSession{Session: this.Session, engine: this.engine, unscoped: this.unscoped, ctx: this.ctx}
+}
+
+// 每条语句开始的时候设置Unscoped和过滤条件，md用于计算过滤条件
+func (this *XormSession) session(md interface{}) *xorm.Session {
+	session := this.Session
+	if this.unscoped {
+		session = session.Unscoped()
+	}
+	criteria := repository.FilterCriteria(this.filters, md)
+	if criteria != nil {
+		err := criteria.Check()
+		var cond builder.Cond
+		if err == nil {
+			cond, err = this.toCond(criteria)
+		}
+		if err != nil {
+			// 过滤条件错误的时候不返回任何记录
+			logger.Sugar.Errorf("%v", err.Error())
+			cond = builder.Expr("1 = 0")
+		}
+		session = session.Where(cond)
+	}
+
+	return session
+}
+
 func (this *XormSession) Begin() error {
 	err := this.Session.Begin()
 	if err != nil {
@@ -386,6 +714,24 @@ func (this *XormSession) Commit() error {
 	return err
 }
 
+func (this *XormSession) Savepoint(name string) error {
+	_, err := this.Exec("SAVEPOINT " + name)
+
+	return err
+}
+
+func (this *XormSession) RollbackTo(name string) error {
+	_, err := this.Exec("ROLLBACK TO SAVEPOINT " + name)
+
+	return err
+}
+
+func (this *XormSession) ReleaseSavepoint(name string) error {
+	_, err := this.Exec("RELEASE SAVEPOINT " + name)
+
+	return err
+}
+
 func (this *XormSession) Close() error {
 	err := this.Session.Close()
 	if err != nil {
@@ -413,26 +759,670 @@ func (this *XormSession) Scan(dest interface{}) (*XormSession, error) {
 	return this, err
 }
 
-func (this *XormSession) Complex(qb *repository.QueryBuilder, dest []interface{}) error {
-	// 构建查询对象
-	rows, err := this.Session.Select(qb.Select).
-		Distinct(qb.Distinct...).
-		Table(qb.From).
-		Join(qb.Join[0], qb.Join[1], qb.Join[2]).
-		Where(qb.Where, qb.Args...).
-		OrderBy(qb.OrderBy).
-		GroupBy(qb.GroupBy).
-		Limit(qb.Limit, qb.Offset).Rows(nil)
+/*
+*
+按照QueryBuilder构造查询，dest可以是*[]map[string]interface{}，结构数组的指针或者结构的指针
+map的值是按照列的类型转换后的值，结构的指针只取第一条记录
+*/
+func (this *XormSession) Complex(qb *repository.QueryBuilder, dest interface{}) error {
+	clause, args, err := qb.ToSql(func(bean interface{}) string {
+		return this.engine.TableName(bean, true)
+	})
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return err
+	}
+	switch d := dest.(type) {
+	case *[]map[string]interface{}:
+		var results []map[string]interface{}
+		results, err = this.Session.SQL(clause, args...).QueryInterface()
+		if err == nil {
+			*d = results
+		}
+	default:
+		kind := reflect.GetIndirectType(dest)
+		if kind == goreflect.Slice {
+			err = this.Session.SQL(clause, args...).Find(dest)
+		} else {
+			_, err = this.Session.SQL(clause, args...).Get(dest)
+		}
+	}
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
+
+	return err
+}
+
+/*
+*
+把条件翻译成xorm的builder条件，没有条件的时候返回nil
+Like直接使用传入的模式，不自动在两边加%
+时间和xorm处理sql参数一样转换成数据库时区的字符串
+*/
+func (this *XormSession) toCond(criteria *repository.Criteria) (builder.Cond, error) {
+	if !criteria.HasCondition() {
+		return nil, nil
+	}
+	values := make([]interface{}, len(criteria.Values))
+	for i, v := range criteria.Values {
+		values[i] = this.dbValue(v)
+	}
+	switch criteria.Op {
+	case repository.Op_Eq:
+		return builder.Eq{criteria.Field: values[0]}, nil
+	case repository.Op_In:
+		if len(values) == 0 {
+			return builder.Expr("1 = 0"), nil
+		}
+		return builder.In(criteria.Field, values...), nil
+	case repository.Op_Between:
+		return builder.Between{Col: criteria.Field, LessVal: values[0], MoreVal: values[1]}, nil
+	case repository.Op_Like:
+		return builder.Expr(criteria.Field+" LIKE ?", values[0]), nil
+	case repository.Op_Gt:
+		return builder.Gt{criteria.Field: values[0]}, nil
+	case repository.Op_Ge:
+		return builder.Gte{criteria.Field: values[0]}, nil
+	case repository.Op_Lt:
+		return builder.Lt{criteria.Field: values[0]}, nil
+	case repository.Op_Le:
+		return builder.Lte{criteria.Field: values[0]}, nil
+	case repository.Op_IsNull:
+		return builder.IsNull{criteria.Field}, nil
+	case repository.Op_And, repository.Op_Or:
+		conds := make([]builder.Cond, 0, len(criteria.Children))
+		for _, child := range criteria.Children {
+			cond, err := this.toCond(child)
+			if err != nil {
+				return nil, err
+			}
+			if cond != nil {
+				conds = append(conds, cond)
+			}
+		}
+		if len(conds) == 0 {
+			return nil, nil
+		}
+		if criteria.Op == repository.Op_And {
+			return builder.And(conds...), nil
+		}
+		return builder.Or(conds...), nil
+	}
+
+	return nil, errors.New("NotSupportOp")
+}
+
+func (this *XormSession) dbValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case time.Time:
+		return t.In(this.engine.DatabaseTZ).Format("2006-01-02 15:04:05")
+	case *time.Time:
+		if t != nil {
+			return t.In(this.engine.DatabaseTZ).Format("2006-01-02 15:04:05")
+		}
+	}
+
+	return v
+}
+
+// 在会话上加上条件和排序
+func (this *XormSession) criteriaSession(md interface{}, criteria *repository.Criteria) (*xorm.Session, error) {
+	var session = this.session(md)
+	err := criteria.Check()
 	if err != nil {
 		logger.Sugar.Errorf("%v", err.Error())
+		return nil, err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		err = rows.Scan(dest)
+	cond, err := this.toCond(criteria)
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return nil, err
+	}
+	if cond != nil {
+		session = session.Where(cond)
+	}
+	orderby := criteria.OrderBy()
+	if orderby != "" {
+		session = session.OrderBy(orderby)
+	}
+
+	return session, nil
+}
+
+func (this *XormSession) GetByCriteria(dest interface{}, locked bool, criteria *repository.Criteria) (bool, error) {
+	get := func(forUpdate bool) (bool, error) {
+		session, err := this.criteriaSession(dest, criteria)
 		if err != nil {
-			logger.Sugar.Errorf("%v", err.Error())
+			return false, err
+		}
+		if forUpdate {
+			session = session.ForUpdate()
 		}
+		return session.Get(dest)
+	}
+	var found bool
+	var err error
+	if locked == true {
+		found, err = this.lockedGet(dest, get)
+	} else {
+		found, err = get(false)
+	}
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
+
+	return found, err
+}
+
+/*
+*
+加锁读取一条记录，xorm的ForUpdate只支持mysql，其他数据库返回错误，
+postgres读到记录以后按照主键执行SELECT FOR UPDATE，然后恢复dest的条件重新读取，
+sqlite的写事务锁住整个数据库，不需要行锁
+*/
+func (this *XormSession) lockedGet(dest interface{}, get func(forUpdate bool) (bool, error)) (bool, error) {
+	switch this.engine.Dialect().URI().DBType {
+	case schemas.MYSQL:
+		return get(true)
+	case schemas.POSTGRES:
+	default:
+		return get(false)
+	}
+	// dest的非零字段是查询条件，重新读取之前恢复
+	v := goreflect.ValueOf(dest).Elem()
+	origin := goreflect.New(v.Type()).Elem()
+	origin.Set(v)
+	found, err := get(false)
+	if err != nil || !found {
+		return found, err
+	}
+	table, err := this.engine.TableInfo(dest)
+	if err != nil {
+		return false, err
+	}
+	pks := table.PKColumns()
+	if len(pks) == 0 {
+		return false, errors.New("NoPrimaryKey")
+	}
+	conds := make([]string, len(pks))
+	args := make([]interface{}, len(pks))
+	for i, pk := range pks {
+		value, err := pk.ValueOf(dest)
+		if err != nil {
+			return false, err
+		}
+		conds[i] = this.engine.Quote(pk.Name) + " = ?"
+		args[i] = value.Interface()
+	}
+	query := fmt.Sprintf("SELECT 1 FROM %v WHERE %v FOR UPDATE", this.engine.Quote(this.engine.TableName(dest, true)),
+		strings.Join(conds, " AND "))
+	_, err = this.Session.QueryString(append([]interface{}{query}, args...)...)
+	if err != nil {
+		return false, err
+	}
+	v.Set(origin)
+
+	return get(false)
+}
+
+func (this *XormSession) FindByCriteria(rowsSlicePtr interface{}, md interface{}, criteria *repository.Criteria, from int, limit int) error {
+	session, err := this.criteriaSession(rowsSlicePtr, criteria)
+	if err != nil {
+		return err
+	}
+	if limit != 0 || from != 0 {
+		session = session.Limit(limit, from)
+	}
+	if md == nil {
+		err = session.Find(rowsSlicePtr)
+	} else {
+		err = session.Find(rowsSlicePtr, md)
+	}
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
+
+	return err
+}
+
+func (this *XormSession) CountByCriteria(bean interface{}, criteria *repository.Criteria) (int64, error) {
+	session, err := this.criteriaSession(bean, criteria.Unordered())
+	if err != nil {
+		return 0, err
+	}
+	count, err := session.Count(bean)
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
+
+	return count, err
+}
+
+// md的非空字段和条件一起作为删除的条件，都没有的时候不删除
+func (this *XormSession) DeleteByCriteria(md interface{}, criteria *repository.Criteria) (int64, error) {
+	session, err := this.criteriaSession(md, criteria)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := session.Delete(md)
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
+
+	return affected, err
+}
+
+/*
+*
+逐条处理满足条件的记录，md的非空字段也是条件，batchSize大于0的时候每次查询batchSize条记录，
+否则使用游标逐条读取，没有排序的时候按照主键排序，保证分批查询的结果稳定
+ctx取消的时候停止处理，返回ctx的错误
+*/
+func (this *XormSession) Iterate(ctx context.Context, md interface{}, criteria *repository.Criteria, batchSize int, fn func(row interface{}) error) error {
+	session, err := this.criteriaSession(md, criteria)
+	if err != nil {
+		return err
+	}
+	if batchSize > 0 {
+		if criteria.OrderBy() == "" {
+			table, err := this.engine.TableInfo(md)
+			if err == nil && len(table.PrimaryKeys) > 0 {
+				session = session.Asc(table.PrimaryKeys...)
+			}
+		}
+		session = session.BufferSize(batchSize)
+	}
+	err = session.Iterate(md, func(idx int, bean interface{}) error {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		return fn(bean)
+	})
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
 	}
 
 	return err
 }
+
+// 一条语句的参数个数的上限，sqlite是32766，postgres是65535
+const maxUpsertParams = 32766
+
+// 字段的值不能直接作为sql参数，这一批实体改为逐条处理
+var errNotConvertible = errors.New("NotConvertible")
+
+/*
+*
+批量新增或者修改，返回新增和修改的记录数，postgres和sqlite使用INSERT ... ON CONFLICT DO UPDATE，其他数据库逐条处理
+conflictColumns必须是唯一索引或者主键，updateColumns为空的时候修改repository.UpsertColumns返回的字段
+会话的过滤条件加在DO UPDATE的WHERE上，被排除的已有记录不修改，也不计数
+postgres用RETURNING (xmax = 0)区分新增和修改，sqlite在执行之前在同一个事务中查询已有记录的数量
+实体的id只用于新增，已有记录的id不变
+*/
+func (this *XormSession) UpsertBatch(mds []interface{}, conflictColumns []string, updateColumns []string) (int64, int64, error) {
+	if len(mds) == 0 {
+		return 0, 0, nil
+	}
+	dbType := this.engine.Dialect().URI().DBType
+	if dbType != schemas.POSTGRES && dbType != schemas.SQLITE {
+		return repository.UpsertEach(this, mds, conflictColumns, updateColumns)
+	}
+	_, err := repository.ConflictKeys(mds, conflictColumns)
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return 0, 0, err
+	}
+	typ := goreflect.TypeOf(mds[0])
+	if typ.Kind() != goreflect.Ptr {
+		return 0, 0, errors.New("DestinationNeedPtr")
+	}
+	for _, md := range mds {
+		if goreflect.TypeOf(md) != typ {
+			return 0, 0, errors.New("UpsertNeedSameType")
+		}
+	}
+	table, err := this.engine.TableInfo(mds[0])
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return 0, 0, err
+	}
+	columns := insertColumns(table)
+	conflicts, err := upsertColumns(table, conflictColumns)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(updateColumns) == 0 {
+		updateColumns = repository.UpsertColumns(mds[0], conflictColumns)
+	}
+	updates, err := upsertColumns(table, updateColumns)
+	if err != nil {
+		return 0, 0, err
+	}
+	rows := make([][]interface{}, len(mds))
+	now := time.Now()
+	for i, md := range mds {
+		rows[i], err = this.columnValues(columns, md, now)
+		if errors.Is(err, errNotConvertible) {
+			return repository.UpsertEach(this, mds, conflictColumns, updateColumns)
+		}
+		if err != nil {
+			logger.Sugar.Errorf("%v", err.Error())
+			return 0, 0, err
+		}
+	}
+	clause, args, err := this.conflictClause(table, mds[0], conflicts, updates)
+	if err != nil {
+		return 0, 0, err
+	}
+	var inserted, updated int64
+	size := (maxUpsertParams - len(args)) / len(columns)
+	for start := 0; start < len(rows); start += size {
+		end := start + size
+		if end > len(rows) {
+			end = len(rows)
+		}
+		i, u, err := this.upsertRows(table, columns, conflicts, rows[start:end], clause, args)
+		inserted += i
+		updated += u
+		if err != nil {
+			logger.Sugar.Errorf("%v", err.Error())
+			return inserted, updated, err
+		}
+	}
+
+	return inserted, updated, nil
+}
+
+// 执行一条INSERT ... ON CONFLICT语句
+func (this *XormSession) upsertRows(table *schemas.Table, columns []*schemas.Column, conflicts []*schemas.Column, rows [][]interface{}, clause string, args []interface{}) (int64, int64, error) {
+	postgres := this.engine.Dialect().URI().DBType == schemas.POSTGRES
+	var existing int64
+	if !postgres {
+		n, err := this.countExisting(table, columns, conflicts, rows)
+		if err != nil {
+			return 0, 0, err
+		}
+		existing = n
+	}
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = this.engine.Quote(col.Name)
+	}
+	marks := "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+	values := make([]string, len(rows))
+	params := make([]interface{}, 0, len(rows)*len(columns)+len(args))
+	for i, row := range rows {
+		values[i] = marks
+		params = append(params, row...)
+	}
+	params = append(params, args...)
+	query := fmt.Sprintf("INSERT INTO %v (%v) VALUES %v%v", this.engine.Quote(this.engine.TableName(table.Name, true)),
+		strings.Join(names, ","), strings.Join(values, ","), clause)
+	if postgres {
+		results, err := this.Query(query+" RETURNING (xmax = 0) AS inserted", params...)
+		if err != nil {
+			return 0, 0, err
+		}
+		var inserted, updated int64
+		for _, result := range results {
+			b, _ := strconv.ParseBool(string(result["inserted"]))
+			if b {
+				inserted++
+			} else {
+				updated++
+			}
+		}
+		return inserted, updated, nil
+	}
+	result, err := this.Exec(query, params...)
+	if err != nil {
+		return 0, 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+	inserted := int64(len(rows)) - existing
+
+	return inserted, affected - inserted, nil
+}
+
+// 已经存在的冲突键的数量，包括会话的过滤条件排除的记录
+func (this *XormSession) countExisting(table *schemas.Table, columns []*schemas.Column, conflicts []*schemas.Column, rows [][]interface{}) (int64, error) {
+	names := make([]string, len(conflicts))
+	indexes := make([]int, len(conflicts))
+	for i, conflict := range conflicts {
+		names[i] = this.engine.Quote(conflict.Name)
+		for j, col := range columns {
+			if col == conflict {
+				indexes[i] = j
+			}
+		}
+	}
+	marks := "(" + strings.TrimSuffix(strings.Repeat("?,", len(conflicts)), ",") + ")"
+	values := make([]string, len(rows))
+	params := make([]interface{}, 0, len(rows)*len(conflicts))
+	for i, row := range rows {
+		values[i] = marks
+		for _, j := range indexes {
+			params = append(params, row[j])
+		}
+	}
+	query := fmt.Sprintf("SELECT count(*) AS n FROM %v WHERE (%v) IN (VALUES %v)", this.engine.Quote(this.engine.TableName(table.Name, true)),
+		strings.Join(names, ","), strings.Join(values, ","))
+	results, err := this.Query(query, params...)
+	if err != nil || len(results) == 0 {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(results[0]["n"]), 10, 64)
+}
+
+/*
+*
+ON CONFLICT子句和WHERE的参数，没有修改的列的时候DO NOTHING
+修改的时间总是修改，版本号加1，软删除的记录恢复，过滤条件的列加上表名，避免和excluded的列混淆
+*/
+func (this *XormSession) conflictClause(table *schemas.Table, md interface{}, conflicts []*schemas.Column, updates []*schemas.Column) (string, []interface{}, error) {
+	names := make([]string, len(conflicts))
+	for i, col := range conflicts {
+		names[i] = this.engine.Quote(col.Name)
+	}
+	clause := " ON CONFLICT (" + strings.Join(names, ",") + ")"
+	if len(updates) == 0 {
+		return clause + " DO NOTHING", nil, nil
+	}
+	sets := make([]string, 0, len(updates)+3)
+	for _, col := range updates {
+		if col.IsUpdated || col.IsVersion || col.IsCreated || col.IsDeleted {
+			continue
+		}
+		name := this.engine.Quote(col.Name)
+		sets = append(sets, name+" = excluded."+name)
+	}
+	updated := table.UpdatedColumn()
+	if updated != nil {
+		name := this.engine.Quote(updated.Name)
+		sets = append(sets, name+" = excluded."+name)
+	}
+	// 软删除的已有记录恢复
+	deleted := table.DeletedColumn()
+	if deleted != nil {
+		sets = append(sets, this.engine.Quote(deleted.Name)+" = NULL")
+	}
+	version := table.VersionColumn()
+	if version != nil {
+		name := this.engine.Quote(version.Name)
+		sets = append(sets, name+" = "+this.engine.Quote(table.Name)+"."+name+" + 1")
+	}
+	clause = clause + " DO UPDATE SET " + strings.Join(sets, ",")
+	criteria := repository.FilterCriteria(this.filters, md)
+	if criteria == nil {
+		return clause, nil, nil
+	}
+	err := criteria.Check()
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return "", nil, err
+	}
+	cond, err := this.toCond(qualify(criteria, table.Name))
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return "", nil, err
+	}
+	where, args, err := builder.ToSQL(cond)
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return "", nil, err
+	}
+
+	return clause + " WHERE " + where, args, nil
+}
+
+// 条件的列加上表名
+func qualify(criteria *repository.Criteria, table string) *repository.Criteria {
+	c := *criteria
+	if criteria.Field != "" && !strings.Contains(criteria.Field, ".") {
+		c.Field = table + "." + criteria.Field
+	}
+	c.Children = make([]*repository.Criteria, len(criteria.Children))
+	for i, child := range criteria.Children {
+		c.Children[i] = qualify(child, table)
+	}
+
+	return &c
+}
+
+// 新增的时候写入的列，不包括自增的列和只读的列
+func insertColumns(table *schemas.Table) []*schemas.Column {
+	columns := make([]*schemas.Column, 0)
+	for _, col := range table.Columns() {
+		if col.MapType != schemas.ONLYFROMDB && !col.IsAutoIncrement {
+			columns = append(columns, col)
+		}
+	}
+
+	return columns
+}
+
+// 按照列名或者字段名查找表的列
+func upsertColumns(table *schemas.Table, names []string) ([]*schemas.Column, error) {
+	columns := make([]*schemas.Column, 0, len(names))
+	for _, name := range names {
+		col := table.GetColumn(name)
+		if col == nil {
+			key := columnKey(name)
+			for _, c := range table.Columns() {
+				if columnKey(c.Name) == key || columnKey(c.FieldName) == key {
+					col = c
+					break
+				}
+			}
+		}
+		if col == nil {
+			err := fmt.Errorf("InvalidColumn: %v", name)
+			logger.Sugar.Errorf("%v", err.Error())
+			return nil, err
+		}
+		columns = append(columns, col)
+	}
+
+	return columns, nil
+}
+
+// 忽略大小写，下划线和嵌入的结构的名称
+func columnKey(name string) string {
+	i := strings.LastIndex(name, ".")
+	if i >= 0 {
+		name = name[i+1:]
+	}
+
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+/*
+*
+实体的列的值，和xorm新增的时候一样填写创建时间，修改时间和版本号
+不能转换成sql参数的字段返回errNotConvertible
+*/
+func (this *XormSession) columnValues(columns []*schemas.Column, md interface{}, now time.Time) ([]interface{}, error) {
+	value := goreflect.ValueOf(md).Elem()
+	values := make([]interface{}, len(columns))
+	for i, col := range columns {
+		f, err := value.FieldByIndexErr(col.FieldIndex)
+		if err != nil {
+			// 嵌入的结构指针为nil
+			continue
+		}
+		if col.IsCreated || col.IsUpdated {
+			stampNow(f, now, col.IsUpdated)
+		}
+		if col.IsVersion && f.CanInt() && f.Int() == 0 {
+			f.SetInt(1)
+		}
+		values[i], err = this.columnValue(col, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
+
+// 创建时间为空的时候填写，修改时间总是填写
+func stampNow(f goreflect.Value, now time.Time, always bool) {
+	switch t := f.Interface().(type) {
+	case time.Time:
+		if always || t.IsZero() {
+			f.Set(goreflect.ValueOf(now))
+		}
+	case *time.Time:
+		if always || t == nil || t.IsZero() {
+			f.Set(goreflect.ValueOf(&now))
+		}
+	case int64:
+		if always || t == 0 {
+			f.SetInt(now.Unix())
+		}
+	}
+}
+
+func (this *XormSession) columnValue(col *schemas.Column, f goreflect.Value) (interface{}, error) {
+	if (f.Kind() == goreflect.Ptr || f.Kind() == goreflect.Interface || f.Kind() == goreflect.Map || f.Kind() == goreflect.Slice) && f.IsNil() {
+		return nil, nil
+	}
+	if col.IsJSON {
+		bs, err := json.Marshal(f.Interface())
+		if err != nil {
+			return nil, err
+		}
+		return string(bs), nil
+	}
+	v := f.Interface()
+	if f.CanAddr() {
+		v = f.Addr().Interface()
+	}
+	if c, ok := v.(convert.Conversion); ok {
+		return c.ToDB()
+	}
+	if c, ok := f.Interface().(driver.Valuer); ok {
+		return c.Value()
+	}
+	switch t := f.Interface().(type) {
+	case time.Time, *time.Time:
+		return this.dbValue(t), nil
+	case []byte:
+		return t, nil
+	}
+	f = goreflect.Indirect(f)
+	switch f.Kind() {
+	case goreflect.Bool, goreflect.String, goreflect.Float32, goreflect.Float64,
+		goreflect.Int, goreflect.Int8, goreflect.Int16, goreflect.Int32, goreflect.Int64,
+		goreflect.Uint, goreflect.Uint8, goreflect.Uint16, goreflect.Uint32, goreflect.Uint64:
+		return f.Interface(), nil
+	}
+
+	return nil, errNotConvertible
+}
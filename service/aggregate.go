@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"errors"
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/repository"
+	"github.com/curltech/go-colla-core/util/reflect"
+	goreflect "reflect"
+	"strconv"
+)
+
+/*
+*
+保存聚合，root是聚合根的指针，聚合根中实体指针的数组字段是子实体，子实体也可以有自己的子实体
+子实体的ParentId填写父实体的id，TopId填写聚合根的id，有Kind字段的时候填写数组字段的名称，用来区分同一个类型的多个数组字段
+状态为New或者还没有id的实体插入，状态为Deleted的实体和它在数据库中的子实体删除，其他的实体修改
+数据库中有但是已经不在数组中的子实体和它们的子实体删除，所有的操作在一个事务中
+读取数据库中已有的子实体也在这个事务中，不读副本，避免按照过时的数据删除
+*/
+func (this *OrmBaseService) SaveAggregate(roots ...interface{}) (int64, error) {
+	for _, root := range roots {
+		if !reflect.IsPtr(root) {
+			return 0, errors.New("DestinationNeedPtr")
+		}
+	}
+	var affected int64
+	err := this.RunInTransaction(this.ctx, func(ctx context.Context) error {
+		s := *this
+		s.ctx = ctx
+		saves := make([]*baseentity.EntityDiff, 0)
+		deletes := make([]*baseentity.EntityDiff, 0)
+		for _, root := range roots {
+			err := s.planAggregate(root, root, &saves, &deletes)
+			if err != nil {
+				logger.Sugar.Errorf("%v", err.Error())
+				return err
+			}
+		}
+		// 删除的时候子实体在父实体之前
+		for i := len(deletes) - 1; i >= 0; i-- {
+			saves = append(saves, deletes[i])
+		}
+		var err error
+		affected, err = s.saveDiffs(saves)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return affected, nil
+}
+
+/*
+*
+按照id读取聚合根，然后读取子实体，填写到聚合根的数组字段中
+depth是读取子实体的层数，0只读取聚合根，小于0的时候读取所有的层
+*/
+func (this *OrmBaseService) LoadAggregate(root interface{}, depth int) (bool, error) {
+	if !reflect.IsPtr(root) {
+		return false, errors.New("DestinationNeedPtr")
+	}
+	found, err := this.Get(root, false, "", "")
+	if err != nil || !found {
+		return found, err
+	}
+	err = this.loadChildren([]interface{}{root}, depth)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (this *OrmBaseService) loadChildren(parents []interface{}, depth int) error {
+	if depth == 0 || len(parents) == 0 {
+		return nil
+	}
+	ids := make([]interface{}, 0, len(parents))
+	for _, parent := range parents {
+		id, ok := repository.GetId(parent)
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	for _, field := range childFields(goreflect.TypeOf(parents[0])) {
+		children, err := this.findChildren(field, ids...)
+		if err != nil {
+			return err
+		}
+		groups := make(map[uint64]goreflect.Value)
+		all := make([]interface{}, 0, children.Len())
+		for i := 0; i < children.Len(); i++ {
+			child := children.Index(i)
+			parentId := refValue(child.Interface(), baseentity.FieldName_ParentId)
+			group, ok := groups[parentId]
+			if !ok {
+				group = goreflect.MakeSlice(field.Type, 0, 0)
+			}
+			groups[parentId] = goreflect.Append(group, child)
+			all = append(all, child.Interface())
+		}
+		for _, parent := range parents {
+			id, _ := repository.GetId(parent)
+			group, ok := groups[toUint64(id)]
+			if !ok {
+				group = goreflect.MakeSlice(field.Type, 0, 0)
+			}
+			goreflect.ValueOf(parent).Elem().FieldByIndex(field.Index).Set(group)
+		}
+		err = this.loadChildren(all, depth-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 计划保存一个实体和它的子实体，新增和修改的父实体在子实体之前
+func (this *OrmBaseService) planAggregate(md interface{}, top interface{}, saves *[]*baseentity.EntityDiff, deletes *[]*baseentity.EntityDiff) error {
+	state, _ := reflect.GetValue(md, baseentity.FieldName_State)
+	_, persisted := repository.GetId(md)
+	if state == baseentity.EntityState_Deleted {
+		if persisted {
+			return this.planDelete(md, deletes)
+		}
+		return nil
+	}
+	if state == baseentity.EntityState_New || !persisted {
+		// 先分配id，子实体需要填写父实体的id
+		this.setId(md)
+		*saves = append(*saves, baseentity.NewEntityDiff(md, baseentity.EntityState_New, nil))
+	} else {
+		*saves = append(*saves, baseentity.NewEntityDiff(md, baseentity.EntityState_Modified, nil))
+	}
+	id, _ := repository.GetId(md)
+	topId, _ := repository.GetId(top)
+	for _, field := range childFields(goreflect.TypeOf(md)) {
+		slice := goreflect.ValueOf(md).Elem().FieldByIndex(field.Index)
+		keeps := make(map[uint64]bool)
+		for i := 0; i < slice.Len(); i++ {
+			child := slice.Index(i).Interface()
+			if slice.Index(i).IsNil() {
+				continue
+			}
+			setRef(child, baseentity.FieldName_ParentId, toUint64(id))
+			setRef(child, baseentity.FieldName_TopId, toUint64(topId))
+			setKind(child, field.Name)
+			childId, ok := repository.GetId(child)
+			if ok {
+				keeps[toUint64(childId)] = true
+			}
+			err := this.planAggregate(child, top, saves, deletes)
+			if err != nil {
+				return err
+			}
+		}
+		if !persisted {
+			continue
+		}
+		// 数据库中已经不在数组中的子实体
+		existing, err := this.findChildren(field, id)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < existing.Len(); i++ {
+			child := existing.Index(i).Interface()
+			childId, _ := repository.GetId(child)
+			if !keeps[toUint64(childId)] {
+				err = this.planDelete(child, deletes)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// 计划删除一个实体和它在数据库中的所有子实体
+func (this *OrmBaseService) planDelete(md interface{}, deletes *[]*baseentity.EntityDiff) error {
+	*deletes = append(*deletes, baseentity.NewEntityDiff(md, baseentity.EntityState_Deleted, nil))
+	id, ok := repository.GetId(md)
+	if !ok {
+		return nil
+	}
+	for _, field := range childFields(goreflect.TypeOf(md)) {
+		children, err := this.findChildren(field, id)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < children.Len(); i++ {
+			err = this.planDelete(children.Index(i).Interface(), deletes)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// 读取父实体的id在ids中的子实体，返回子实体数组字段类型的数组
+func (this *OrmBaseService) findChildren(field goreflect.StructField, ids ...interface{}) (goreflect.Value, error) {
+	rows := goreflect.New(field.Type)
+	rows.Elem().Set(goreflect.MakeSlice(field.Type, 0, 0))
+	criteria := repository.In(baseentity.FieldName_ParentId, ids...)
+	_, ok := field.Type.Elem().Elem().FieldByName(baseentity.FieldName_Kind)
+	if ok {
+		criteria = repository.And(criteria, repository.Eq(baseentity.FieldName_Kind, field.Name))
+	}
+	err := this.FindByCriteria(rows.Interface(), nil, criteria.Sort(baseentity.FieldName_Id, false), 0, 0)
+	if err != nil {
+		return goreflect.Value{}, err
+	}
+
+	return rows.Elem(), nil
+}
+
+// 聚合的子实体字段，也就是实体指针的数组，而且实体有ParentId字段
+func childFields(typ goreflect.Type) []goreflect.StructField {
+	for typ.Kind() == goreflect.Ptr {
+		typ = typ.Elem()
+	}
+	fields := make([]goreflect.StructField, 0)
+	if typ.Kind() != goreflect.Struct {
+		return fields
+	}
+	for _, field := range goreflect.VisibleFields(typ) {
+		if !field.IsExported() || field.Type.Kind() != goreflect.Slice || !baseentity.IsChild(field) {
+			continue
+		}
+		_, ok := field.Type.Elem().Elem().FieldByName(baseentity.FieldName_ParentId)
+		if ok {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// 填写ParentId或者TopId，字段可以是整数或者字符串，没有字段的时候忽略
+func setRef(md interface{}, name string, id uint64) {
+	field := goreflect.ValueOf(md).Elem().FieldByName(name)
+	if !field.IsValid() || !field.CanSet() {
+		return
+	}
+	switch field.Kind() {
+	case goreflect.Uint, goreflect.Uint8, goreflect.Uint16, goreflect.Uint32, goreflect.Uint64:
+		field.SetUint(id)
+	case goreflect.Int, goreflect.Int8, goreflect.Int16, goreflect.Int32, goreflect.Int64:
+		field.SetInt(int64(id))
+	case goreflect.String:
+		field.SetString(strconv.FormatUint(id, 10))
+	}
+}
+
+func setKind(md interface{}, kind string) {
+	field := goreflect.ValueOf(md).Elem().FieldByName(baseentity.FieldName_Kind)
+	if field.IsValid() && field.CanSet() && field.Kind() == goreflect.String {
+		field.SetString(kind)
+	}
+}
+
+func refValue(md interface{}, name string) uint64 {
+	v, err := reflect.GetValue(md, name)
+	if err != nil {
+		return 0
+	}
+
+	return toUint64(v)
+}
+
+func toUint64(v interface{}) uint64 {
+	value := goreflect.ValueOf(v)
+	switch value.Kind() {
+	case goreflect.Uint, goreflect.Uint8, goreflect.Uint16, goreflect.Uint32, goreflect.Uint64:
+		return value.Uint()
+	case goreflect.Int, goreflect.Int8, goreflect.Int16, goreflect.Int32, goreflect.Int64:
+		return uint64(value.Int())
+	case goreflect.String:
+		i, _ := strconv.ParseUint(value.String(), 10, 64)
+		return i
+	}
+
+	return 0
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+type aggPart struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	ParentId              uint64
+	TopId                 uint64
+	Name                  string `xorm:"varchar(32)"`
+}
+
+func (aggPart) TableName() string {
+	return "test_agg_part"
+}
+
+type aggItem struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	ParentId              uint64
+	TopId                 uint64
+	Name                  string     `xorm:"varchar(32)"`
+	Parts                 []*aggPart `xorm:"-" gorm:"-" json:"-"`
+}
+
+func (aggItem) TableName() string {
+	return "test_agg_item"
+}
+
+type aggRoot struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	Name                  string     `xorm:"varchar(32)"`
+	Items                 []*aggItem `xorm:"-" gorm:"-" json:"-"`
+}
+
+func (aggRoot) TableName() string {
+	return "test_agg_root"
+}
+
+// 聚合的名称，子实体的名称在括号中
+func aggNames(root *aggRoot) string {
+	s := root.Name
+	for _, item := range root.Items {
+		s += fmt.Sprintf(" %v%v", item.Name, partNames(item))
+	}
+
+	return s
+}
+
+func partNames(item *aggItem) []string {
+	names := make([]string, 0)
+	for _, part := range item.Parts {
+		names = append(names, part.Name)
+	}
+
+	return names
+}
+
+func TestSaveAggregate(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(aggRoot))
+		newTestService(t, dbName, new(aggItem))
+		newTestService(t, dbName, new(aggPart))
+		root := &aggRoot{Name: "r", Items: []*aggItem{
+			{Name: "a", Parts: []*aggPart{{Name: "a1"}, {Name: "a2"}}},
+			{Name: "b", Parts: []*aggPart{{Name: "b1"}}},
+		}}
+		affected, err := svc.SaveAggregate(root)
+		if err != nil || affected != 6 {
+			t.Fatalf("save: %v %v", affected, err)
+		}
+		if root.Items[0].ParentId != root.Id || root.Items[0].Parts[0].ParentId != root.Items[0].Id || root.Items[0].Parts[0].TopId != root.Id {
+			t.Fatalf("refs: %+v %+v", root.Items[0], root.Items[0].Parts[0])
+		}
+		load := func(depth int) *aggRoot {
+			got := &aggRoot{}
+			got.Id = root.Id
+			found, err := svc.LoadAggregate(got, depth)
+			if err != nil || !found {
+				t.Fatalf("load %v: %v %v", depth, found, err)
+			}
+			return got
+		}
+		if got := aggNames(load(0)); got != "r" {
+			t.Fatalf("depth 0: %v", got)
+		}
+		if got := aggNames(load(1)); got != "r a[] b[]" {
+			t.Fatalf("depth 1: %v", got)
+		}
+		loaded := load(-1)
+		if got := aggNames(loaded); got != "r a[a1 a2] b[b1]" {
+			t.Fatalf("depth -1: %v", got)
+		}
+		// 去掉b和它的子实体，增加c，删除a的子实体a1，修改a2
+		a := loaded.Items[0]
+		a.Parts = a.Parts[1:]
+		a.Parts[0].Name = "a2x"
+		loaded.Items = []*aggItem{a, {Name: "c"}}
+		_, err = svc.SaveAggregate(loaded)
+		if err != nil {
+			t.Fatalf("save changes: %v", err)
+		}
+		if got := aggNames(load(-1)); got != "r a[a2x] c[]" {
+			t.Fatalf("after changes: %v", got)
+		}
+		parts := make([]*aggPart, 0)
+		err = svc.FindByCriteria(&parts, nil, repository.Sort("id", false), 0, 0)
+		if err != nil || len(parts) != 1 {
+			t.Fatalf("orphan parts: %v %v", idsOf(parts), err)
+		}
+		// 删除聚合根的时候删除所有的子实体
+		loaded.State = baseentity.EntityState_Deleted
+		_, err = svc.SaveAggregate(loaded)
+		if err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		found, err := svc.LoadAggregate(&aggRoot{BaseEntity: baseentity.BaseEntity{Id: root.Id}}, -1)
+		if err != nil || found {
+			t.Fatalf("deleted root: %v %v", found, err)
+		}
+		items := make([]*aggItem, 0)
+		err = svc.FindByCriteria(&items, nil, nil, 0, 0)
+		if err != nil || len(items) != 0 {
+			t.Fatalf("deleted items: %v %v", idsOf(items), err)
+		}
+	})
+}
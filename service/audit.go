@@ -0,0 +1,365 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/curltech/go-colla-core/container"
+	"github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/repository"
+	"github.com/curltech/go-colla-core/util/message"
+	"github.com/curltech/go-colla-core/util/reflect"
+	goreflect "reflect"
+	"strings"
+	"sync"
+)
+
+/*
+*
+审计记录的服务，服务的Audit为true的时候，Insert，Update，Upsert，Delete，Save，DeleteByCriteria，Restore和Purge在同一个事务中写审计记录
+按照条件修改或者删除的时候在事务中查询受影响的记录，每条记录写一条审计记录
+审计记录写在服务使用的数据库的bas_audit表中
+*/
+type AuditService struct {
+	OrmBaseService
+}
+
+var auditService = &AuditService{}
+
+func GetAuditService() *AuditService {
+	return auditService
+}
+
+func (this *AuditService) GetSeqName() string {
+	return seqname
+}
+
+func (this *AuditService) NewEntity(data []byte) (interface{}, error) {
+	entity := &entity.Audit{}
+	if data == nil {
+		return entity, nil
+	}
+	err := message.Unmarshal(data, entity)
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, err
+}
+
+func (this *AuditService) NewEntities(data []byte) (interface{}, error) {
+	entities := make([]*entity.Audit, 0)
+	if data == nil {
+		return &entities, nil
+	}
+	err := message.Unmarshal(data, &entities)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entities, err
+}
+
+/*
+*
+实体的变化历史，按照发生的先后排序，md是实体的指针，只需要有id
+*/
+func (this *OrmBaseService) History(md interface{}) ([]*entity.Audit, error) {
+	id, ok := repository.GetId(md)
+	if !ok {
+		return nil, errors.New("NoId")
+	}
+	audits := make([]*entity.Audit, 0)
+	criteria := repository.And(repository.Eq("EntityType", entityType(md)), repository.Eq("EntityKey", fmt.Sprint(id))).
+		Sort("id", false)
+	err := this.FindByCriteria(&audits, nil, criteria, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return audits, nil
+}
+
+// 已经创建审计表的命名数据库
+var auditTables sync.Map
+
+var auditSeq sync.Once
+
+func syncAuditTable(dbName string) {
+	_, ok := auditTables.Load(dbName)
+	if ok {
+		return
+	}
+	err := GetDbSession(dbName).Sync(new(entity.Audit))
+	if err == nil {
+		auditTables.Store(dbName, true)
+	}
+}
+
+// 一次操作的审计，服务没有打开审计的时候是nil，方法都可以在nil上调用
+type auditor struct {
+	service *OrmBaseService
+	ids     []uint64
+	next    int
+}
+
+// 在事务之外为审计记录分配id，避免在事务中嵌套序列的事务
+func (this *OrmBaseService) newAuditor(mds ...interface{}) *auditor {
+	if !this.Audit {
+		return nil
+	}
+	n := len(entities(mds...))
+	if n == 0 {
+		return nil
+	}
+	syncAuditTable(this.dbName())
+	auditSeq.Do(func() {
+		RegistSeq(seqname, 0)
+	})
+
+	return &auditor{service: this, ids: GetAuditService().WithContext(this.ctx).GetSeqs(n)}
+}
+
+// 修改和删除之前读取实体原来的值，和md的元素一一对应，没有找到的是nil
+func (this *auditor) before(session repository.DbSession, md interface{}) []interface{} {
+	if this == nil {
+		return nil
+	}
+	ms := entities(md)
+	olds := make([]interface{}, len(ms))
+	for i, m := range ms {
+		olds[i] = load(session, m)
+	}
+
+	return olds
+}
+
+/*
+*
+修改和删除之前读取受影响的记录，返回审计的实体和原来的值，调用record(session, operation, olds, targets)
+有id的实体按照id读取，和before相同，没有id的单个实体按照条件修改或者删除，用find查询条件匹配的记录，
+否则这些记录没有id，不能写审计
+*/
+func (this *auditor) affected(session repository.DbSession, md interface{}, find func(rowsSlicePtr interface{}) error) (interface{}, []interface{}, error) {
+	if this == nil {
+		return md, nil, nil
+	}
+	_, ok := repository.GetId(md)
+	if ok || reflect.ToArray(md) != nil {
+		return md, this.before(session, md), nil
+	}
+	olds, err := this.find(session, md, find)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return olds, olds, nil
+}
+
+// 在事务中查询条件匹配的记录，并且为这些记录的审计分配id
+func (this *auditor) find(session repository.DbSession, md interface{}, find func(rowsSlicePtr interface{}) error) ([]interface{}, error) {
+	if this == nil {
+		return nil, nil
+	}
+	rows := goreflect.New(goreflect.SliceOf(goreflect.TypeOf(md)))
+	err := find(rows.Interface())
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return nil, err
+	}
+	olds := reflect.ToArray(rows.Interface())
+	this.reserve(session, len(olds))
+
+	return olds, nil
+}
+
+/*
+*
+审计记录的id不够的时候在事务中分配，按照条件修改的记录数事先不知道
+序列在缺省数据库，服务使用缺省数据库的时候在这个事务中取序列，避免单写的数据库死锁
+*/
+func (this *auditor) reserve(session repository.DbSession, n int) {
+	if this == nil {
+		return
+	}
+	need := this.next + n - len(this.ids)
+	if need <= 0 {
+		return
+	}
+	ctx := this.service.ctx
+	if this.service.dbName() == "" && getTxState(ctx, "") == nil {
+		ctx = context.WithValue(this.service.Context(), txKey{dbName: ""}, &txState{session: session})
+	}
+	this.ids = append(this.ids, GetAuditService().WithContext(ctx).GetSeqs(need)...)
+}
+
+/*
+*
+写审计记录，olds是before读取的原来的值，新增的时候是nil
+修改的时候重新读取实体，比较修改前后的值，没有变化的字段不记录，没有任何变化的时候不写审计记录
+*/
+func (this *auditor) record(session repository.DbSession, operation string, olds []interface{}, md interface{}) error {
+	if this == nil {
+		return nil
+	}
+	var userId string
+	principal := GetPrincipal(this.service.ctx)
+	if principal != nil {
+		userId = principal.UserId
+	}
+	for i, m := range entities(md) {
+		id, ok := repository.GetId(m)
+		if !ok {
+			continue
+		}
+		var before, after *entity.EntitySnapshot
+		if olds != nil && olds[i] != nil {
+			before = entity.NewSnapshot(olds[i])
+		}
+		switch operation {
+		case entity.AuditOperation_Insert:
+			after = entity.NewSnapshot(m)
+		case entity.AuditOperation_Update:
+			current := load(session, m)
+			if current != nil {
+				after = entity.NewSnapshot(current)
+			}
+		}
+		diffs := entity.DiffSnapshot(before, after)
+		for name := range auditIgnored(m) {
+			delete(diffs, name)
+		}
+		if len(diffs) == 0 && operation == entity.AuditOperation_Update {
+			continue
+		}
+		bs, err := json.Marshal(diffs)
+		if err != nil {
+			return err
+		}
+		audit := &entity.Audit{
+			EntityType: entityType(m),
+			EntityKey:  fmt.Sprint(id),
+			Operation:  operation,
+			UserId:     userId,
+			Diff:       string(bs),
+		}
+		if this.next < len(this.ids) {
+			audit.Id = this.ids[this.next]
+			this.next++
+		}
+		_, err = session.Insert(audit)
+		if err != nil {
+			logger.Sugar.Errorf("%v", err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 展开实体数组，返回实体的列表
+func entities(mds ...interface{}) []interface{} {
+	es := make([]interface{}, 0, len(mds))
+	for _, md := range mds {
+		ms := reflect.ToArray(md)
+		if ms == nil {
+			es = append(es, md)
+		} else {
+			es = append(es, ms...)
+		}
+	}
+
+	return es
+}
+
+// 按照id读取实体现在的值，没有id或者没有找到的时候返回nil
+func load(session repository.DbSession, md interface{}) interface{} {
+	return loadLocked(session, md, false)
+}
+
+// 按照id读取实体现在的值，locked为true的时候加锁读取，在事务提交之前其他事务不能修改
+func loadLocked(session repository.DbSession, md interface{}, locked bool) interface{} {
+	id, ok := repository.GetId(md)
+	if !ok {
+		return nil
+	}
+	current := reflect.New(md)
+	err := reflect.SetValue(current, idName(md), id)
+	if err != nil {
+		return nil
+	}
+	found, err := session.Get(current, locked, "", "")
+	if err != nil || !found {
+		return nil
+	}
+
+	return current
+}
+
+// 实体的主键字段，实体有IdName方法的时候使用IdName
+func idName(md interface{}) string {
+	n, ok := md.(interface{ IdName() string })
+	if ok {
+		return n.IdName()
+	}
+
+	return entity.FieldName_Id
+}
+
+// 实体的类型，有TableName方法的时候使用表名，否则使用结构的名称
+func entityType(md interface{}) string {
+	t, ok := md.(interface{ TableName() string })
+	if ok {
+		return t.TableName()
+	}
+	typ := goreflect.TypeOf(md)
+	for typ.Kind() == goreflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	return typ.Name()
+}
+
+// 不记录变化的字段，也就是不保存的字段和自动填写的创建时间和修改时间
+func auditIgnored(md interface{}) map[string]bool {
+	ignored := make(map[string]bool)
+	typ := goreflect.TypeOf(md)
+	for typ.Kind() == goreflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Kind() == goreflect.Struct {
+		collectIgnored(typ, ignored)
+	}
+
+	return ignored
+}
+
+func collectIgnored(typ goreflect.Type, ignored map[string]bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous && field.Type.Kind() == goreflect.Struct {
+			collectIgnored(field.Type, ignored)
+			continue
+		}
+		// 加密的字段不记录明文
+		if isEncrypted(field) {
+			ignored[field.Name] = true
+			continue
+		}
+		for _, t := range strings.Fields(field.Tag.Get("xorm")) {
+			if t == "-" || t == "created" || t == "updated" {
+				ignored[field.Name] = true
+			}
+		}
+	}
+}
+
+func init() {
+	syncAuditTable("")
+	auditService.OrmBaseService.GetSeqName = auditService.GetSeqName
+	auditService.OrmBaseService.FactNewEntity = auditService.NewEntity
+	auditService.OrmBaseService.FactNewEntities = auditService.NewEntities
+	container.RegistService("audit", auditService)
+}
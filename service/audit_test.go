@@ -0,0 +1,98 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+type auditRow struct {
+	baseentity.DeletedEntity `xorm:"extends"`
+	Name                     string `xorm:"varchar(32)"`
+}
+
+func (auditRow) TableName() string {
+	return "test_audit"
+}
+
+// 实体的审计操作，按照发生的先后
+func operations(t *testing.T, svc *OrmBaseService, id uint64) string {
+	t.Helper()
+	md := &auditRow{}
+	md.Id = id
+	audits, err := svc.History(md)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	ops := make([]string, len(audits))
+	for i, audit := range audits {
+		ops[i] = audit.Operation
+	}
+
+	return fmt.Sprint(ops)
+}
+
+func TestAuditConditionalWrites(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(auditRow))
+		svc.Audit = true
+		svc.FactNewEntity = func(data []byte) (interface{}, error) { return new(auditRow), nil }
+		for i := 1; i <= 4; i++ {
+			row := &auditRow{Name: "row"}
+			row.Id = uint64(i)
+			_, err := svc.Insert(row)
+			if err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+		}
+		// bolt不支持字符串的条件
+		if dbName != "bolt" {
+			affected, err := svc.Update(&auditRow{Name: "x"}, []string{"Name"}, "id >= ?", 3)
+			if err != nil || affected != 2 {
+				t.Fatalf("update by conds: %v %v", affected, err)
+			}
+			if ops := operations(t, svc, 3); ops != "[Insert Update]" {
+				t.Fatalf("update audit: %v", ops)
+			}
+			if ops := operations(t, svc, 2); ops != "[Insert]" {
+				t.Fatalf("not updated: %v", ops)
+			}
+		}
+		affected, err := svc.DeleteByCriteria(new(auditRow), repository.Ge("id", 4))
+		if err != nil || affected != 1 {
+			t.Fatalf("delete by criteria: %v %v", affected, err)
+		}
+		if ops := operations(t, svc, 4); ops != "[Insert Delete]" && ops != "[Insert Update Delete]" {
+			t.Fatalf("delete audit: %v", ops)
+		}
+		row := &auditRow{}
+		row.Id = 1
+		_, err = svc.Delete(row, "")
+		if err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		_, err = svc.Restore(row)
+		if err != nil {
+			t.Fatalf("restore: %v", err)
+		}
+		if ops := operations(t, svc, 1); ops != "[Insert Delete Update]" {
+			t.Fatalf("restore audit: %v", ops)
+		}
+		row = &auditRow{}
+		row.Id = 1
+		_, err = svc.Delete(row, "")
+		if err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		affected, err = svc.Purge(-time.Minute)
+		if err != nil || affected < 1 {
+			t.Fatalf("purge: %v %v", affected, err)
+		}
+		if ops := operations(t, svc, 1); ops != "[Insert Delete Update Delete Delete]" {
+			t.Fatalf("purge audit: %v", ops)
+		}
+	})
+}
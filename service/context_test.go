@@ -0,0 +1,30 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestExportUsesContext(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(pageRow))
+		svc.FactNewEntity = func(data []byte) (interface{}, error) { return new(pageRow), nil }
+		row := &pageRow{Rank: 1}
+		row.Id = 1
+		_, err := svc.Insert(row)
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		bs, err := svc.Export(new(pageRow))
+		if err != nil || len(bs) == 0 {
+			t.Fatalf("export: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = svc.WithContext(ctx).(*OrmBaseService).Export(new(pageRow))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("canceled export: %v", err)
+		}
+	})
+}
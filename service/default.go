@@ -1,15 +1,21 @@
 package service
 
 import (
+	"context"
 	"database/sql"
 	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/entity"
 	"github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-core/repository"
 	"github.com/curltech/go-colla-core/util/collection"
 	"strconv"
+	"time"
 )
 
 type BaseService interface {
+	WithContext(ctx context.Context) BaseService
+	WithPrincipal(principal *Principal) BaseService
+	WithTenant(tenant *Tenant) BaseService
 	GetSeq() uint64
 	GetSeqs(count int) []uint64
 	NewEntity(data []byte) (interface{}, error)
@@ -22,12 +28,28 @@ type BaseService interface {
 	BatchInsert(mds ...interface{}) (int64, error)
 	Update(md interface{}, columns []string, conds string, params ...interface{}) (int64, error)
 	Upsert(mds ...interface{}) (int64, error)
+	UpsertBatch(mds []interface{}, conflictColumns []string, updateColumns []string) (int64, int64, error)
 	Delete(md interface{}, conds string, params ...interface{}) (int64, error)
 	Save(mds ...interface{}) (int64, error)
+	SaveContext(ec *entity.EntityContext) (int64, error)
+	SaveAggregate(roots ...interface{}) (int64, error)
+	LoadAggregate(root interface{}, depth int) (bool, error)
+	TransitionStatus(md interface{}, to string, reason string) error
+	Rekey(md interface{}) (int64, error)
 	Exec(clause string, params ...interface{}) (sql.Result, error)
 	Query(clause string, params ...interface{}) ([]map[string][]byte, error)
 	Count(bean interface{}, conds string, params ...interface{}) (int64, error)
+	GetByCriteria(dest interface{}, locked bool, criteria *repository.Criteria) (bool, error)
+	FindByCriteria(rowsSlicePtr interface{}, md interface{}, criteria *repository.Criteria, from int, limit int) error
+	CountByCriteria(bean interface{}, criteria *repository.Criteria) (int64, error)
+	DeleteByCriteria(md interface{}, criteria *repository.Criteria) (int64, error)
+	FindWithDeleted(rowsSlicePtr interface{}, md interface{}, orderby string, from int, limit int, conds string, params ...interface{}) error
+	Restore(mds ...interface{}) (int64, error)
+	Purge(olderThan time.Duration) (int64, error)
+	FindPage(condiBean interface{}, criteria *repository.Criteria, cursor string, pageSize int) (repository.Page, error)
+	FindIter(ctx context.Context, condiBean interface{}, criteria *repository.Criteria, fn func(row interface{}) error) error
 	Transaction(fc func(s repository.DbSession) (interface{}, error)) (interface{}, error)
+	RunInTransaction(ctx context.Context, fn func(ctx context.Context) error) error
 }
 
 type SeqCache struct {
@@ -103,6 +125,52 @@ func GetSeq(name string, count int) []uint64 {
 	return ids
 }
 
+/*
+*
+表序列在缺省数据库，bolt和sqlite同一时刻只允许一个写事务，ctx中有缺省数据库的事务的时候，
+再开始序列的事务会死锁，所以直接在已有的事务中修改序列，ok为false表示不需要这样处理
+多余的id不放入缓存，因为事务回滚的时候序列也会回滚，缓存中的id会被重复分配
+*/
+func getSeqInTx(ctx context.Context, name string, count int) (ids []uint64, ok bool) {
+	state := getTxState(ctx, "")
+	if state == nil || config.DatabaseParams.Sequence != "table" || !singleWriter(config.GetDatabaseParams("")) {
+		return nil, false
+	}
+	if count < 1 {
+		panic("ErrorCount")
+	}
+	idCache, ok := idCaches[name]
+	if !ok {
+		logger.Sugar.Errorf("seqname:%v no regist", name)
+		panic("SeqNotRegist")
+	}
+	ids, c := enough(name, count)
+	increment := uint64(idCache.increment)
+	for c < count {
+		id, err := nextSeqValue(state.session, name)
+		if err != nil {
+			panic(err)
+		}
+		if id == 0 {
+			logger.Sugar.Errorf("seqname:%v not exist", name)
+			break
+		}
+		base := id - increment + 1
+		var j uint64
+		for j = 0; j < increment && c < count; j++ {
+			ids[c] = j + base
+			c++
+		}
+	}
+
+	return ids, true
+}
+
+// 同一时刻只允许一个写事务的数据库
+func singleWriter(params *config.DbParams) bool {
+	return params.Orm == "bolt" || params.Orm == "memory" || params.Drivername == "sqlite3" || params.Drivername == "sqlite"
+}
+
 func enough(name string, count int) ([]uint64, int) {
 	ids := make([]uint64, count)
 	idCache, ok := idCaches[name]
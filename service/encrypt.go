@@ -0,0 +1,535 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/crypto/std"
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/repository"
+	goreflect "reflect"
+	"strings"
+	"sync"
+)
+
+/*
+*
+字段的加密，字符串字段加上colla:"encrypt"标签，写数据库之前加密，读出来以后解密，比如
+
+	IdCard string `xorm:"varchar(255)" colla:"encrypt=deterministic"`
+	Phone  string `xorm:"varchar(255)" colla:"encrypt"`
+
+使用AES的GCM模式，密文是$enc$<密钥id>$<base64>，所以字段的长度要比明文长
+encrypt每次加密使用随机的nonce，相同的明文得到不同的密文，不能用于查询
+encrypt=deterministic相同的密钥和明文得到相同的密文，可以在条件bean和Criteria的Eq和In中做相等的查询
+空字符串不加密，没有密文前缀的值当作明文，所以可以在已有的表上逐步打开加密，再用Rekey加密原来的数据
+加密的字段不记录审计的变化
+*/
+const encryptPrefix = "$enc$"
+
+// 加密的字段不能做查询的时候返回的错误
+var ErrEncryptedField = errors.New("EncryptedFieldNotSearchable")
+
+/*
+*
+加密的密钥，CurrentKey返回加密使用的密钥和密钥的id，Key按照密文中的id返回解密的密钥
+轮换密钥的时候增加新的密钥，CurrentKey返回新的密钥，旧的密钥保留到Rekey完成
+*/
+type KeyProvider interface {
+	CurrentKey() (string, []byte, error)
+	Key(id string) ([]byte, error)
+}
+
+/*
+*
+从配置中读取密钥，encrypt.keys是id=base64密钥的列表，用逗号分隔，encrypt.current是加密使用的密钥的id，比如
+
+	encrypt:
+	  keys: k1=<base64>,k2=<base64>
+	  current: k2
+
+密钥是16，24或者32字节，对应AES-128，AES-192或者AES-256
+确定性加密的字段作为条件的时候只用当前密钥加密，修改encrypt.current以后到Rekey完成之前，
+用旧密钥加密的记录按照这些字段查询不到
+*/
+type ConfigKeyProvider struct {
+	once    sync.Once
+	current string
+	keys    map[string][]byte
+	err     error
+}
+
+func (this *ConfigKeyProvider) load() {
+	this.keys = make(map[string][]byte)
+	keys, _ := config.GetString("encrypt.keys", "")
+	for _, item := range strings.Split(keys, ",") {
+		id, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			logger.Sugar.Errorf("encrypt key:%v error:%v", id, err.Error())
+			this.err = errors.New("WrongEncryptKey")
+			return
+		}
+		this.keys[id] = key
+	}
+	this.current, _ = config.GetString("encrypt.current", "")
+}
+
+func (this *ConfigKeyProvider) CurrentKey() (string, []byte, error) {
+	this.once.Do(this.load)
+	if this.err != nil {
+		return "", nil, this.err
+	}
+	key, err := this.Key(this.current)
+
+	return this.current, key, err
+}
+
+func (this *ConfigKeyProvider) Key(id string) ([]byte, error) {
+	this.once.Do(this.load)
+	if this.err != nil {
+		return nil, this.err
+	}
+	key, ok := this.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("NoEncryptKey: %v", id)
+	}
+
+	return key, nil
+}
+
+var keyProvider KeyProvider = &ConfigKeyProvider{}
+
+var keyProviderLock sync.RWMutex
+
+// 设置加密的密钥，比如从密钥管理服务中取得密钥，一般在init中调用
+func SetKeyProvider(provider KeyProvider) {
+	keyProviderLock.Lock()
+	defer keyProviderLock.Unlock()
+	keyProvider = provider
+}
+
+func getKeyProvider() KeyProvider {
+	keyProviderLock.RLock()
+	defer keyProviderLock.RUnlock()
+
+	return keyProvider
+}
+
+type encryptedField struct {
+	index         []int
+	name          string
+	deterministic bool
+}
+
+// 实体类型的加密字段的缓存
+var encryptedFields sync.Map
+
+// typ可以是实体，实体的指针或者实体数组的类型
+func encryptedFieldsOf(typ goreflect.Type) []*encryptedField {
+	for typ != nil && (typ.Kind() == goreflect.Ptr || typ.Kind() == goreflect.Slice || typ.Kind() == goreflect.Array) {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != goreflect.Struct {
+		return nil
+	}
+	cached, ok := encryptedFields.Load(typ)
+	if ok {
+		return cached.([]*encryptedField)
+	}
+	fields := make([]*encryptedField, 0)
+	for _, field := range goreflect.VisibleFields(typ) {
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+		rule, ok := encryptRule(field.Tag.Get(baseentity.TagName_Colla))
+		if !ok {
+			continue
+		}
+		if field.Type.Kind() != goreflect.String {
+			logger.Sugar.Errorf("%v.%v encrypt only support string field", typ.Name(), field.Name)
+			continue
+		}
+		fields = append(fields, &encryptedField{index: field.Index, name: field.Name, deterministic: rule == "deterministic"})
+	}
+	encryptedFields.Store(typ, fields)
+
+	return fields
+}
+
+// colla标签中的encrypt规则，pattern后面的内容是正则表达式，不再解析
+func encryptRule(tag string) (string, bool) {
+	for _, item := range strings.Split(tag, ",") {
+		item = strings.TrimSpace(item)
+		if strings.HasPrefix(item, "pattern=") {
+			break
+		}
+		name, arg, _ := strings.Cut(item, "=")
+		if name == "encrypt" {
+			return arg, true
+		}
+	}
+
+	return "", false
+}
+
+// 是否是加密的字段，用于审计忽略加密的字段
+func isEncrypted(field goreflect.StructField) bool {
+	_, ok := encryptRule(field.Tag.Get(baseentity.TagName_Colla))
+
+	return ok
+}
+
+// 对md中的每个实体结构执行fn，md可以是实体的指针，实体数组或者实体数组的指针
+func eachStruct(md interface{}, fn func(value goreflect.Value) error) error {
+	if md == nil {
+		return nil
+	}
+	value := goreflect.ValueOf(md)
+	for value.Kind() == goreflect.Ptr || value.Kind() == goreflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case goreflect.Struct:
+		if !value.CanAddr() {
+			return nil
+		}
+		return fn(value)
+	case goreflect.Slice, goreflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			elem := value.Index(i)
+			if elem.Kind() == goreflect.Struct {
+				elem = elem.Addr()
+			}
+			err := eachStruct(elem.Interface(), fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+*
+写数据库之前加密实体的加密字段，已经加密的值不再加密
+*/
+func encryptEntity(md interface{}) error {
+	return eachStruct(md, func(value goreflect.Value) error {
+		for _, field := range encryptedFieldsOf(value.Type()) {
+			f := value.FieldByIndex(field.index)
+			cipher, err := sealValue(f.String(), field.deterministic)
+			if err != nil {
+				return err
+			}
+			f.SetString(cipher)
+		}
+		return nil
+	})
+}
+
+/*
+*
+读出来以后解密实体的加密字段，没有密文前缀的值不处理
+*/
+func decryptEntity(md interface{}) error {
+	return eachStruct(md, func(value goreflect.Value) error {
+		for _, field := range encryptedFieldsOf(value.Type()) {
+			f := value.FieldByIndex(field.index)
+			plain, err := openValue(f.String(), field.deterministic)
+			if err != nil {
+				logger.Sugar.Errorf("%v.%v decrypt error:%v", value.Type().Name(), field.name, err.Error())
+				return err
+			}
+			f.SetString(plain)
+		}
+		return nil
+	})
+}
+
+/*
+*
+作为条件的实体，确定性加密的字段加密以后作为条件，随机加密的字段不能作为条件
+查询结束以后用decryptEntity恢复原来的明文
+*/
+func encryptConds(md interface{}) error {
+	err := eachStruct(md, func(value goreflect.Value) error {
+		for _, field := range encryptedFieldsOf(value.Type()) {
+			f := value.FieldByIndex(field.index)
+			if f.String() == "" || strings.HasPrefix(f.String(), encryptPrefix) {
+				continue
+			}
+			if !field.deterministic {
+				return fmt.Errorf("%w: %v", ErrEncryptedField, field.name)
+			}
+			cipher, err := sealValue(f.String(), true)
+			if err != nil {
+				return err
+			}
+			f.SetString(cipher)
+		}
+		return nil
+	})
+	if err != nil {
+		decryptEntity(md)
+	}
+
+	return err
+}
+
+// 读取以后解密结果，读取的错误优先返回
+func decryptResult(md interface{}, err error) error {
+	e := decryptEntity(md)
+	if err != nil {
+		return err
+	}
+
+	return e
+}
+
+/*
+*
+写数据库之前加密实体，返回的函数在写完以后恢复明文
+删除的时候只加密没有id的实体，这时实体的非空字段是删除的条件
+*/
+func sealEntity(operation string, md interface{}) (func(), error) {
+	var err error
+	if operation != baseentity.AuditOperation_Delete {
+		err = encryptEntity(md)
+	} else {
+		for _, m := range entities(md) {
+			_, ok := repository.GetId(m)
+			if !ok {
+				err = encryptConds(m)
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	restore := func() {
+		decryptEntity(md)
+	}
+	if err != nil {
+		restore()
+		return nil, err
+	}
+
+	return restore, nil
+}
+
+/*
+*
+把条件中对确定性加密字段的Eq和In的值加密，返回新的条件，原来的条件不变
+其他的操作不能用于加密的字段，返回ErrEncryptedField
+*/
+func encryptCriteria(md interface{}, criteria *repository.Criteria) (*repository.Criteria, error) {
+	if !criteria.HasCondition() {
+		return criteria, nil
+	}
+	fields := make(map[string]*encryptedField)
+	for _, field := range encryptedFieldsOf(goreflect.TypeOf(md)) {
+		fields[strings.ToLower(field.name)] = field
+	}
+	if len(fields) == 0 {
+		return criteria, nil
+	}
+
+	return sealCriteria(fields, criteria)
+}
+
+func sealCriteria(fields map[string]*encryptedField, criteria *repository.Criteria) (*repository.Criteria, error) {
+	c := *criteria
+	if len(criteria.Children) > 0 {
+		c.Children = make([]*repository.Criteria, len(criteria.Children))
+		for i, child := range criteria.Children {
+			sealed, err := sealCriteria(fields, child)
+			if err != nil {
+				return nil, err
+			}
+			c.Children[i] = sealed
+		}
+		return &c, nil
+	}
+	field, ok := fields[strings.ToLower(strings.ReplaceAll(criteria.Field, "_", ""))]
+	if !ok {
+		return &c, nil
+	}
+	if !field.deterministic || (criteria.Op != repository.Op_Eq && criteria.Op != repository.Op_In) {
+		return nil, fmt.Errorf("%w: %v %v", ErrEncryptedField, criteria.Op, field.name)
+	}
+	c.Values = make([]interface{}, len(criteria.Values))
+	for i, v := range criteria.Values {
+		s, ok := v.(string)
+		if !ok {
+			c.Values[i] = v
+			continue
+		}
+		cipher, err := sealValue(s, true)
+		if err != nil {
+			return nil, err
+		}
+		c.Values[i] = cipher
+	}
+
+	return &c, nil
+}
+
+// 用当前的密钥加密，空字符串和已经加密的值不处理
+func sealValue(plain string, deterministic bool) (string, error) {
+	if plain == "" || strings.HasPrefix(plain, encryptPrefix) {
+		return plain, nil
+	}
+	id, key, err := getKeyProvider().CurrentKey()
+	if err != nil {
+		return "", err
+	}
+
+	return seal(id, key, plain, deterministic)
+}
+
+func seal(id string, key []byte, plain string, deterministic bool) (cipher string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("EncryptFailure: %v", p)
+		}
+	}()
+	var bs []byte
+	if deterministic {
+		bs = std.EncryptDeterministic(key, []byte(plain))
+	} else {
+		bs = std.EncryptSymmetrical(key, []byte(plain), "GCM")
+	}
+
+	return encryptPrefix + id + "$" + base64.StdEncoding.EncodeToString(bs), nil
+}
+
+// 按照密文中的密钥id解密，没有密文前缀的值原样返回，deterministic是加密的时候是否使用确定性的加密
+func openValue(value string, deterministic bool) (plain string, err error) {
+	id, data, ok := parseCipher(value)
+	if !ok {
+		return value, nil
+	}
+	key, err := getKeyProvider().Key(id)
+	if err != nil {
+		return "", err
+	}
+	bs, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("DecryptFailure: %v", p)
+		}
+	}()
+
+	if deterministic {
+		return string(std.DecryptDeterministic(key, bs)), nil
+	}
+
+	return string(std.DecryptSymmetrical(key, bs, "GCM")), nil
+}
+
+// 拆分密文，返回密钥的id和base64的数据
+func parseCipher(value string) (string, string, bool) {
+	if !strings.HasPrefix(value, encryptPrefix) {
+		return "", "", false
+	}
+
+	return strings.Cut(value[len(encryptPrefix):], "$")
+}
+
+/*
+*
+密钥轮换，按照主键分批在主库的事务中读取md类型的所有记录，包括已经软删除的记录，
+把不是用当前密钥加密的字段和还没有加密的字段用当前密钥重新加密，只更新加密的字段，返回更新的记录数
+md是实体的指针，只用于确定实体的类型，不调用实体的钩子，也不记录审计
+*/
+func (this *OrmBaseService) Rekey(md interface{}) (int64, error) {
+	fields := encryptedFieldsOf(goreflect.TypeOf(md))
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	current, _, err := getKeyProvider().CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+	columns := make([]string, 0, len(fields))
+	for _, field := range fields {
+		columns = append(columns, field.name)
+	}
+	batchSize := this.BatchSize
+	if batchSize <= 0 {
+		batchSize = config.GetDatabaseParams(this.DbName).BatchSize
+	}
+	name := idName(md)
+	typ := indirectType(md)
+	var last interface{}
+	var count int64
+	for {
+		// 在主库的事务中读取和修改，不会用副本或者并发修改之前的明文覆盖新的值
+		var n int
+		var rekeyed int64
+		_, err = this.Transaction(func(session repository.DbSession) (interface{}, error) {
+			rows := goreflect.New(goreflect.SliceOf(goreflect.PtrTo(typ)))
+			criteria := repository.Sort(name, false)
+			if last != nil {
+				criteria = repository.Gt(name, last).Sort(name, false)
+			}
+			err := session.Unscoped().FindByCriteria(rows.Interface(), nil, criteria, 0, batchSize)
+			if err != nil {
+				return nil, err
+			}
+			n = rows.Elem().Len()
+			for i := 0; i < n; i++ {
+				row := rows.Elem().Index(i)
+				stale := false
+				for _, field := range fields {
+					value := row.Elem().FieldByIndex(field.index).String()
+					id, _, ok := parseCipher(value)
+					if (ok && id != current) || (!ok && value != "") {
+						stale = true
+						break
+					}
+				}
+				if !stale {
+					continue
+				}
+				err := decryptEntity(row.Interface())
+				if err == nil {
+					err = encryptEntity(row.Interface())
+				}
+				if err == nil {
+					_, err = session.Unscoped().Update(row.Interface(), columns, "")
+				}
+				if err != nil {
+					return nil, err
+				}
+				rekeyed++
+			}
+			if n > 0 {
+				last, _ = repository.GetId(rows.Elem().Index(n - 1).Interface())
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return count, err
+		}
+		count += rekeyed
+		if n < batchSize {
+			break
+		}
+	}
+
+	return count, nil
+}
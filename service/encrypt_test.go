@@ -0,0 +1,129 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/curltech/go-colla-core/crypto/std"
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+type encryptRow struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	IdCard                string `xorm:"varchar(255)" colla:"encrypt=deterministic"`
+	Phone                 string `xorm:"varchar(255)" colla:"encrypt"`
+}
+
+func (encryptRow) TableName() string {
+	return "test_encrypt"
+}
+
+// 测试用的密钥，可以切换加密使用的密钥
+type testKeyProvider struct {
+	ConfigKeyProvider
+	current string
+}
+
+func (this *testKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := this.Key(this.current)
+
+	return this.current, key, err
+}
+
+func TestDeterministicSubkeys(t *testing.T) {
+	_, key, err := (&ConfigKeyProvider{}).CurrentKey()
+	if err != nil || len(key) != 16 {
+		t.Fatalf("config key: %v %v", len(key), err)
+	}
+	plain := []byte("110101199001011234")
+	cipher := std.EncryptDeterministic(key, plain)
+	if !bytes.Equal(cipher, std.EncryptDeterministic(key, plain)) {
+		t.Fatalf("not deterministic")
+	}
+	// nonce不是直接用key计算的HMAC
+	mac := hmac.New(sha256.New, key)
+	mac.Write(plain)
+	if bytes.Equal(cipher[:12], mac.Sum(nil)[:12]) {
+		t.Fatalf("nonce uses the encryption key")
+	}
+	if string(std.DecryptDeterministic(key, cipher)) != string(plain) {
+		t.Fatalf("decrypt")
+	}
+}
+
+func TestEncryptedFields(t *testing.T) {
+	provider := &testKeyProvider{current: "k1"}
+	previous := getKeyProvider()
+	SetKeyProvider(provider)
+	defer SetKeyProvider(previous)
+	forEachDb(t, func(t *testing.T, dbName string) {
+		provider.current = "k1"
+		svc := newTestService(t, dbName, new(encryptRow))
+		row := &encryptRow{IdCard: "110", Phone: "139"}
+		row.Id = 1
+		_, err := svc.Insert(row)
+		if err != nil || row.IdCard != "110" || row.Phone != "139" {
+			t.Fatalf("insert: %v %+v", err, row)
+		}
+		raw := func() *encryptRow {
+			got := &encryptRow{}
+			got.Id = 1
+			found, err := GetDbSession(dbName).Get(got, false, "", "")
+			if err != nil || !found {
+				t.Fatalf("raw get: %v %v", found, err)
+			}
+			return got
+		}
+		stored := raw()
+		if !strings.HasPrefix(stored.IdCard, encryptPrefix+"k1$") || !strings.HasPrefix(stored.Phone, encryptPrefix+"k1$") {
+			t.Fatalf("stored: %+v", stored)
+		}
+		// 确定性的密文不能用普通的GCM解密，说明加密使用了子密钥
+		bs, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored.IdCard, encryptPrefix+"k1$"))
+		key, _ := provider.Key("k1")
+		func() {
+			defer func() { recover() }()
+			std.DecryptSymmetrical(key, bs, "GCM")
+			t.Fatalf("deterministic cipher opened with the master key")
+		}()
+		find := func() []*encryptRow {
+			rows := make([]*encryptRow, 0)
+			err := svc.FindByCriteria(&rows, nil, repository.Eq("IdCard", "110"), 0, 0)
+			if err != nil {
+				t.Fatalf("find: %v", err)
+			}
+			return rows
+		}
+		rows := find()
+		if len(rows) != 1 || rows[0].IdCard != "110" || rows[0].Phone != "139" {
+			t.Fatalf("find by deterministic field: %v", rows)
+		}
+		err = svc.FindByCriteria(&rows, nil, repository.Eq("Phone", "139"), 0, 0)
+		if !errors.Is(err, ErrEncryptedField) {
+			t.Fatalf("find by random field: %v", err)
+		}
+		// 轮换密钥，Rekey完成之前按照当前密钥查询不到旧密钥加密的记录
+		provider.current = "k2"
+		if rows := find(); len(rows) != 0 {
+			t.Fatalf("find before rekey: %v", rows)
+		}
+		count, err := svc.Rekey(new(encryptRow))
+		if err != nil || count != 1 {
+			t.Fatalf("rekey: %v %v", count, err)
+		}
+		stored = raw()
+		if !strings.HasPrefix(stored.IdCard, encryptPrefix+"k2$") || !strings.HasPrefix(stored.Phone, encryptPrefix+"k2$") {
+			t.Fatalf("rekeyed: %+v", stored)
+		}
+		rows = find()
+		if len(rows) != 1 || rows[0].Phone != "139" {
+			t.Fatalf("find after rekey: %v", rows)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"github.com/curltech/go-colla-core/logger"
+	"sync"
+)
+
+/*
+*
+领域事件，Topic是事件的主题，Entity是发生事件的实体，Payload是事件的内容
+*/
+type Event struct {
+	Topic   string
+	Entity  interface{}
+	Payload interface{}
+}
+
+// 事件的处理函数，返回的错误只记录日志，不影响发布者和其他处理函数
+type EventHandler func(ctx context.Context, event *Event) error
+
+var eventHandlers = make(map[string][]EventHandler)
+
+var eventLock sync.RWMutex
+
+/*
+*
+订阅主题的事件，一般在init中调用
+*/
+func Subscribe(topic string, handler EventHandler) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	eventHandlers[topic] = append(eventHandlers[topic], handler)
+}
+
+/*
+*
+同步发布事件，按照订阅的顺序调用处理函数，处理函数的错误和panic只记录日志
+*/
+func Publish(ctx context.Context, event *Event) {
+	eventLock.RLock()
+	handlers := eventHandlers[event.Topic]
+	eventLock.RUnlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for _, handler := range handlers {
+		handle(ctx, handler, event)
+	}
+}
+
+func handle(ctx context.Context, handler EventHandler, event *Event) {
+	defer func() {
+		if p := recover(); p != nil {
+			logger.Sugar.Errorf("event:%v handler panic:%v", event.Topic, p)
+		}
+	}()
+	err := handler(ctx, event)
+	if err != nil {
+		logger.Sugar.Errorf("event:%v handler error:%v", event.Topic, err.Error())
+	}
+}
@@ -0,0 +1,326 @@
+package service
+
+import (
+	"context"
+	"errors"
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/repository"
+	goreflect "reflect"
+	"sync"
+)
+
+/*
+*
+实体的生命周期钩子，实体实现需要的接口就可以，OrmBaseService在Insert，Update，Upsert，Delete，DeleteByCriteria，
+Save，SaveContext，SaveAggregate和TransitionStatus中调用，DeleteByCriteria对条件匹配的每条记录调用
+Before和After在事务中执行，session是当前事务的会话，返回错误的时候整个操作回滚
+AfterCommit在事务真正提交以后调用，ctx中有外层事务的时候等外层事务提交以后才调用，回滚的时候不调用
+*/
+type BeforeInsertHook interface {
+	BeforeInsert(ctx context.Context, session repository.DbSession) error
+}
+
+type AfterInsertHook interface {
+	AfterInsert(ctx context.Context, session repository.DbSession) error
+}
+
+type BeforeUpdateHook interface {
+	BeforeUpdate(ctx context.Context, session repository.DbSession) error
+}
+
+type AfterUpdateHook interface {
+	AfterUpdate(ctx context.Context, session repository.DbSession) error
+}
+
+type BeforeDeleteHook interface {
+	BeforeDelete(ctx context.Context, session repository.DbSession) error
+}
+
+type AfterDeleteHook interface {
+	AfterDelete(ctx context.Context, session repository.DbSession) error
+}
+
+// operation是AuditOperation_Insert，AuditOperation_Update或者AuditOperation_Delete
+type AfterCommitHook interface {
+	AfterCommit(ctx context.Context, operation string)
+}
+
+/*
+*
+实体的监听器，和实体的钩子相同，md是发生操作的实体，用于不方便修改实体的时候，比如清除缓存，更新索引，发送消息
+只需要部分方法的时候嵌入BaseEntityListener
+*/
+type EntityListener interface {
+	BeforeInsert(ctx context.Context, session repository.DbSession, md interface{}) error
+	AfterInsert(ctx context.Context, session repository.DbSession, md interface{}) error
+	BeforeUpdate(ctx context.Context, session repository.DbSession, md interface{}) error
+	AfterUpdate(ctx context.Context, session repository.DbSession, md interface{}) error
+	BeforeDelete(ctx context.Context, session repository.DbSession, md interface{}) error
+	AfterDelete(ctx context.Context, session repository.DbSession, md interface{}) error
+	AfterCommit(ctx context.Context, operation string, md interface{})
+}
+
+// 什么都不做的监听器
+type BaseEntityListener struct {
+}
+
+func (BaseEntityListener) BeforeInsert(ctx context.Context, session repository.DbSession, md interface{}) error {
+	return nil
+}
+
+func (BaseEntityListener) AfterInsert(ctx context.Context, session repository.DbSession, md interface{}) error {
+	return nil
+}
+
+func (BaseEntityListener) BeforeUpdate(ctx context.Context, session repository.DbSession, md interface{}) error {
+	return nil
+}
+
+func (BaseEntityListener) AfterUpdate(ctx context.Context, session repository.DbSession, md interface{}) error {
+	return nil
+}
+
+func (BaseEntityListener) BeforeDelete(ctx context.Context, session repository.DbSession, md interface{}) error {
+	return nil
+}
+
+func (BaseEntityListener) AfterDelete(ctx context.Context, session repository.DbSession, md interface{}) error {
+	return nil
+}
+
+func (BaseEntityListener) AfterCommit(ctx context.Context, operation string, md interface{}) {
+}
+
+// 实体提交以后在事件总线上发布的事件的主题，事件的Entity是实体
+const (
+	EventTopic_EntityInsert = "EntityInsert"
+	EventTopic_EntityUpdate = "EntityUpdate"
+	EventTopic_EntityDelete = "EntityDelete"
+)
+
+var commitTopics = map[string]string{
+	baseentity.AuditOperation_Insert: EventTopic_EntityInsert,
+	baseentity.AuditOperation_Update: EventTopic_EntityUpdate,
+	baseentity.AuditOperation_Delete: EventTopic_EntityDelete,
+}
+
+// 键是实体的类型，nil是所有实体的监听器
+var entityListeners = make(map[goreflect.Type][]EntityListener)
+
+var listenerLock sync.RWMutex
+
+/*
+*
+登记实体类型的监听器，md是实体的指针或者实体，md为nil的时候监听所有的实体
+*/
+func RegistListener(md interface{}, listener EntityListener) {
+	listenerLock.Lock()
+	defer listenerLock.Unlock()
+	typ := indirectType(md)
+	entityListeners[typ] = append(entityListeners[typ], listener)
+}
+
+func listeners(md interface{}) []EntityListener {
+	listenerLock.RLock()
+	defer listenerLock.RUnlock()
+	ls := make([]EntityListener, 0)
+	ls = append(ls, entityListeners[nil]...)
+
+	return append(ls, entityListeners[indirectType(md)]...)
+}
+
+type committed struct {
+	operation string
+	md        interface{}
+}
+
+/*
+*
+一次操作的生命周期，在事务中检查数据访问策略和调用钩子，记录操作过的实体，事务提交以后调用AfterCommit
+*/
+type lifecycle struct {
+	service   *OrmBaseService
+	committed []*committed
+	denied    []interface{}
+	denials   []*AccessDenial
+}
+
+func (this *OrmBaseService) newLifecycle() *lifecycle {
+	return &lifecycle{service: this}
+}
+
+// 在事务中执行实体的操作，前后调用钩子，写数据库的时候加密字段，md可以是实体的指针或者实体数组
+func (this *lifecycle) run(session repository.DbSession, operation string, md interface{}, fn func() (int64, error)) (int64, error) {
+	if operation != baseentity.AuditOperation_Delete {
+		err := this.service.stampTenant(md)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if operation != baseentity.AuditOperation_Insert {
+		err := this.check(session, operation, md)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := this.fire(session, operation, false, md)
+	if err != nil {
+		return 0, err
+	}
+	restore, err := sealEntity(operation, md)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := fn()
+	restore()
+	if err != nil {
+		return affected, err
+	}
+	err = this.fire(session, operation, true, md)
+	if err != nil {
+		return affected, err
+	}
+	this.committed = append(this.committed, &committed{operation: operation, md: md})
+
+	return affected, nil
+}
+
+// 检查数据访问策略，被拒绝的时候记录下来，操作结束的时候在done中记录
+func (this *lifecycle) check(session repository.DbSession, operation string, md interface{}) error {
+	err := this.service.checkAccess(session, operation, md)
+	var denial *AccessDenial
+	if errors.As(err, &denial) {
+		this.denied = append(this.denied, md)
+		this.denials = append(this.denials, denial)
+	}
+
+	return err
+}
+
+func (this *lifecycle) fire(session repository.DbSession, operation string, after bool, md interface{}) error {
+	ctx := this.service.Context()
+	for _, m := range entities(md) {
+		err := entityHook(ctx, session, operation, after, m)
+		if err != nil {
+			return err
+		}
+		for _, listener := range listeners(m) {
+			err = listenerHook(ctx, session, operation, after, listener, m)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func entityHook(ctx context.Context, session repository.DbSession, operation string, after bool, md interface{}) error {
+	switch operation {
+	case baseentity.AuditOperation_Insert:
+		if h, ok := md.(BeforeInsertHook); ok && !after {
+			return h.BeforeInsert(ctx, session)
+		}
+		if h, ok := md.(AfterInsertHook); ok && after {
+			return h.AfterInsert(ctx, session)
+		}
+	case baseentity.AuditOperation_Update:
+		if h, ok := md.(BeforeUpdateHook); ok && !after {
+			return h.BeforeUpdate(ctx, session)
+		}
+		if h, ok := md.(AfterUpdateHook); ok && after {
+			return h.AfterUpdate(ctx, session)
+		}
+	case baseentity.AuditOperation_Delete:
+		if h, ok := md.(BeforeDeleteHook); ok && !after {
+			return h.BeforeDelete(ctx, session)
+		}
+		if h, ok := md.(AfterDeleteHook); ok && after {
+			return h.AfterDelete(ctx, session)
+		}
+	}
+
+	return nil
+}
+
+func listenerHook(ctx context.Context, session repository.DbSession, operation string, after bool, listener EntityListener, md interface{}) error {
+	switch operation {
+	case baseentity.AuditOperation_Insert:
+		if after {
+			return listener.AfterInsert(ctx, session, md)
+		}
+		return listener.BeforeInsert(ctx, session, md)
+	case baseentity.AuditOperation_Update:
+		if after {
+			return listener.AfterUpdate(ctx, session, md)
+		}
+		return listener.BeforeUpdate(ctx, session, md)
+	case baseentity.AuditOperation_Delete:
+		if after {
+			return listener.AfterDelete(ctx, session, md)
+		}
+		return listener.BeforeDelete(ctx, session, md)
+	}
+
+	return nil
+}
+
+// 操作结束的时候调用，成功的时候调用commit，失败的时候记录被策略拒绝的访问
+func (this *lifecycle) done(err error) {
+	if err == nil {
+		this.commit()
+		return
+	}
+	this.service.recordDenials(this.denied, this.denials)
+	this.denied = nil
+	this.denials = nil
+}
+
+/*
+*
+事务成功以后调用，通知所有操作过的实体，并且在事件总线上发布实体的事件
+*/
+func (this *lifecycle) commit() {
+	if len(this.committed) == 0 {
+		return
+	}
+	cs := this.committed
+	this.committed = nil
+	this.service.afterCommit(func(ctx context.Context) {
+		for _, c := range cs {
+			for _, m := range entities(c.md) {
+				notifyCommit(ctx, c.operation, m)
+			}
+		}
+	})
+}
+
+func notifyCommit(ctx context.Context, operation string, md interface{}) {
+	defer func() {
+		if p := recover(); p != nil {
+			logger.Sugar.Errorf("after commit %v panic:%v", operation, p)
+		}
+	}()
+	h, ok := md.(AfterCommitHook)
+	if ok {
+		h.AfterCommit(ctx, operation)
+	}
+	for _, listener := range listeners(md) {
+		listener.AfterCommit(ctx, operation, md)
+	}
+	Publish(ctx, &Event{Topic: commitTopics[operation], Entity: md, Payload: operation})
+}
+
+/*
+*
+提交以后执行fn，ctx中有这个数据库的事务的时候放到事务中，等最外层的事务提交以后执行，否则马上执行
+*/
+func (this *OrmBaseService) afterCommit(fn func(ctx context.Context)) {
+	state := getTxState(this.ctx, this.dbName())
+	if state != nil {
+		state.afterCommit = append(state.afterCommit, fn)
+		return
+	}
+	fn(this.Context())
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+// 钩子，监听器和事件按照调用的顺序记录
+var hookLog []string
+
+func logHook(format string, args ...interface{}) {
+	hookLog = append(hookLog, fmt.Sprintf(format, args...))
+}
+
+type hookRow struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	Name                  string `xorm:"varchar(32)"`
+}
+
+func (hookRow) TableName() string {
+	return "test_hook"
+}
+
+func (this *hookRow) BeforeInsert(ctx context.Context, session repository.DbSession) error {
+	logHook("BeforeInsert %v", this.Id)
+	if this.Name == "fail" {
+		return errors.New("fail")
+	}
+	return nil
+}
+
+func (this *hookRow) AfterInsert(ctx context.Context, session repository.DbSession) error {
+	logHook("AfterInsert %v", this.Id)
+	return nil
+}
+
+func (this *hookRow) BeforeDelete(ctx context.Context, session repository.DbSession) error {
+	logHook("BeforeDelete %v", this.Id)
+	return nil
+}
+
+func (this *hookRow) AfterDelete(ctx context.Context, session repository.DbSession) error {
+	logHook("AfterDelete %v", this.Id)
+	return nil
+}
+
+func (this *hookRow) AfterCommit(ctx context.Context, operation string) {
+	logHook("AfterCommit %v %v", operation, this.Id)
+}
+
+type hookListener struct {
+	BaseEntityListener
+}
+
+func (hookListener) BeforeInsert(ctx context.Context, session repository.DbSession, md interface{}) error {
+	logHook("listener BeforeInsert %v", md.(*hookRow).Id)
+	return nil
+}
+
+func (hookListener) AfterCommit(ctx context.Context, operation string, md interface{}) {
+	logHook("listener AfterCommit %v %v", operation, md.(*hookRow).Id)
+}
+
+func init() {
+	RegistListener(new(hookRow), hookListener{})
+	for _, topic := range []string{EventTopic_EntityInsert, EventTopic_EntityDelete} {
+		// 处理函数的错误不影响后面的处理函数
+		Subscribe(topic, func(ctx context.Context, event *Event) error {
+			return errors.New("ignored")
+		})
+		Subscribe(topic, func(ctx context.Context, event *Event) error {
+			row, ok := event.Entity.(*hookRow)
+			if ok {
+				logHook("event %v %v", event.Topic, row.Id)
+			}
+			return nil
+		})
+	}
+}
+
+func newHookRow(id uint64, name string) *hookRow {
+	row := &hookRow{Name: name}
+	row.Id = id
+	return row
+}
+
+func TestHooks(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(hookRow))
+		count := func() int64 {
+			n, err := svc.Count(new(hookRow), "")
+			if err != nil {
+				t.Fatalf("count: %v", err)
+			}
+			return n
+		}
+		expect := func(name string, want ...string) {
+			t.Helper()
+			if strings.Join(hookLog, ", ") != strings.Join(want, ", ") {
+				t.Fatalf("%v:\n%v\nwant:\n%v", name, strings.Join(hookLog, "\n"), strings.Join(want, "\n"))
+			}
+			hookLog = nil
+		}
+		hookLog = nil
+		_, err := svc.Insert(newHookRow(1, "a"))
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		expect("insert", "BeforeInsert 1", "listener BeforeInsert 1", "AfterInsert 1",
+			"AfterCommit Insert 1", "listener AfterCommit Insert 1", "event EntityInsert 1")
+		// Before钩子失败的时候整个操作回滚，已经新增的也回滚，不调用AfterCommit
+		_, err = svc.Insert(newHookRow(2, "b"), newHookRow(3, "fail"))
+		if err == nil || count() != 1 {
+			t.Fatalf("before hook failure: %v %v", err, count())
+		}
+		expect("failure", "BeforeInsert 2", "listener BeforeInsert 2", "AfterInsert 2", "BeforeInsert 3")
+		// 外层事务提交以后才调用AfterCommit
+		err = svc.RunInTransaction(context.Background(), func(ctx context.Context) error {
+			err := svc.RunInTransaction(ctx, func(ctx context.Context) error {
+				_, err := svc.WithContext(ctx).Insert(newHookRow(4, "d"))
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			expect("inner committed", "BeforeInsert 4", "listener BeforeInsert 4", "AfterInsert 4")
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ambient: %v", err)
+		}
+		expect("outer committed", "AfterCommit Insert 4", "listener AfterCommit Insert 4", "event EntityInsert 4")
+		// 外层事务回滚的时候不调用
+		failure := errors.New("rollback")
+		err = svc.RunInTransaction(context.Background(), func(ctx context.Context) error {
+			_, err := svc.WithContext(ctx).Insert(newHookRow(5, "e"))
+			if err != nil {
+				return err
+			}
+			return failure
+		})
+		if !errors.Is(err, failure) || count() != 2 {
+			t.Fatalf("ambient rollback: %v %v", err, count())
+		}
+		expect("rolled back", "BeforeInsert 5", "listener BeforeInsert 5", "AfterInsert 5")
+		// 按照条件删除的每条记录都调用钩子，提交以后发布事件
+		affected, err := svc.DeleteByCriteria(new(hookRow), repository.Ge("id", 0).Sort("id", false))
+		if err != nil || affected != 2 {
+			t.Fatalf("delete by criteria: %v %v", affected, err)
+		}
+		expect("delete by criteria", "BeforeDelete 1", "BeforeDelete 4", "AfterDelete 1", "AfterDelete 4",
+			"AfterCommit Delete 1", "listener AfterCommit Delete 1", "event EntityDelete 1",
+			"AfterCommit Delete 4", "listener AfterCommit Delete 4", "event EntityDelete 4")
+	})
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+)
+
+type iterRow struct {
+	baseentity.DeletedEntity `xorm:"extends"`
+	Name                     string `xorm:"varchar(32)"`
+}
+
+func (iterRow) TableName() string {
+	return "test_iter"
+}
+
+// 逐条处理的记录的id，fn返回错误的时候停止
+func iterIds(svc BaseService, ctx context.Context, fn func(ids []uint64) error) (string, error) {
+	ids := make([]uint64, 0)
+	err := svc.FindIter(ctx, nil, nil, func(row interface{}) error {
+		ids = append(ids, row.(*iterRow).Id)
+		if fn != nil {
+			return fn(ids)
+		}
+		return nil
+	})
+
+	return fmt.Sprint(ids), err
+}
+
+func TestFindIter(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(iterRow))
+		svc.FactNewEntity = func(data []byte) (interface{}, error) { return new(iterRow), nil }
+		// 每批3条，10条记录分4批读取
+		svc.BatchSize = 3
+		for i := 1; i <= 10; i++ {
+			row := &iterRow{Name: "row"}
+			row.Id = uint64(i)
+			_, err := svc.Insert(row)
+			if err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+		}
+		row := &iterRow{}
+		row.Id = 5
+		_, err := svc.Delete(row, "")
+		if err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		ids, err := iterIds(svc, context.Background(), nil)
+		if err != nil || ids != "[1 2 3 4 6 7 8 9 10]" {
+			t.Fatalf("iterate: %v %v", ids, err)
+		}
+		// fn的错误原样返回，不再处理后面的记录
+		stop := errors.New("stop")
+		ids, err = iterIds(svc, context.Background(), func(ids []uint64) error {
+			if len(ids) == 4 {
+				return stop
+			}
+			return nil
+		})
+		if !errors.Is(err, stop) || ids != "[1 2 3 4]" {
+			t.Fatalf("stop: %v %v", ids, err)
+		}
+		// ctx取消以后提前结束
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ids, err = iterIds(svc, ctx, func(ids []uint64) error {
+			if len(ids) == 2 {
+				cancel()
+			}
+			return nil
+		})
+		if !errors.Is(err, context.Canceled) || ids != "[1 2]" {
+			t.Fatalf("cancel: %v %v", ids, err)
+		}
+		// 条件实体的非空字段也是条件
+		cond := &iterRow{}
+		cond.Id = 7
+		n := 0
+		err = svc.FindIter(context.Background(), cond, nil, func(row interface{}) error {
+			n++
+			return nil
+		})
+		if err != nil || n != 1 {
+			t.Fatalf("condition: %v %v", n, err)
+		}
+	})
+}
+
+func TestFindIterTenant(t *testing.T) {
+	svc := newTestService(t, "tenant", new(tenantRow))
+	svc.FactNewEntity = func(data []byte) (interface{}, error) { return new(tenantRow), nil }
+	svc.BatchSize = 2
+	a := svc.WithTenant(&Tenant{TenantId: "a"})
+	b := svc.WithTenant(&Tenant{TenantId: "b"})
+	for i := 1; i <= 6; i++ {
+		s := a
+		if i%2 == 0 {
+			s = b
+		}
+		row := &tenantRow{Name: "row"}
+		row.Id = uint64(i)
+		_, err := s.Insert(row)
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	iterate := func(s BaseService) string {
+		ids := make([]uint64, 0)
+		err := s.FindIter(context.Background(), nil, nil, func(row interface{}) error {
+			ids = append(ids, row.(*tenantRow).Id)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("iterate: %v", err)
+		}
+		return fmt.Sprint(ids)
+	}
+	if ids := iterate(a); ids != "[1 3 5]" {
+		t.Fatalf("tenant a: %v", ids)
+	}
+	if ids := iterate(b); ids != "[2 4 6]" {
+		t.Fatalf("tenant b: %v", ids)
+	}
+	if ids := iterate(svc); ids != "[]" {
+		t.Fatalf("no tenant: %v", ids)
+	}
+}
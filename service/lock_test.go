@@ -0,0 +1,46 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/curltech/go-colla-core/repository"
+)
+
+func TestLockedGet(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(pageRow))
+		// 没有id的时候从表序列取id，表序列加锁读取
+		row := &pageRow{Rank: 1}
+		_, err := svc.Insert(row)
+		if err != nil || row.Id == 0 {
+			t.Fatalf("insert: %v %v", row.Id, err)
+		}
+		_, err = svc.Transaction(func(session repository.DbSession) (interface{}, error) {
+			got := &pageRow{}
+			got.Id = row.Id
+			found, err := session.Get(got, true, "", "")
+			if err != nil || !found || got.Rank != 1 {
+				t.Fatalf("locked get: %v %v %+v", found, err, got)
+			}
+			got.Rank = 2
+			_, err = session.Update(got, []string{"Rank"}, "")
+			if err != nil {
+				return nil, err
+			}
+			got = &pageRow{}
+			found, err = session.GetByCriteria(got, true, repository.Eq("rank", 2))
+			if err != nil || !found || got.Id != row.Id {
+				t.Fatalf("locked get by criteria: %v %v %+v", found, err, got)
+			}
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatalf("transaction: %v", err)
+		}
+		got := &pageRow{}
+		found, err := svc.GetByCriteria(got, true, repository.Eq("rank", 2))
+		if err != nil || !found || got.Id != row.Id {
+			t.Fatalf("service locked get: %v %v %+v", found, err, got)
+		}
+	})
+}
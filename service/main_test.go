@@ -0,0 +1,73 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	goreflect "reflect"
+	"testing"
+
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+// 测试的数据库，空字符串是xorm的内存数据库，bolt和gorm的数据库文件在临时目录
+var testDbs = []string{"", "bolt", "gorm"}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "colla-service")
+	if err != nil {
+		panic(err)
+	}
+	config.GetDatabaseParams("bolt").Dsn = filepath.Join(dir, "bolt.db")
+	config.GetDatabaseParams("gorm").Dsn = filepath.Join(dir, "gorm.db")
+	code := m.Run()
+	repository.CloseEngines()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+/*
+*
+测试用的服务，md是实体的指针，在数据库上建表并且清空
+*/
+func newTestService(t *testing.T, dbName string, md interface{}) *OrmBaseService {
+	t.Helper()
+	session := GetDbSession(dbName)
+	err := session.Sync(md)
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	_, err = GetDbSession(dbName).Unfiltered().Unscoped().DeleteByCriteria(md, repository.Ge("id", 0))
+	if err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	svc := &OrmBaseService{DbName: dbName}
+	svc.GetSeqName = func() string { return seqname }
+
+	return svc
+}
+
+// 在每个测试数据库上运行fn
+func forEachDb(t *testing.T, fn func(t *testing.T, dbName string)) {
+	for _, dbName := range testDbs {
+		name := dbName
+		if name == "" {
+			name = "xorm"
+		}
+		t.Run(name, func(t *testing.T) {
+			fn(t, dbName)
+		})
+	}
+}
+
+// 实体数组的id，rows是实体指针的数组或者数组的指针
+func idsOf(rows interface{}) string {
+	value := goreflect.Indirect(goreflect.ValueOf(rows))
+	ids := make([]interface{}, value.Len())
+	for i := range ids {
+		ids[i], _ = repository.GetId(value.Index(i).Interface())
+	}
+
+	return fmt.Sprint(ids)
+}
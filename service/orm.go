@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -9,13 +10,16 @@ import (
 	"github.com/curltech/go-colla-core/excel"
 	"github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-core/repository"
-	"github.com/curltech/go-colla-core/repository/gorm"
-	"github.com/curltech/go-colla-core/repository/xorm"
+	_ "github.com/curltech/go-colla-core/repository/bolt"
+	_ "github.com/curltech/go-colla-core/repository/gorm"
+	_ "github.com/curltech/go-colla-core/repository/xorm"
 	"github.com/curltech/go-colla-core/util/debug"
 	"github.com/curltech/go-colla-core/util/reflect"
 	"github.com/curltech/go-colla-core/util/security"
+	goreflect "reflect"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 func PlaceQuestionMark(n int) string {
@@ -30,9 +34,15 @@ func PlaceQuestionMark(n int) string {
 }
 
 type OrmBaseService struct {
+	DbName          string //使用的命名数据库，缺省是空字符串
+	BatchSize       int    //流式查询每批读取的记录数，缺省使用数据库的配置
+	InsertBatchSize int    //批量新增的时候一条INSERT语句的记录数，缺省使用数据库的配置
+	InsertParallel  int    //批量新增的并发数，缺省使用数据库的配置
+	Audit           bool   //是否在bas_audit中记录实体的变化，见AuditService
 	GetSeqName      func() string
 	FactNewEntity   func(data []byte) (interface{}, error)
 	FactNewEntities func(data []byte) (interface{}, error)
+	ctx             context.Context
 }
 
 var ormBaseService BaseService = &OrmBaseService{}
@@ -46,10 +56,14 @@ func GetSeqValue(name string) (uint64, error) {
 		return GetSequenceService().GetSeqValue(name)
 	} else if config.DatabaseParams.Sequence == "seq" {
 		sql := fmt.Sprintf("select nextval('%v')", name)
-		result, err := ormBaseService.Query(sql)
+		// nextval修改序列，必须在主库执行，不能路由到只读副本
+		r, err := ormBaseService.(*OrmBaseService).Transaction(func(session repository.DbSession) (interface{}, error) {
+			return session.Query(sql)
+		})
 		if err != nil {
 			return 0, err
 		}
+		result, _ := r.([]map[string][]byte)
 
 		if len(result) > 0 {
 			r := result[0]
@@ -69,6 +83,30 @@ func GetSeqValue(name string) (uint64, error) {
 	return 0, nil
 }
 
+/*
+*
+返回使用ctx的服务，所有数据库操作都使用ctx，请求的取消或者超时会中止正在执行的sql，比如
+
+	err := svc.WithContext(ctx).Find(&rows, nil, "", 0, 10, "")
+
+返回的是OrmBaseService的副本，具体服务重载的方法不会被调用
+*/
+func (this *OrmBaseService) WithContext(ctx context.Context) BaseService {
+	s := *this
+	s.ctx = ctx
+
+	return &s
+}
+
+// 服务使用的ctx，没有的时候返回context.Background()
+func (this *OrmBaseService) Context() context.Context {
+	if this.ctx != nil {
+		return this.ctx
+	}
+
+	return context.Background()
+}
+
 func (this *OrmBaseService) NewEntity(data []byte) (interface{}, error) {
 	return this.FactNewEntity(data)
 }
@@ -105,7 +143,11 @@ func (this *OrmBaseService) GetSeq() uint64 {
 
 func (this *OrmBaseService) GetSeqs(count int) []uint64 {
 	seqname := this.GetSeqName()
-	ids := GetSeq(seqname, count)
+	ids, ok := getSeqInTx(this.ctx, seqname, count)
+	if ok {
+		return ids
+	}
+	ids = GetSeq(seqname, count)
 
 	return ids
 }
@@ -116,11 +158,23 @@ func (this *OrmBaseService) Get(dest interface{}, locked bool, orderby string, c
 	if !reflect.IsPtr(dest) {
 		return false, errors.New("DestinationNeedPtr")
 	}
-	result, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
-		result, err := session.Get(dest, locked, orderby, conds, params...)
+	err := encryptConds(dest)
+	if err != nil {
+		return false, err
+	}
+	get := func(session repository.DbSession, dest interface{}) (bool, error) {
+		return session.Get(dest, locked, orderby, conds, params...)
+	}
+	result, err := this.read(locked, func(session repository.DbSession) (interface{}, error) {
+		result, err := get(session, dest)
+		if err == nil && !result {
+			err = this.checkGet(session, dest, get)
+		}
 		// return nil will commit the whole transaction
 		return result, err
 	})
+	err = decryptResult(dest, err)
+	this.deniedGet(dest, err)
 	if result == nil {
 		return false, err
 	}
@@ -143,13 +197,18 @@ func (this *OrmBaseService) Find(rowsSlicePtr interface{}, condiBean interface{}
 
 		return err
 	}
-	_, err = this.Transaction(func(session repository.DbSession) (interface{}, error) {
+	err = encryptConds(condiBean)
+	if err != nil {
+		return err
+	}
+	_, err = this.read(false, func(session repository.DbSession) (interface{}, error) {
 		err = session.Find(rowsSlicePtr, condiBean, orderby, from, limit, conds, params...)
 
 		return nil, err
 	})
+	decryptEntity(condiBean)
 
-	return err
+	return decryptResult(rowsSlicePtr, err)
 }
 
 func (this *OrmBaseService) setId(rowPtr interface{}) bool {
@@ -169,28 +228,54 @@ func (this *OrmBaseService) setId(rowPtr interface{}) bool {
 	return false
 }
 
+// 保存之前按照colla标签校验实体，columns不为空的时候只校验这些字段
+func validate(md interface{}, columns ...string) error {
+	err := baseentity.Validate(md, columns...)
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
+
+	return err
+}
+
 // insert model data to database
 func (this *OrmBaseService) Insert(mds ...interface{}) (int64, error) {
+	// 在事务之外分配id，避免在事务中嵌套序列的事务
+	for _, rowPtr := range mds {
+		if !reflect.IsPtr(rowPtr) {
+			return 0, errors.New("DestinationNeedPtr")
+		}
+		this.setId(rowPtr)
+		this.stampUser(rowPtr, true)
+		err := validate(rowPtr)
+		if err != nil {
+			return 0, err
+		}
+	}
+	auditor := this.newAuditor(mds...)
+	lc := this.newLifecycle()
 	affected, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
 		var affected int64
 		var err error
 		for _, rowPtr := range mds {
-			if !reflect.IsPtr(rowPtr) {
-				panic(errors.New("DestinationNeedPtr"))
-			}
-			this.setId(rowPtr)
-
-			_, err = session.Insert(rowPtr)
+			_, err = lc.run(session, baseentity.AuditOperation_Insert, rowPtr, func() (int64, error) {
+				return session.Insert(rowPtr)
+			})
 			if err == nil {
 				affected++
 			} else {
 				return 0, err
 			}
+			err = auditor.record(session, baseentity.AuditOperation_Insert, nil, rowPtr)
+			if err != nil {
+				return 0, err
+			}
 		}
 
 		// return nil will commit the whole transaction
 		return affected, err
 	})
+	lc.done(err)
 	if affected == nil || affected == 0 {
 		return 0, err
 	}
@@ -198,40 +283,180 @@ func (this *OrmBaseService) Insert(mds ...interface{}) (int64, error) {
 	return affected.(int64), err
 }
 
+/*
+*
+批量新增，开始之前用GetSeqs一次分配所有实体的id，然后按照InsertBatchSize分批，每批是一条多行的INSERT语句，
+在单独的事务中执行，和Insert一样校验，调用实体的钩子和记录审计
+postgres上新增的记录数达到数据库配置的copyThreshold的时候使用COPY，每批copyThreshold条
+InsertParallel大于1的时候并发执行各个批次，sqlite或者ctx中有这个数据库的事务的时候所有批次顺序执行
+返回成功新增的记录数，某一批失败的时候停止，已经提交的批次不回滚
+*/
 func (this *OrmBaseService) BatchInsert(mds ...interface{}) (int64, error) {
-	batch := 1000
-	ms := make([]interface{}, 0)
-	var count int64
+	if len(mds) == 0 {
+		return 0, nil
+	}
+	news := make([]interface{}, 0)
+	for _, md := range mds {
+		if !reflect.IsPtr(md) {
+			return 0, errors.New("DestinationNeedPtr")
+		}
+		this.stampUser(md, true)
+		err := validate(md)
+		if err != nil {
+			return 0, err
+		}
+		v, err := reflect.GetValue(md, baseentity.FieldName_Id)
+		if err != nil {
+			continue
+		}
+		id, _ := v.(uint64)
+		if id == 0 {
+			news = append(news, md)
+		}
+	}
+	if len(news) > 0 {
+		ids := this.GetSeqs(len(news))
+		for i, md := range news {
+			reflect.SetValue(md, baseentity.FieldName_Id, ids[i])
+		}
+	}
+	params := config.GetDatabaseParams(this.DbName)
+	batch := this.InsertBatchSize
+	if batch <= 0 {
+		batch = params.InsertBatchSize
+	}
+	if batch <= 0 {
+		batch = 1000
+	}
+	useCopy := params.Orm == "xorm" && params.Drivername == "postgres" && params.CopyThreshold > 0 && len(mds) >= params.CopyThreshold
+	if useCopy {
+		batch = params.CopyThreshold
+	}
+	parallel := this.InsertParallel
+	if parallel <= 0 {
+		parallel = params.InsertParallel
+	}
+	// 外层事务的会话不能并发使用，sqlite不能并发写
+	if parallel < 1 || getTxState(this.ctx, this.dbName()) != nil || singleWriter(params) {
+		parallel = 1
+	}
+	// 审计的id在这里分配，避免并发取序列
+	batches := make(chan *insertBatch, (len(mds)+batch-1)/batch)
 	for i := 0; i < len(mds); i = i + batch {
-		for j := 0; j < batch; j++ {
-			if i+j < len(mds) {
-				md := mds[i+j]
-				ms = append(ms, md)
-			}
+		end := i + batch
+		if end > len(mds) {
+			end = len(mds)
 		}
-		c, err := this.Insert(ms...)
+		batches <- &insertBatch{mds: mds[i:end], auditor: this.newAuditor(mds[i:end]...)}
+	}
+	close(batches)
+	if parallel > len(batches) {
+		parallel = len(batches)
+	}
+	var count int64
+	var failure error
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				lock.Lock()
+				stopped := failure != nil
+				lock.Unlock()
+				if stopped {
+					return
+				}
+				c, err := this.insertBatch(b, useCopy)
+				lock.Lock()
+				count = count + c
+				if err != nil && failure == nil {
+					failure = err
+				}
+				lock.Unlock()
+				if err == nil {
+					logger.Sugar.Infof("Insert database record:%v", c)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if failure != nil {
+		logger.Sugar.Errorf("Insert database error:%v", failure.Error())
+	}
+
+	return count, failure
+}
+
+type insertBatch struct {
+	mds     []interface{}
+	auditor *auditor
+}
+
+// 在一个事务中用一条语句新增一批实体
+func (this *OrmBaseService) insertBatch(b *insertBatch, useCopy bool) (int64, error) {
+	lc := this.newLifecycle()
+	affected, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
+		affected, err := lc.run(session, baseentity.AuditOperation_Insert, b.mds, func() (int64, error) {
+			return session.BatchInsert(b.mds, useCopy)
+		})
 		if err != nil {
-			logger.Sugar.Errorf("Insert database error:%v", err.Error())
-			return count, err
-		} else {
-			logger.Sugar.Infof("Insert database record:%v", len(ms))
+			return 0, err
 		}
-		count = count + c
-		ms = make([]interface{}, 0)
+		err = b.auditor.record(session, baseentity.AuditOperation_Insert, nil, b.mds)
+
+		return affected, err
+	})
+	lc.done(err)
+	if err != nil || affected == nil {
+		return 0, err
 	}
 
-	return count, nil
+	return affected.(int64), nil
 }
 
 // update model to database.
 // cols set the columns those want to update.
 func (this *OrmBaseService) Update(md interface{}, columns []string, conds string, params ...interface{}) (int64, error) {
+	if this.stampUser(md, false) {
+		columns = withUpdateUser(columns)
+	}
+	var err error
+	if conds != "" && len(columns) == 0 {
+		err = baseentity.ValidatePresent(md)
+	} else {
+		err = baseentity.Validate(md, columns...)
+	}
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return 0, err
+	}
+	auditor := this.newAuditor(md)
+	lc := this.newLifecycle()
 	affected, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
 		var affected int64
-		affected, err := session.Update(md, columns, conds, params...)
+		// 实体的字段是修改的值，不是条件，没有条件的时候params是条件的实体
+		targets, olds, err := auditor.affected(session, md, func(rowsSlicePtr interface{}) error {
+			if conds == "" && len(params) > 0 {
+				return session.Find(rowsSlicePtr, params[0], "", 0, 0, "")
+			}
+			return session.Find(rowsSlicePtr, nil, "", 0, 0, conds, params...)
+		})
+		if err != nil {
+			return affected, err
+		}
+		affected, err = lc.run(session, baseentity.AuditOperation_Update, md, func() (int64, error) {
+			return session.Update(md, columns, conds, params...)
+		})
+		if err != nil {
+			return affected, err
+		}
+		err = auditor.record(session, baseentity.AuditOperation_Update, olds, targets)
 
 		return affected, err
 	})
+	lc.done(err)
 	if affected == nil || affected == 0 {
 		return 0, err
 	}
@@ -241,28 +466,50 @@ func (this *OrmBaseService) Update(md interface{}, columns []string, conds strin
 
 // Upsert model data to database by id field
 func (this *OrmBaseService) Upsert(mds ...interface{}) (int64, error) {
+	news := make([]bool, len(mds))
+	for i, md := range mds {
+		if !reflect.IsPtr(md) && !reflect.IsSlice(md) {
+			return 0, errors.New("DestinationNeedPtr")
+		}
+		news[i] = this.setId(md)
+		this.stampUser(md, news[i])
+		err := validate(md)
+		if err != nil {
+			return 0, err
+		}
+	}
+	auditor := this.newAuditor(mds...)
+	lc := this.newLifecycle()
 	affected, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
 		var affected int64
-		var err error
-		for _, md := range mds {
-			if !reflect.IsPtr(md) && !reflect.IsSlice(md) {
-				panic(errors.New("DestinationNeedPtr"))
-			}
-			ok := this.setId(md)
-			if ok {
-				affected, err = session.Insert(md)
+		for i, md := range mds {
+			var n int64
+			var err error
+			if news[i] {
+				n, err = lc.run(session, baseentity.AuditOperation_Insert, md, func() (int64, error) {
+					return session.Insert(md)
+				})
+				if err == nil {
+					err = auditor.record(session, baseentity.AuditOperation_Insert, nil, md)
+				}
 			} else {
-				affected, err = session.Update(md, nil, "")
+				olds := auditor.before(session, md)
+				n, err = lc.run(session, baseentity.AuditOperation_Update, md, func() (int64, error) {
+					return session.Update(md, nil, "")
+				})
+				if err == nil {
+					err = auditor.record(session, baseentity.AuditOperation_Update, olds, md)
+				}
 			}
 			if err != nil {
 				return 0, err
-			} else {
-				affected++
 			}
+			affected = affected + n
 		}
 		// return nil will commit the whole transaction
-		return affected, err
+		return affected, nil
 	})
+	lc.done(err)
 	if affected == nil || affected == 0 {
 		return 0, err
 	}
@@ -270,16 +517,102 @@ func (this *OrmBaseService) Upsert(mds ...interface{}) (int64, error) {
 	return affected.(int64), err
 }
 
+/*
+*
+按照冲突键批量新增或者修改，返回新增和修改的记录数，用于数据同步
+postgres和sqlite使用INSERT ... ON CONFLICT DO UPDATE，其他数据库逐条处理，见DbSession.UpsertBatch
+conflictColumns必须是唯一索引或者主键，已有的记录修改updateColumns，为空的时候修改冲突键，主键和创建信息以外的所有字段
+每批1000条，所有的批次在一个事务中，不调用实体的钩子，也不记录审计
+冲突键重复的实体不能在一次调用中，返回repository.ErrDuplicateConflictKey
+*/
+func (this *OrmBaseService) UpsertBatch(mds []interface{}, conflictColumns []string, updateColumns []string) (int64, int64, error) {
+	stamped := false
+	for _, md := range mds {
+		if !reflect.IsPtr(md) {
+			return 0, 0, errors.New("DestinationNeedPtr")
+		}
+		this.setId(md)
+		stamped = this.stampUser(md, true) || stamped
+		err := validate(md)
+		if err != nil {
+			return 0, 0, err
+		}
+		err = this.stampTenant(md)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if stamped {
+		updateColumns = withUpdateUser(updateColumns)
+	}
+	// 冲突键重复的时候新增和修改的记录数不准确，分批之前整体检查
+	_, err := repository.ConflictKeys(mds, conflictColumns)
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return 0, 0, err
+	}
+	restores := make([]func(), 0, len(mds))
+	defer func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}()
+	for _, md := range mds {
+		restore, err := sealEntity(baseentity.AuditOperation_Insert, md)
+		if err != nil {
+			return 0, 0, err
+		}
+		restores = append(restores, restore)
+	}
+	batch := 1000
+	var inserted, updated int64
+	_, err = this.Transaction(func(session repository.DbSession) (interface{}, error) {
+		for i := 0; i < len(mds); i = i + batch {
+			end := i + batch
+			if end > len(mds) {
+				end = len(mds)
+			}
+			n, m, err := session.UpsertBatch(mds[i:end], conflictColumns, updateColumns)
+			if err != nil {
+				return nil, err
+			}
+			inserted = inserted + n
+			updated = updated + m
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return inserted, updated, nil
+}
+
 // delete model in database
 // Delete records, bean's non-empty fields are conditions
 func (this *OrmBaseService) Delete(md interface{}, conds string, params ...interface{}) (int64, error) {
+	auditor := this.newAuditor(md)
+	lc := this.newLifecycle()
 	affected, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
 		var affected int64
-		var err error
-		affected, err = session.Delete(md, conds, params...)
+		// 没有id的时候实体的非空字段和条件一起作为删除的条件
+		targets, olds, err := auditor.affected(session, md, func(rowsSlicePtr interface{}) error {
+			return session.Find(rowsSlicePtr, md, "", 0, 0, conds, params...)
+		})
+		if err != nil {
+			return affected, err
+		}
+		affected, err = lc.run(session, baseentity.AuditOperation_Delete, md, func() (int64, error) {
+			return session.Delete(md, conds, params...)
+		})
+		if err != nil {
+			return affected, err
+		}
+		err = auditor.record(session, baseentity.AuditOperation_Delete, olds, targets)
 		// return nil will commit the whole transaction
 		return affected, err
 	})
+	lc.done(err)
 	if affected == nil || affected == 0 {
 		return 0, err
 	}
@@ -289,32 +622,68 @@ func (this *OrmBaseService) Delete(md interface{}, conds string, params ...inter
 
 // save model data to database by state field
 func (this *OrmBaseService) Save(mds ...interface{}) (int64, error) {
+	for _, md := range mds {
+		if !reflect.IsPtr(md) && !reflect.IsSlice(md) {
+			return 0, errors.New("DestinationNeedPtr")
+		}
+		state, _ := reflect.GetValue(md, "State")
+		if state == baseentity.EntityState_New {
+			this.setId(md)
+			this.stampUser(md, true)
+		} else if state == baseentity.EntityState_Modified {
+			this.stampUser(md, false)
+		}
+		if state == baseentity.EntityState_New || state == baseentity.EntityState_Modified {
+			err := validate(md)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	auditor := this.newAuditor(mds...)
+	lc := this.newLifecycle()
 	affected, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
 		var affected int64
 		var err error
 		for _, md := range mds {
-			if !reflect.IsPtr(md) && !reflect.IsSlice(md) {
-				panic(errors.New("DestinationNeedPtr"))
-			}
+			var n int64
 			state, _ := reflect.GetValue(md, "State")
 			if state != nil {
 				switch state {
 				case baseentity.EntityState_New:
-					this.setId(md)
-					affected, err = session.Insert(md)
+					n, err = lc.run(session, baseentity.AuditOperation_Insert, md, func() (int64, error) {
+						return session.Insert(md)
+					})
+					if err == nil {
+						err = auditor.record(session, baseentity.AuditOperation_Insert, nil, md)
+					}
 				case baseentity.EntityState_Modified:
-					affected, err = session.Update(md, nil, "")
+					olds := auditor.before(session, md)
+					n, err = lc.run(session, baseentity.AuditOperation_Update, md, func() (int64, error) {
+						return session.Update(md, nil, "")
+					})
+					if err == nil {
+						err = auditor.record(session, baseentity.AuditOperation_Update, olds, md)
+					}
 				case baseentity.EntityState_Deleted:
-					affected, err = session.Delete(md, "")
+					olds := auditor.before(session, md)
+					n, err = lc.run(session, baseentity.AuditOperation_Delete, md, func() (int64, error) {
+						return session.Delete(md, "")
+					})
+					if err == nil {
+						err = auditor.record(session, baseentity.AuditOperation_Delete, olds, md)
+					}
 				}
 			}
 			if err != nil {
 				return 0, err
 			}
+			affected = affected + n
 		}
 		// return nil will commit the whole transaction
 		return affected, err
 	})
+	lc.done(err)
 	if affected == nil || affected == 0 {
 		return 0, err
 	}
@@ -322,6 +691,104 @@ func (this *OrmBaseService) Save(mds ...interface{}) (int64, error) {
 	return affected.(int64), err
 }
 
+/*
+*
+保存工作单元中变化的实体，ec是登记了对象图的EntityContext
+新增的实体插入，修改的实体只更新修改过的字段，删除的实体删除，都在一个事务中
+保存成功之后重新记录快照，保存失败的时候快照不变，可以修改之后重新保存
+*/
+func (this *OrmBaseService) SaveContext(ec *baseentity.EntityContext) (int64, error) {
+	diffs, err := ec.GetSyncInfo()
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+		return 0, err
+	}
+	affected, err := this.saveDiffs(diffs)
+	if err != nil {
+		return 0, err
+	}
+	ec.Refresh()
+
+	return affected, nil
+}
+
+// 按照顺序在一个事务中保存实体的变化，Modified的时候只更新Columns，Columns为nil的时候更新所有的字段
+func (this *OrmBaseService) saveDiffs(diffs []*baseentity.EntityDiff) (int64, error) {
+	if len(diffs) == 0 {
+		return 0, nil
+	}
+	mds := make([]interface{}, 0, len(diffs))
+	stamped := make([]bool, len(diffs))
+	for i, diff := range diffs {
+		md := diff.Entity()
+		var err error
+		switch diff.State() {
+		case baseentity.EntityState_New:
+			this.setId(md)
+			this.stampUser(md, true)
+			err = validate(md)
+		case baseentity.EntityState_Modified:
+			stamped[i] = this.stampUser(md, false)
+			err = validate(md, diff.Columns()...)
+		}
+		if err != nil {
+			return 0, err
+		}
+		mds = append(mds, md)
+	}
+	auditor := this.newAuditor(mds...)
+	lc := this.newLifecycle()
+	affected, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
+		var affected int64
+		for i, diff := range diffs {
+			md := diff.Entity()
+			var n int64
+			var err error
+			switch diff.State() {
+			case baseentity.EntityState_New:
+				n, err = lc.run(session, baseentity.AuditOperation_Insert, md, func() (int64, error) {
+					return session.Insert(md)
+				})
+				if err == nil {
+					err = auditor.record(session, baseentity.AuditOperation_Insert, nil, md)
+				}
+			case baseentity.EntityState_Modified:
+				columns := diff.Columns()
+				if columns != nil && stamped[i] {
+					columns = withUpdateUser(columns)
+				}
+				olds := auditor.before(session, md)
+				n, err = lc.run(session, baseentity.AuditOperation_Update, md, func() (int64, error) {
+					return session.Update(md, columns, "")
+				})
+				if err == nil {
+					err = auditor.record(session, baseentity.AuditOperation_Update, olds, md)
+				}
+			case baseentity.EntityState_Deleted:
+				olds := auditor.before(session, md)
+				n, err = lc.run(session, baseentity.AuditOperation_Delete, md, func() (int64, error) {
+					return session.Delete(md, "")
+				})
+				if err == nil {
+					err = auditor.record(session, baseentity.AuditOperation_Delete, olds, md)
+				}
+			}
+			if err != nil {
+				return affected, err
+			}
+			affected += n
+		}
+		// return nil will commit the whole transaction
+		return affected, nil
+	})
+	lc.done(err)
+	if err != nil {
+		return 0, err
+	}
+
+	return affected.(int64), nil
+}
+
 // execute sql and get result
 func (this *OrmBaseService) Exec(clause string, params ...interface{}) (sql.Result, error) {
 	result, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
@@ -338,7 +805,7 @@ func (this *OrmBaseService) Exec(clause string, params ...interface{}) (sql.Resu
 
 // execute sql and get result
 func (this *OrmBaseService) Query(clause string, params ...interface{}) ([]map[string][]byte, error) {
-	result, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
+	result, err := this.read(false, func(session repository.DbSession) (interface{}, error) {
 		result, err := session.Query(clause, params...)
 
 		// return nil will commit the whole transaction
@@ -352,10 +819,15 @@ func (this *OrmBaseService) Query(clause string, params ...interface{}) ([]map[s
 }
 
 func (this *OrmBaseService) Count(bean interface{}, conds string, params ...interface{}) (int64, error) {
-	result, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
+	result, err := this.read(false, func(session repository.DbSession) (interface{}, error) {
 		if bean == nil {
 			return 0, errors.New("condiBean can't be nil")
 		}
+		err := encryptConds(bean)
+		if err != nil {
+			return 0, err
+		}
+		defer decryptEntity(bean)
 		result, err := session.Count(bean, conds, params...)
 
 		// return nil will commit the whole transaction
@@ -368,6 +840,276 @@ func (this *OrmBaseService) Count(bean interface{}, conds string, params ...inte
 	return result.(int64), err
 }
 
+// 按照条件获取一条记录，dest的非空字段也作为条件
+func (this *OrmBaseService) GetByCriteria(dest interface{}, locked bool, criteria *repository.Criteria) (bool, error) {
+	if !reflect.IsPtr(dest) {
+		return false, errors.New("DestinationNeedPtr")
+	}
+	criteria, err := encryptCriteria(dest, criteria)
+	if err != nil {
+		return false, err
+	}
+	err = encryptConds(dest)
+	if err != nil {
+		return false, err
+	}
+	get := func(session repository.DbSession, dest interface{}) (bool, error) {
+		return session.GetByCriteria(dest, locked, criteria)
+	}
+	result, err := this.read(locked, func(session repository.DbSession) (interface{}, error) {
+		result, err := get(session, dest)
+		if err == nil && !result {
+			err = this.checkGet(session, dest, get)
+		}
+		return result, err
+	})
+	err = decryptResult(dest, err)
+	this.deniedGet(dest, err)
+	if result == nil {
+		return false, err
+	}
+	return result.(bool), err
+}
+
+/*
+*
+按照条件查询，condiBean的非空字段和条件一起作为查询条件，条件中的排序作为查询的排序，比如
+
+	err := svc.FindByCriteria(&users, nil, repository.In("status", "Effective", "Draft").Sort("createdate", true), 0, 10)
+*/
+func (this *OrmBaseService) FindByCriteria(rowsSlicePtr interface{}, condiBean interface{}, criteria *repository.Criteria, from int, limit int) error {
+	var err error
+	if !reflect.IsPtr(rowsSlicePtr) {
+		err = errors.New("ResultNeedPtr")
+
+		return err
+	}
+	if condiBean != nil && !reflect.IsPtr(condiBean) {
+		err = errors.New("CondiBeanNeedPtr")
+
+		return err
+	}
+	criteria, err = encryptCriteria(rowsSlicePtr, criteria)
+	if err != nil {
+		return err
+	}
+	err = encryptConds(condiBean)
+	if err != nil {
+		return err
+	}
+	_, err = this.read(false, func(session repository.DbSession) (interface{}, error) {
+		err = session.FindByCriteria(rowsSlicePtr, condiBean, criteria, from, limit)
+
+		return nil, err
+	})
+	decryptEntity(condiBean)
+
+	return decryptResult(rowsSlicePtr, err)
+}
+
+func (this *OrmBaseService) CountByCriteria(bean interface{}, criteria *repository.Criteria) (int64, error) {
+	result, err := this.read(false, func(session repository.DbSession) (interface{}, error) {
+		if bean == nil {
+			return 0, errors.New("condiBean can't be nil")
+		}
+		criteria, err := encryptCriteria(bean, criteria)
+		if err != nil {
+			return 0, err
+		}
+		err = encryptConds(bean)
+		if err != nil {
+			return 0, err
+		}
+		defer decryptEntity(bean)
+		return session.CountByCriteria(bean, criteria)
+	})
+	if result == nil {
+		return 0, err
+	}
+
+	return result.(int64), err
+}
+
+// md的非空字段和条件一起作为删除的条件，和Delete一样调用钩子和监听器，检查访问策略，提交以后发布事件
+func (this *OrmBaseService) DeleteByCriteria(md interface{}, criteria *repository.Criteria) (int64, error) {
+	criteria, err := encryptCriteria(md, criteria)
+	if err != nil {
+		return 0, err
+	}
+	err = encryptConds(md)
+	if err != nil {
+		return 0, err
+	}
+	defer decryptEntity(md)
+	auditor := this.newAuditor(md)
+	lc := this.newLifecycle()
+	affected, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
+		// 在事务中读取条件匹配的记录，钩子，监听器，访问策略和审计都针对这些记录
+		rows := goreflect.New(goreflect.SliceOf(goreflect.TypeOf(md)))
+		err := session.FindByCriteria(rows.Interface(), md, criteria.Unordered(), 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		olds := reflect.ToArray(rows.Interface())
+		if len(olds) == 0 {
+			return int64(0), nil
+		}
+		err = decryptEntity(olds)
+		if err != nil {
+			return nil, err
+		}
+		auditor.reserve(session, len(olds))
+		affected, err := lc.run(session, baseentity.AuditOperation_Delete, olds, func() (int64, error) {
+			return session.DeleteByCriteria(md, criteria)
+		})
+		if err != nil {
+			return affected, err
+		}
+		err = auditor.record(session, baseentity.AuditOperation_Delete, olds, olds)
+
+		return affected, err
+	})
+	lc.done(err)
+	if affected == nil {
+		return 0, err
+	}
+
+	return affected.(int64), err
+}
+
+/*
+*
+流式查询，逐条处理满足条件的记录，不需要把全部结果加载到内存，condiBean为nil的时候查询全部记录
+每批读取的记录数由BatchSize决定，fn返回错误或者ctx取消的时候停止处理
+*/
+func (this *OrmBaseService) FindIter(ctx context.Context, condiBean interface{}, criteria *repository.Criteria, fn func(row interface{}) error) error {
+	var err error
+	if condiBean == nil {
+		condiBean, err = this.NewEntity(nil)
+		if err != nil {
+			return err
+		}
+	} else if !reflect.IsPtr(condiBean) {
+		err = errors.New("CondiBeanNeedPtr")
+
+		return err
+	}
+	batchSize := this.BatchSize
+	if batchSize <= 0 {
+		batchSize = config.GetDatabaseParams(this.DbName).BatchSize
+	}
+	criteria, err = encryptCriteria(condiBean, criteria)
+	if err != nil {
+		return err
+	}
+	err = encryptConds(condiBean)
+	if err != nil {
+		return err
+	}
+	defer decryptEntity(condiBean)
+	_, err = this.read(false, func(session repository.DbSession) (interface{}, error) {
+		err = session.WithContext(ctx).Iterate(ctx, condiBean, criteria, batchSize, func(row interface{}) error {
+			err := decryptEntity(row)
+			if err != nil {
+				return err
+			}
+			return fn(row)
+		})
+
+		return nil, err
+	})
+
+	return err
+}
+
+/*
+*
+游标分页，按照条件的排序加上主键排序，cursor为空字符串的时候取第一页，否则取游标指向的页
+返回的Page.Data是结构数组的指针，NextCursor和PrevCursor用于取下一页和上一页
+和from，limit的分页相比，深度翻页不需要扫描前面的记录，并发插入的时候也不会重复或者遗漏
+*/
+func (this *OrmBaseService) FindPage(condiBean interface{}, criteria *repository.Criteria, cursor string, pageSize int) (repository.Page, error) {
+	var page repository.Page
+	var err error
+	if pageSize <= 0 {
+		return page, errors.New("PageSizeInvalid")
+	}
+	prototype := condiBean
+	if prototype == nil {
+		prototype, err = this.NewEntity(nil)
+		if err != nil {
+			return page, err
+		}
+	} else if !reflect.IsPtr(condiBean) {
+		return page, errors.New("CondiBeanNeedPtr")
+	}
+	orders := repository.KeysetOrders(criteria)
+	c, direction, err := repository.KeysetCriteria(prototype, criteria, orders, cursor)
+	if err != nil {
+		return page, err
+	}
+	rowsSlicePtr := goreflect.New(goreflect.SliceOf(goreflect.TypeOf(prototype)))
+	// 多取一条判断是否还有数据
+	err = this.FindByCriteria(rowsSlicePtr.Interface(), condiBean, c, 0, pageSize+1)
+	if err != nil {
+		return page, err
+	}
+	rows := rowsSlicePtr.Elem()
+	more := rows.Len() > pageSize
+	if more {
+		rows.Set(rows.Slice(0, pageSize))
+	}
+	n := rows.Len()
+	if direction == repository.Cursor_Prev {
+		for i := 0; i < n/2; i++ {
+			t := rows.Index(i).Interface()
+			rows.Index(i).Set(rows.Index(n - 1 - i))
+			rows.Index(n - 1 - i).Set(goreflect.ValueOf(t))
+		}
+	}
+	page.Data = rowsSlicePtr.Interface()
+	if n == 0 {
+		return page, nil
+	}
+	if (direction == repository.Cursor_Next && more) || direction == repository.Cursor_Prev {
+		page.NextCursor, err = repository.EncodeCursor(rows.Index(n-1).Interface(), orders, repository.Cursor_Next)
+		if err != nil {
+			return page, err
+		}
+	}
+	if (direction == repository.Cursor_Prev && more) || (direction == repository.Cursor_Next && cursor != "") {
+		page.PrevCursor, err = repository.EncodeCursor(rows.Index(0).Interface(), orders, repository.Cursor_Prev)
+		if err != nil {
+			return page, err
+		}
+	}
+
+	return page, nil
+}
+
+/*
+*
+只读的操作，不在写事务中的时候使用只读副本的会话，不开启事务
+以下情况仍然在主库的事务中执行：ctx中已经有这个数据库的事务，配置了readtransaction，或者需要加锁
+*/
+func (this *OrmBaseService) read(locked bool, fc func(s repository.DbSession) (interface{}, error)) (interface{}, error) {
+	dbName := this.dbName()
+	if locked || getTxState(this.ctx, dbName) != nil || config.GetDatabaseParams(dbName).Readtransaction {
+		return this.Transaction(fc)
+	}
+	var session = GetDbReadSession(dbName)
+	if this.ctx != nil {
+		session = session.WithContext(this.ctx)
+	}
+	defer session.Close()
+	result, err := fc(this.scoped(session))
+	if err != nil {
+		logger.Sugar.Errorf("Exception:%v", err.Error())
+	}
+
+	return result, err
+}
+
 /*
 *
 
@@ -379,16 +1121,29 @@ func (this *OrmBaseService) Count(bean interface{}, conds string, params ...inte
 	        }
 		})
 */
-func (this *OrmBaseService) Transaction(fc func(s repository.DbSession) (interface{}, error)) (interface{}, error) {
+func (this *OrmBaseService) Transaction(fc func(s repository.DbSession) (interface{}, error)) (result interface{}, err error) {
 	id := security.UUID()
 	msg := fmt.Sprintf("XORM Transaction %v :", id)
 	fn := debug.TraceDebug(msg)
 	defer fn()
+	// ctx中已经有这个数据库的事务的时候加入这个事务
+	dbName := this.dbName()
+	state := getTxState(this.ctx, dbName)
+	if state != nil {
+		return state.nest(func(s repository.DbSession) (interface{}, error) {
+			return fc(this.scoped(s))
+		})
+	}
 	//先获取新会话
-	var session = GetSession()
-	var err error
+	var session = GetDbSession(dbName)
+	if this.ctx != nil {
+		session = session.WithContext(this.ctx)
+	}
 	defer session.Close()
 	err = session.Begin()
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		if p := recover(); p != nil {
 			logger.Sugar.Errorf("recover rollback:%s\r\n", p)
@@ -402,7 +1157,7 @@ func (this *OrmBaseService) Transaction(fc func(s repository.DbSession) (interfa
 		}
 	}()
 	// 执行在事务内的处理
-	result, err := fc(session)
+	result, err = fc(this.scoped(session))
 	if err != nil {
 		logger.Sugar.Errorf("Exception:%v", err.Error())
 	}
@@ -429,22 +1184,42 @@ func (this *OrmBaseService) Import(filenames []string) error {
 	return nil
 }
 
+// 导出excel格式的数据，逐条读取写入，不需要先把全部数据加载到切片中
 func (this *OrmBaseService) Export(condiBean interface{}) ([]byte, error) {
-	rowsSlicePtr, err := this.NewEntities(nil)
+	writer := excel.NewWriter("result")
+	err := this.FindIter(this.Context(), condiBean, nil, func(row interface{}) error {
+		return writer.Append(row)
+	})
 	if err != nil {
-
+		return nil, err
 	}
-	this.Find(rowsSlicePtr, condiBean, "", 0, 0, "")
 
-	return excel.Write(rowsSlicePtr)
+	return writer.Bytes()
 }
 
+// 获取缺省数据库的新会话
 func GetSession() repository.DbSession {
-	var session repository.DbSession
-	if config.DatabaseParams.Orm == "xorm" {
-		session = xorm.NewXormSession()
-	} else if config.DatabaseParams.Orm == "gorm" {
-		session = gorm.NewGormSession()
+	return GetDbSession("")
+}
+
+/*
+*
+获取命名数据库的新会话，数据库的驱动由database.<name>.orm决定，在第一次使用的时候打开
+*/
+func GetDbSession(dbname string) repository.DbSession {
+	session, err := repository.NewSession(dbname)
+	if err != nil {
+		panic(err)
+	}
+
+	return session
+}
+
+// 只读的会话，配置了只读副本的时候使用健康的副本，否则使用主库
+func GetDbReadSession(dbname string) repository.DbSession {
+	session, err := repository.NewReadSession(dbname)
+	if err != nil {
+		panic(err)
 	}
 
 	return session
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"testing"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+type pageRow struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	Rank                  int
+}
+
+func (pageRow) TableName() string {
+	return "test_page"
+}
+
+func TestFindPage(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(pageRow))
+		// 按照Rank降序，Rank相同的时候按照id升序
+		for i := 1; i <= 7; i++ {
+			row := &pageRow{Rank: i % 3}
+			row.Id = uint64(i)
+			_, err := svc.Insert(row)
+			if err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+		}
+		criteria := repository.Sort("rank", true)
+		expected := []string{"[2 5 1]", "[4 7 3]", "[6]"}
+		cursor := ""
+		pages := make([]repository.Page, 0)
+		for i, want := range expected {
+			page, err := svc.FindPage(new(pageRow), criteria, cursor, 3)
+			if err != nil {
+				t.Fatalf("page %v: %v", i, err)
+			}
+			if got := idsOf(page.Data); got != want {
+				t.Fatalf("page %v: %v, want %v", i, got, want)
+			}
+			if (page.PrevCursor == "") != (i == 0) || (page.NextCursor == "") != (i == len(expected)-1) {
+				t.Fatalf("page %v cursors: %q %q", i, page.PrevCursor, page.NextCursor)
+			}
+			pages = append(pages, page)
+			cursor = page.NextCursor
+		}
+		// 从最后一页往前翻
+		cursor = pages[2].PrevCursor
+		for i := 1; i >= 0; i-- {
+			page, err := svc.FindPage(new(pageRow), criteria, cursor, 3)
+			if err != nil {
+				t.Fatalf("prev page %v: %v", i, err)
+			}
+			if got := idsOf(page.Data); got != expected[i] {
+				t.Fatalf("prev page %v: %v, want %v", i, got, expected[i])
+			}
+			cursor = page.PrevCursor
+		}
+		if cursor != "" {
+			t.Fatalf("first page has prev cursor")
+		}
+		// 翻页的时候插入的记录不影响后面的页
+		row := &pageRow{Rank: 2}
+		row.Id = 8
+		svc.Insert(row)
+		page, err := svc.FindPage(new(pageRow), criteria, pages[0].NextCursor, 3)
+		if err != nil || idsOf(page.Data) != expected[1] {
+			t.Fatalf("after insert: %v %v", idsOf(page.Data), err)
+		}
+		_, err = svc.FindPage(new(pageRow), criteria, "bad", 3)
+		if err == nil {
+			t.Fatalf("invalid cursor accepted")
+		}
+	})
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/repository"
+	goreflect "reflect"
+	"sync"
+	"time"
+)
+
+// 访问被拒绝的事件的主题，事件的Entity是实体，Payload是*AccessDenial
+const EventTopic_AccessDenied = "AccessDenied"
+
+// 数据访问策略拒绝了操作，使用errors.Is判断，errors.As取得*AccessDenial
+var ErrAccessDenied = errors.New("AccessDenied")
+
+// 被拒绝的读取的操作，修改和删除使用AuditOperation_Update和AuditOperation_Delete
+const AccessOperation_Get = "Get"
+
+/*
+*
+数据访问的策略，根据主体返回实体的附加条件，返回nil的时候不限制
+条件加在Get，Find，Count，Update，Delete和Iterate上，md是实体的指针，只用于判断实体的类型和字段
+ctx中没有主体的时候不使用策略，用于后台任务和系统管理
+*/
+type Policy func(ctx context.Context, principal *Principal, md interface{}) *repository.Criteria
+
+// 一次被策略拒绝的访问
+type AccessDenial struct {
+	Operation  string
+	EntityType string
+	EntityKey  string
+	UserId     string
+	Date       time.Time
+}
+
+func (this *AccessDenial) Error() string {
+	return fmt.Sprintf("%v: %v %v %v by user %v", ErrAccessDenied.Error(), this.Operation, this.EntityType, this.EntityKey, this.UserId)
+}
+
+func (this *AccessDenial) Unwrap() error {
+	return ErrAccessDenied
+}
+
+// 键是实体的类型，nil是所有实体的策略
+var policies = make(map[goreflect.Type][]Policy)
+
+var policyLock sync.RWMutex
+
+/*
+*
+登记实体类型的数据访问策略，md是实体的指针或者实体，md为nil的时候对所有的实体有效
+同一个实体的多个策略是And的关系，比如
+
+	service.RegistPolicy(new(entity.Contract), service.OwnerPolicy("OrgId"))
+*/
+func RegistPolicy(md interface{}, policy Policy) {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+	typ := indirectType(md)
+	policies[typ] = append(policies[typ], policy)
+}
+
+func getPolicies(md interface{}) []Policy {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	ps := make([]Policy, 0)
+	ps = append(ps, policies[nil]...)
+
+	return append(ps, policies[indirectType(md)]...)
+}
+
+func hasPolicies() bool {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+
+	return len(policies) > 0
+}
+
+/*
+*
+只能访问自己创建的记录，orgField不为空的时候也可以访问本机构的记录，也就是
+CreateUserId = 我 OR <orgField> = 我的机构
+实体没有CreateUserId字段的时候不限制
+*/
+func OwnerPolicy(orgField string) Policy {
+	return func(ctx context.Context, principal *Principal, md interface{}) *repository.Criteria {
+		typ := indirectType(md)
+		_, ok := typ.FieldByName(baseentity.FieldName_CreateUserId)
+		if !ok {
+			return nil
+		}
+		criteria := repository.Eq(baseentity.FieldName_CreateUserId, principal.UserId)
+		if orgField == "" || principal.OrgId == "" {
+			return criteria
+		}
+		_, ok = typ.FieldByName(orgField)
+		if !ok {
+			return criteria
+		}
+
+		return repository.Or(criteria, repository.Eq(orgField, principal.OrgId))
+	}
+}
+
+/*
+*
+ctx中主体的数据访问策略的过滤条件，没有主体或者没有登记策略的时候返回nil
+*/
+func (this *OrmBaseService) policyFilter() repository.Filter {
+	principal := GetPrincipal(this.ctx)
+	if principal == nil || !hasPolicies() {
+		return nil
+	}
+	ctx := this.Context()
+
+	return func(md interface{}) *repository.Criteria {
+		criterias := make([]*repository.Criteria, 0)
+		for _, policy := range getPolicies(md) {
+			criteria := policy(ctx, principal, md)
+			if criteria.HasCondition() {
+				criterias = append(criterias, criteria)
+			}
+		}
+		if len(criterias) == 0 {
+			return nil
+		}
+		return repository.And(criterias...)
+	}
+}
+
+/*
+*
+检查按照id访问的实体是否被策略拒绝，也就是在策略的条件下找不到，去掉策略以后能够找到
+被拒绝的时候返回*AccessDenial，没有id的实体按照条件访问，不满足策略的记录只是被过滤，不算拒绝
+*/
+func (this *OrmBaseService) checkAccess(session repository.DbSession, operation string, md interface{}) error {
+	if this.policyFilter() == nil {
+		return nil
+	}
+	for _, m := range entities(md) {
+		_, ok := repository.GetId(m)
+		if !ok || load(session, m) != nil {
+			continue
+		}
+		if load(this.unpolicied(session), m) != nil {
+			return this.denial(operation, m)
+		}
+	}
+
+	return nil
+}
+
+/*
+*
+Get没有找到的时候，去掉策略用dest的副本重新查询，能够找到的时候说明被策略拒绝
+*/
+func (this *OrmBaseService) checkGet(session repository.DbSession, dest interface{}, get func(session repository.DbSession, dest interface{}) (bool, error)) error {
+	if this.policyFilter() == nil {
+		return nil
+	}
+	probe := goreflect.New(goreflect.TypeOf(dest).Elem())
+	probe.Elem().Set(goreflect.ValueOf(dest).Elem())
+	found, err := get(this.unpolicied(session), probe.Interface())
+	if err != nil || !found {
+		return err
+	}
+
+	return this.denial(AccessOperation_Get, probe.Interface())
+}
+
+// 去掉策略的会话，租户的条件仍然有效，其他租户的记录是不存在而不是被拒绝
+func (this *OrmBaseService) unpolicied(session repository.DbSession) repository.DbSession {
+	raw := session.Unfiltered()
+	filter := this.tenantFilter()
+	if filter != nil {
+		raw = raw.Filter(filter)
+	}
+
+	return raw
+}
+
+func (this *OrmBaseService) denial(operation string, md interface{}) *AccessDenial {
+	denial := &AccessDenial{Operation: operation, EntityType: entityType(md), Date: time.Now()}
+	id, ok := repository.GetId(md)
+	if ok {
+		denial.EntityKey = fmt.Sprint(id)
+	}
+	principal := GetPrincipal(this.ctx)
+	if principal != nil {
+		denial.UserId = principal.UserId
+	}
+
+	return denial
+}
+
+// Get被拒绝的时候记录
+func (this *OrmBaseService) deniedGet(dest interface{}, err error) {
+	var denial *AccessDenial
+	if errors.As(err, &denial) {
+		this.recordDenials([]interface{}{dest}, []*AccessDenial{denial})
+	}
+}
+
+/*
+*
+记录被拒绝的访问，写日志，发布EventTopic_AccessDenied事件，服务打开审计的时候在bas_audit中写一条Deny记录
+被拒绝的操作已经回滚，所以审计记录在单独的事务中写，ctx中有外层事务的时候，外层事务一般也会因为拒绝的错误回滚，
+而且单写的数据库在外层事务结束之前不能开始新的写事务，所以等外层事务结束以后再写，不管外层事务提交还是回滚
+*/
+func (this *OrmBaseService) recordDenials(mds []interface{}, denials []*AccessDenial) {
+	if len(denials) == 0 {
+		return
+	}
+	ctx := this.Context()
+	for i, denial := range denials {
+		logger.Sugar.Warnf("%v", denial.Error())
+		Publish(ctx, &Event{Topic: EventTopic_AccessDenied, Entity: mds[i], Payload: denial})
+	}
+	if !this.Audit {
+		return
+	}
+	state := getTxState(this.ctx, this.dbName())
+	if state != nil {
+		state.finally = append(state.finally, func(ctx context.Context) {
+			s := *this
+			s.ctx = withoutTx(ctx, s.dbName(), "")
+			s.auditDenials(denials)
+		})
+		return
+	}
+	s := *this
+	s.ctx = withoutTx(ctx, s.dbName(), "")
+	s.auditDenials(denials)
+}
+
+// 在新的事务中写拒绝的审计记录，ctx中不能有外层事务
+func (this *OrmBaseService) auditDenials(denials []*AccessDenial) {
+	syncAuditTable(this.dbName())
+	auditSeq.Do(func() {
+		RegistSeq(seqname, 0)
+	})
+	ids := GetAuditService().WithContext(this.ctx).GetSeqs(len(denials))
+	_, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
+		for i, denial := range denials {
+			bs, err := json.Marshal(map[string]string{"operation": denial.Operation})
+			if err != nil {
+				return nil, err
+			}
+			audit := &baseentity.Audit{
+				EntityType: denial.EntityType,
+				EntityKey:  denial.EntityKey,
+				Operation:  baseentity.AuditOperation_Deny,
+				UserId:     denial.UserId,
+				Diff:       string(bs),
+			}
+			if i < len(ids) {
+				audit.Id = ids[i]
+			}
+			_, err = session.Insert(audit)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		logger.Sugar.Errorf("%v", err.Error())
+	}
+}
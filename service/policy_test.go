@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+type policyRow struct {
+	baseentity.UserEntity `xorm:"extends"`
+	OrgId                 string `xorm:"varchar(32)"`
+	Name                  string `xorm:"varchar(32)"`
+}
+
+func (policyRow) TableName() string {
+	return "test_policy"
+}
+
+func TestOwnerPolicy(t *testing.T) {
+	RegistPolicy(new(policyRow), OwnerPolicy("OrgId"))
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(policyRow))
+		svc.Audit = true
+		u1 := svc.WithPrincipal(&Principal{UserId: "u1", OrgId: "o1"})
+		u2 := svc.WithPrincipal(&Principal{UserId: "u2", OrgId: "o2"})
+		u3 := svc.WithPrincipal(&Principal{UserId: "u3", OrgId: "o1"})
+		for i, s := range []BaseService{u1, u2, u3} {
+			row := &policyRow{Name: "row"}
+			row.Id = uint64(i + 1)
+			row.OrgId = []string{"o1", "o2", "o1"}[i]
+			_, err := s.Insert(row)
+			if err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+		}
+		find := func(s BaseService) string {
+			rows := make([]*policyRow, 0)
+			err := s.FindByCriteria(&rows, nil, repository.Sort("id", false), 0, 0)
+			if err != nil {
+				t.Fatalf("find: %v", err)
+			}
+			return idsOf(rows)
+		}
+		// 自己创建的和本机构的记录
+		if find(u1) != "[1 3]" || find(u2) != "[2]" {
+			t.Fatalf("find: %v %v", find(u1), find(u2))
+		}
+		// 没有主体的时候不使用策略
+		if find(svc) != "[1 2 3]" {
+			t.Fatalf("without principal: %v", find(svc))
+		}
+		row := &policyRow{}
+		row.Id = 1
+		found, err := u2.Get(row, false, "", "")
+		var denial *AccessDenial
+		if found || !errors.As(err, &denial) || denial.Operation != AccessOperation_Get || denial.UserId != "u2" {
+			t.Fatalf("get: %v %v", found, err)
+		}
+		row = &policyRow{Name: "changed"}
+		row.Id = 1
+		_, err = u2.Update(row, []string{"Name"}, "")
+		if !errors.Is(err, ErrAccessDenied) {
+			t.Fatalf("update: %v", err)
+		}
+		_, err = u2.Delete(row, "")
+		if !errors.Is(err, ErrAccessDenied) {
+			t.Fatalf("delete: %v", err)
+		}
+		count, err := u2.CountByCriteria(new(policyRow), nil)
+		if err != nil || count != 1 {
+			t.Fatalf("count: %v %v", count, err)
+		}
+		// 不存在的记录不是拒绝
+		row = &policyRow{}
+		row.Id = 9
+		found, err = u2.Get(row, false, "", "")
+		if found || err != nil {
+			t.Fatalf("missing: %v %v", found, err)
+		}
+		got := &policyRow{}
+		got.Id = 1
+		found, err = svc.Get(got, false, "", "")
+		if err != nil || !found || got.Name != "row" {
+			t.Fatalf("denied update wrote: %v %v %+v", found, err, got)
+		}
+		audits, err := svc.History(got)
+		if err != nil {
+			t.Fatalf("history: %v", err)
+		}
+		denied := countDenied(audits, "u2")
+		if denied != 3 {
+			t.Fatalf("deny audits: %v", denied)
+		}
+		// 拒绝的错误让外层事务回滚，审计记录仍然要写
+		err = u2.RunInTransaction(WithPrincipal(context.Background(), &Principal{UserId: "u2", OrgId: "o2"}), func(ctx context.Context) error {
+			row := &policyRow{Name: "changed"}
+			row.Id = 1
+			_, err := u2.WithContext(ctx).Update(row, []string{"Name"}, "")
+			return err
+		})
+		if !errors.Is(err, ErrAccessDenied) {
+			t.Fatalf("update in transaction: %v", err)
+		}
+		audits, err = svc.History(got)
+		if err != nil {
+			t.Fatalf("history: %v", err)
+		}
+		if countDenied(audits, "u2") != denied+1 {
+			t.Fatalf("deny audit in transaction: %v", countDenied(audits, "u2"))
+		}
+	})
+}
+
+func countDenied(audits []*baseentity.Audit, userId string) int {
+	denied := 0
+	for _, audit := range audits {
+		if audit.Operation == baseentity.AuditOperation_Deny && audit.UserId == userId {
+			denied++
+		}
+	}
+
+	return denied
+}
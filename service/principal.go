@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/util/reflect"
+	"strings"
+)
+
+/*
+*
+请求的主体，也就是当前登录的用户，由web层在请求开始的时候放到ctx中，比如
+
+	ctx := service.WithPrincipal(r.Context(), &service.Principal{UserId: userId, OrgId: orgId})
+	_, err := svc.WithContext(ctx).Insert(org)
+
+新增和修改的时候用UserId填写UserEntity的CreateUserId和UpdateUserId
+*/
+type Principal struct {
+	UserId   string
+	OrgId    string
+	TenantId string
+	Roles    []string
+}
+
+type principalKey struct{}
+
+// 返回带有主体的ctx
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// ctx中的主体，没有的时候返回nil
+func GetPrincipal(ctx context.Context) *Principal {
+	if ctx == nil {
+		return nil
+	}
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+
+	return principal
+}
+
+// 返回使用主体的服务，和WithContext一样返回OrmBaseService的副本
+func (this *OrmBaseService) WithPrincipal(principal *Principal) BaseService {
+	s := *this
+	s.ctx = WithPrincipal(this.ctx, principal)
+
+	return &s
+}
+
+/*
+*
+用ctx中的主体填写实体的CreateUserId和UpdateUserId，create为true的时候填写两个字段，否则只填写UpdateUserId
+md可以是实体的指针或者实体数组，没有主体或者实体没有这些字段的时候不做处理
+返回是否填写了UpdateUserId
+*/
+func (this *OrmBaseService) stampUser(md interface{}, create bool) bool {
+	principal := GetPrincipal(this.ctx)
+	if principal == nil || principal.UserId == "" {
+		return false
+	}
+	mds := reflect.ToArray(md)
+	if mds == nil {
+		mds = []interface{}{md}
+	}
+	stamped := false
+	for _, m := range mds {
+		if !reflect.IsPtr(m) {
+			continue
+		}
+		if create {
+			reflect.SetValue(m, baseentity.FieldName_CreateUserId, principal.UserId)
+		}
+		if reflect.SetValue(m, baseentity.FieldName_UpdateUserId, principal.UserId) == nil {
+			stamped = true
+		}
+	}
+
+	return stamped
+}
+
+// 指定了更新的字段的时候加上UpdateUserId，否则填写的值不会被更新，返回新的切片，不修改调用者的columns
+func withUpdateUser(columns []string) []string {
+	if columns == nil || len(columns) == 0 {
+		return columns
+	}
+	for _, column := range columns {
+		if strings.EqualFold(strings.ReplaceAll(column, "_", ""), baseentity.FieldName_UpdateUserId) {
+			return columns
+		}
+	}
+
+	return append(append(make([]string, 0, len(columns)+1), columns...), baseentity.FieldName_UpdateUserId)
+}
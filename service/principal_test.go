@@ -0,0 +1,26 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWithUpdateUser(t *testing.T) {
+	// 调用者的切片还有容量的时候，追加的字段不能写到调用者的底层数组
+	columns := append(make([]string, 0, 4), "Name")
+	result := withUpdateUser(columns)
+	if fmt.Sprint(result) != "[Name UpdateUserId]" {
+		t.Fatalf("columns: %v", result)
+	}
+	other := append(columns, "Rank")
+	if fmt.Sprint(result) != "[Name UpdateUserId]" || fmt.Sprint(other) != "[Name Rank]" {
+		t.Fatalf("shared array: %v %v", result, other)
+	}
+	result = withUpdateUser([]string{"update_user_id"})
+	if fmt.Sprint(result) != "[update_user_id]" {
+		t.Fatalf("existing: %v", result)
+	}
+	if withUpdateUser(nil) != nil {
+		t.Fatalf("nil columns")
+	}
+}
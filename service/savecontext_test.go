@@ -0,0 +1,121 @@
+package service
+
+import (
+	"testing"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+type ctxChild struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	Name                  string `xorm:"varchar(32)"`
+}
+
+func (ctxChild) TableName() string {
+	return "test_ctx_child"
+}
+
+type ctxParent struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	Name                  string      `xorm:"varchar(32)"`
+	Note                  string      `xorm:"varchar(32)"`
+	Children              []*ctxChild `xorm:"-" gorm:"-" json:"-"`
+}
+
+func (ctxParent) TableName() string {
+	return "test_ctx_parent"
+}
+
+func TestSaveContext(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		parents := newTestService(t, dbName, new(ctxParent))
+		children := newTestService(t, dbName, new(ctxChild))
+		parent := &ctxParent{Name: "p", Note: "n"}
+		parent.Id = 1
+		child := &ctxChild{Name: "c"}
+		child.Id = 2
+		_, err := parents.Insert(parent)
+		if err != nil {
+			t.Fatalf("insert parent: %v", err)
+		}
+		_, err = children.Insert(child)
+		if err != nil {
+			t.Fatalf("insert child: %v", err)
+		}
+		getParent := func() *ctxParent {
+			got := &ctxParent{}
+			got.Id = 1
+			found, err := parents.Get(got, false, "", "")
+			if err != nil || !found {
+				t.Fatalf("get parent: %v %v", found, err)
+			}
+			return got
+		}
+		getChild := func() (*ctxChild, bool) {
+			got := &ctxChild{}
+			got.Id = 2
+			found, err := children.Get(got, false, "", "")
+			if err != nil {
+				t.Fatalf("get child: %v", err)
+			}
+			return got, found
+		}
+		root := getParent()
+		ec := baseentity.BuildEntityContext(root)
+		// 在工作单元之外读取的子实体，已经有id，修改而不是重复新增
+		attached, _ := getChild()
+		attached.Name = "c2"
+		root.Children = append(root.Children, attached)
+		affected, err := parents.SaveContext(ec)
+		if err != nil || affected != 1 {
+			t.Fatalf("save attached: %v %v", affected, err)
+		}
+		if got, _ := getChild(); got.Name != "c2" {
+			t.Fatalf("attached child: %+v", got)
+		}
+		count, err := children.Count(new(ctxChild), "")
+		if err != nil || count != 1 {
+			t.Fatalf("child count: %v %v", count, err)
+		}
+		// 只修改改过的字段，其他会话修改的字段不被覆盖
+		other := getParent()
+		other.Note = "other"
+		_, err = parents.Update(other, []string{"Note"}, "")
+		if err != nil {
+			t.Fatalf("update other: %v", err)
+		}
+		root.Name = "p2"
+		diffs, err := ec.GetSyncInfo()
+		if err != nil || len(diffs) != 1 || diffs[0].State() != baseentity.EntityState_Modified || len(diffs[0].Columns()) != 1 || diffs[0].Columns()[0] != "Name" {
+			t.Fatalf("diffs: %v %v", diffs, err)
+		}
+		_, err = parents.SaveContext(ec)
+		if err != nil {
+			t.Fatalf("save columns: %v", err)
+		}
+		if got := getParent(); got.Name != "p2" || got.Note != "other" {
+			t.Fatalf("columns: %+v", got)
+		}
+		// 从对象图中移走的子实体删除
+		root.Children = nil
+		affected, err = parents.SaveContext(ec)
+		if err != nil || affected != 1 {
+			t.Fatalf("save removed: %v %v", affected, err)
+		}
+		if _, found := getChild(); found {
+			t.Fatalf("removed child not deleted")
+		}
+		// 状态为Deleted的实体删除
+		root.State = baseentity.EntityState_Deleted
+		_, err = parents.SaveContext(ec)
+		if err != nil {
+			t.Fatalf("save deleted: %v", err)
+		}
+		rows := make([]*ctxParent, 0)
+		err = parents.FindByCriteria(&rows, nil, repository.Sort("id", false), 0, 0)
+		if err != nil || len(rows) != 0 {
+			t.Fatalf("deleted root: %v %v", idsOf(rows), err)
+		}
+	})
+}
@@ -50,34 +50,35 @@ func (this *SequenceService) NewEntities(data []byte) (interface{}, error) {
 }
 
 func (this *SequenceService) GetSeqValue(name string) (uint64, error) {
-	affected, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
-		seq := &entity.Sequence{Name: name}
-		ok, err := session.Get(seq, true, "", "")
-		if !ok || err != nil {
-			return 0, err
-		}
-		var nextVal uint64
-		if ok {
-			if seq.Increment == 0 {
-				seq.Increment = 1
-			}
-			nextVal = seq.CurrentVal + seq.Increment
-			if nextVal < seq.MinValue {
-				nextVal = seq.MinValue
-			}
-			seq.CurrentVal = nextVal
-			_, err = session.Update(seq, nil, "")
-		}
-		return nextVal, err
+	result, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
+		return nextSeqValue(session, name)
 	})
 	if err != nil {
 		return 0, err
 	}
-	if affected == nil || affected == 0 {
-		return 0, nil
+	nextVal, _ := result.(uint64)
+
+	return nextVal, nil
+}
+
+// 在session的事务中加锁读取序列并且增加一个步长，序列不存在的时候返回0
+func nextSeqValue(session repository.DbSession, name string) (uint64, error) {
+	seq := &entity.Sequence{Name: name}
+	ok, err := session.Get(seq, true, "", "")
+	if !ok || err != nil {
+		return 0, err
+	}
+	if seq.Increment == 0 {
+		seq.Increment = 1
+	}
+	nextVal := seq.CurrentVal + seq.Increment
+	if nextVal < seq.MinValue {
+		nextVal = seq.MinValue
 	}
+	seq.CurrentVal = nextVal
+	_, err = session.Update(seq, nil, "")
 
-	return affected.(uint64), nil
+	return nextVal, err
 }
 
 func (this *SequenceService) CreateSeq(name string, increment uint64, minValue uint64) int64 {
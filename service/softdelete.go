@@ -0,0 +1,141 @@
+package service
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/repository"
+	"github.com/curltech/go-colla-core/util/reflect"
+	"github.com/curltech/go-colla-core/util/scheduler"
+	"github.com/robfig/cron"
+	"time"
+)
+
+/*
+*
+和Find相同，但是包括已经软删除的记录，软删除的实体见repository.DeletedField
+*/
+func (this *OrmBaseService) FindWithDeleted(rowsSlicePtr interface{}, condiBean interface{}, orderby string, from int, limit int, conds string, params ...interface{}) error {
+	var err error
+	if !reflect.IsPtr(rowsSlicePtr) {
+		err = errors.New("ResultNeedPtr")
+
+		return err
+	}
+	if condiBean != nil && !reflect.IsPtr(condiBean) {
+		err = errors.New("CondiBeanNeedPtr")
+
+		return err
+	}
+	err = encryptConds(condiBean)
+	if err != nil {
+		return err
+	}
+	_, err = this.read(false, func(session repository.DbSession) (interface{}, error) {
+		err = session.Unscoped().Find(rowsSlicePtr, condiBean, orderby, from, limit, conds, params...)
+
+		return nil, err
+	})
+	decryptEntity(condiBean)
+
+	return decryptResult(rowsSlicePtr, err)
+}
+
+// 恢复已经软删除的记录，按照id清除删除时间
+func (this *OrmBaseService) Restore(mds ...interface{}) (int64, error) {
+	for _, md := range mds {
+		if !reflect.IsPtr(md) {
+			return 0, errors.New("DestinationNeedPtr")
+		}
+		_, name := repository.DeletedField(md)
+		if name == "" {
+			return 0, errors.New("NotSoftDelete")
+		}
+		_, ok := repository.GetId(md)
+		if !ok {
+			return 0, errors.New("NoId")
+		}
+	}
+	auditor := this.newAuditor(mds...)
+	affected, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
+		var affected int64
+		session = session.Unscoped()
+		for _, md := range mds {
+			olds := auditor.before(session, md)
+			_, name := repository.DeletedField(md)
+			repository.SetDeleted(md, nil)
+			n, err := session.Update(md, []string{name}, "")
+			if err != nil {
+				return affected, err
+			}
+			affected = affected + n
+			err = auditor.record(session, entity.AuditOperation_Update, olds, md)
+			if err != nil {
+				return affected, err
+			}
+		}
+		return affected, nil
+	})
+	if affected == nil {
+		return 0, err
+	}
+
+	return affected.(int64), err
+}
+
+/*
+*
+物理删除软删除的时间早于olderThan之前的记录，实体由FactNewEntity创建
+*/
+func (this *OrmBaseService) Purge(olderThan time.Duration) (int64, error) {
+	md, err := this.NewEntity(nil)
+	if err != nil {
+		return 0, err
+	}
+	_, name := repository.DeletedField(md)
+	if name == "" {
+		return 0, errors.New("NotSoftDelete")
+	}
+	criteria := repository.Lt(name, time.Now().Add(-olderThan))
+	auditor := this.newAuditor(md)
+	affected, err := this.Transaction(func(session repository.DbSession) (interface{}, error) {
+		session = session.Unscoped()
+		olds, err := auditor.find(session, md, func(rowsSlicePtr interface{}) error {
+			return session.FindByCriteria(rowsSlicePtr, md, criteria, 0, 0)
+		})
+		if err != nil {
+			return nil, err
+		}
+		affected, err := session.DeleteByCriteria(md, criteria)
+		if err != nil {
+			return affected, err
+		}
+		err = auditor.record(session, entity.AuditOperation_Delete, olds, olds)
+
+		return affected, err
+	})
+	if affected == nil {
+		return 0, err
+	}
+
+	return affected.(int64), err
+}
+
+/*
+*
+定时清理软删除的记录，spec是cron的表达式，比如每天凌晨三点清理三十天前删除的记录
+
+	svc.SchedulePurge("0 0 3 * * *", 30*24*time.Hour)
+
+返回的cron用于停止定时任务
+*/
+func (this *OrmBaseService) SchedulePurge(spec string, olderThan time.Duration) *cron.Cron {
+	return scheduler.RunCron(spec, func() {
+		affected, err := this.Purge(olderThan)
+		if err != nil {
+			logger.Sugar.Errorf("purge error:%v", err.Error())
+			return
+		}
+		logger.Sugar.Infof("purge soft deleted records:%v", affected)
+	}, nil)
+}
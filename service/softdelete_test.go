@@ -0,0 +1,85 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+type deletedRow struct {
+	baseentity.DeletedEntity `xorm:"extends"`
+	Name                     string `xorm:"varchar(32)"`
+}
+
+func (deletedRow) TableName() string {
+	return "test_deleted"
+}
+
+func TestSoftDelete(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(deletedRow))
+		svc.FactNewEntity = func(data []byte) (interface{}, error) { return new(deletedRow), nil }
+		for i := 1; i <= 3; i++ {
+			row := &deletedRow{Name: "row"}
+			row.Id = uint64(i)
+			_, err := svc.Insert(row)
+			if err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+		}
+		row := &deletedRow{}
+		row.Id = 1
+		affected, err := svc.Delete(row, "")
+		if err != nil || affected != 1 {
+			t.Fatalf("delete: %v %v", affected, err)
+		}
+		find := func() string {
+			rows := make([]*deletedRow, 0)
+			err := svc.FindByCriteria(&rows, nil, repository.Sort("id", false), 0, 0)
+			if err != nil {
+				t.Fatalf("find: %v", err)
+			}
+			return idsOf(rows)
+		}
+		if ids := find(); ids != "[2 3]" {
+			t.Fatalf("after delete: %v", ids)
+		}
+		got := &deletedRow{}
+		got.Id = 1
+		found, err := svc.Get(got, false, "", "")
+		if err != nil || found {
+			t.Fatalf("get deleted: %v %v", found, err)
+		}
+		rows := make([]*deletedRow, 0)
+		err = svc.FindWithDeleted(&rows, nil, "id", 0, 0, "")
+		if err != nil || idsOf(rows) != "[1 2 3]" || !repository.IsDeleted(rows[0]) || repository.IsDeleted(rows[1]) {
+			t.Fatalf("find with deleted: %v %v", err, idsOf(rows))
+		}
+		affected, err = svc.Restore(row)
+		if err != nil || affected != 1 || find() != "[1 2 3]" {
+			t.Fatalf("restore: %v %v %v", affected, err, find())
+		}
+		row = &deletedRow{}
+		row.Id = 2
+		_, err = svc.Delete(row, "")
+		if err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		// 删除的时间晚于一小时前，不清理
+		affected, err = svc.Purge(time.Hour)
+		if err != nil || affected != 0 {
+			t.Fatalf("purge recent: %v %v", affected, err)
+		}
+		affected, err = svc.Purge(-time.Minute)
+		if err != nil || affected != 1 {
+			t.Fatalf("purge: %v %v", affected, err)
+		}
+		rows = make([]*deletedRow, 0)
+		err = svc.FindWithDeleted(&rows, nil, "id", 0, 0, "")
+		if err != nil || idsOf(rows) != "[1 3]" {
+			t.Fatalf("after purge: %v %v", err, idsOf(rows))
+		}
+	})
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/repository"
+	"github.com/curltech/go-colla-core/util/reflect"
+	goreflect "reflect"
+	"sync"
+	"time"
+)
+
+// 状态变化的事件的主题，事件的Payload是*StatusTransition
+const EventTopic_StatusTransition = "StatusTransition"
+
+// 状态不允许从From变为To
+var ErrStatusTransition = errors.New("StatusTransitionNotAllowed")
+
+/*
+*
+状态变化的守卫，返回错误的时候不允许变化，md是要变化的实体
+*/
+type StatusGuard func(ctx context.Context, md interface{}, from string, to string) error
+
+// 一次状态的变化
+type StatusTransition struct {
+	From   string
+	To     string
+	Reason string
+	UserId string
+	Date   time.Time
+}
+
+/*
+*
+实体状态的状态机，登记允许的状态变化和守卫，空字符串表示还没有状态
+*/
+type StatusMachine struct {
+	transitions map[string]map[string][]StatusGuard
+}
+
+func NewStatusMachine() *StatusMachine {
+	return &StatusMachine{transitions: make(map[string]map[string][]StatusGuard)}
+}
+
+// 允许从from变为tos中的任何一个状态
+func (this *StatusMachine) Allow(from string, tos ...string) *StatusMachine {
+	m, ok := this.transitions[from]
+	if !ok {
+		m = make(map[string][]StatusGuard)
+		this.transitions[from] = m
+	}
+	for _, to := range tos {
+		_, ok = m[to]
+		if !ok {
+			m[to] = make([]StatusGuard, 0)
+		}
+	}
+
+	return this
+}
+
+// 增加从from变为to的守卫，这个变化必须已经允许
+func (this *StatusMachine) Guard(from string, to string, guard StatusGuard) *StatusMachine {
+	m, ok := this.transitions[from]
+	if !ok || m[to] == nil {
+		logger.Sugar.Errorf("status transition %v to %v not allowed, guard ignored", from, to)
+		return this
+	}
+	m[to] = append(m[to], guard)
+
+	return this
+}
+
+// 是否允许从from变为to，不检查守卫
+func (this *StatusMachine) Can(from string, to string) bool {
+	m, ok := this.transitions[from]
+	if !ok {
+		return false
+	}
+	_, ok = m[to]
+
+	return ok
+}
+
+// 检查从from变为to是否允许，并且执行所有的守卫
+func (this *StatusMachine) Check(ctx context.Context, md interface{}, from string, to string) error {
+	if !this.Can(from, to) {
+		return fmt.Errorf("%w: %v to %v", ErrStatusTransition, from, to)
+	}
+	for _, guard := range this.transitions[from][to] {
+		err := guard(ctx, md, from, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+*
+缺省的状态机，没有登记状态机的实体类型使用
+草稿提交审核，审核通过以后生效，生效以后可以过期，锁定，停用，取消，冲销或者合并
+*/
+func DefaultStatusMachine() *StatusMachine {
+	return NewStatusMachine().
+		Allow("", baseentity.EntityStatus_Draft, baseentity.EntityStatus_Effective).
+		Allow(baseentity.EntityStatus_Draft, baseentity.EntityStatus_Checking, baseentity.EntityStatus_Effective,
+			baseentity.EntityStatus_Canceled, baseentity.EntityStatus_Discarded).
+		Allow(baseentity.EntityStatus_Checking, baseentity.EntityStatus_Checked, baseentity.EntityStatus_Unchecked).
+		Allow(baseentity.EntityStatus_Unchecked, baseentity.EntityStatus_Draft, baseentity.EntityStatus_Discarded).
+		Allow(baseentity.EntityStatus_Checked, baseentity.EntityStatus_Effective, baseentity.EntityStatus_Draft).
+		Allow(baseentity.EntityStatus_Effective, baseentity.EntityStatus_Expired, baseentity.EntityStatus_Locked,
+			baseentity.EntityStatus_Disable, baseentity.EntityStatus_Canceled, baseentity.EntityStatus_Reversed,
+			baseentity.EntityStatus_Merged).
+		Allow(baseentity.EntityStatus_Locked, baseentity.EntityStatus_Effective).
+		Allow(baseentity.EntityStatus_Disable, baseentity.EntityStatus_Effective).
+		Allow(baseentity.EntityStatus_Expired, baseentity.EntityStatus_Discarded)
+}
+
+var defaultStatusMachine = DefaultStatusMachine()
+
+var statusMachines sync.Map
+
+/*
+*
+登记实体类型的状态机，md是实体的指针或者实体，比如RegistStatusMachine(new(entity.Contract), machine)
+*/
+func RegistStatusMachine(md interface{}, machine *StatusMachine) {
+	statusMachines.Store(indirectType(md), machine)
+}
+
+// 实体类型的状态机，没有登记的时候返回缺省的状态机
+func GetStatusMachine(md interface{}) *StatusMachine {
+	machine, ok := statusMachines.Load(indirectType(md))
+	if ok {
+		return machine.(*StatusMachine)
+	}
+
+	return defaultStatusMachine
+}
+
+func indirectType(md interface{}) goreflect.Type {
+	typ := goreflect.TypeOf(md)
+	for typ != nil && typ.Kind() == goreflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	return typ
+}
+
+/*
+*
+改变实体的状态，md是实体的指针，需要有id和StatusEntity的字段
+在事务中读取数据库中现在的状态，按照实体类型的状态机检查变化，然后修改Status，StatusReason和StatusDate
+提交以后发布EventTopic_StatusTransition事件，ctx中有外层事务的时候等外层事务提交以后发布
+*/
+func (this *OrmBaseService) TransitionStatus(md interface{}, to string, reason string) error {
+	if !reflect.IsPtr(md) {
+		return errors.New("DestinationNeedPtr")
+	}
+	_, err := reflect.GetValue(md, baseentity.FieldName_StatusDate)
+	if err != nil {
+		return errors.New("NotStatusEntity")
+	}
+	machine := GetStatusMachine(md)
+	transition := &StatusTransition{To: to, Reason: reason, Date: time.Now()}
+	principal := GetPrincipal(this.ctx)
+	if principal != nil {
+		transition.UserId = principal.UserId
+	}
+	// 失败的时候恢复实体原来的值，包括填写的修改人和修改时间
+	olds := make(map[string]interface{})
+	for _, name := range []string{baseentity.FieldName_Status, baseentity.FieldName_StatusReason, baseentity.FieldName_StatusDate,
+		baseentity.FieldName_UpdateUserId, baseentity.FieldName_UpdateDate} {
+		value, err := reflect.GetValue(md, name)
+		if err == nil {
+			olds[name] = value
+		}
+	}
+	columns := []string{baseentity.FieldName_Status, baseentity.FieldName_StatusReason, baseentity.FieldName_StatusDate}
+	if this.stampUser(md, false) {
+		columns = withUpdateUser(columns)
+	}
+	auditor := this.newAuditor(md)
+	lc := this.newLifecycle()
+	_, err = this.Transaction(func(session repository.DbSession) (interface{}, error) {
+		err := lc.check(session, baseentity.AuditOperation_Update, md)
+		if err != nil {
+			return nil, err
+		}
+		// 加锁读取现在的状态，并发的变化在这个事务提交之前不能修改状态
+		current := loadLocked(session, md, true)
+		if current == nil {
+			return nil, errors.New("NotExist")
+		}
+		from, _ := reflect.GetValue(current, baseentity.FieldName_Status)
+		transition.From, _ = from.(string)
+		err = machine.Check(this.Context(), md, transition.From, to)
+		if err != nil {
+			return nil, err
+		}
+		reflect.SetValue(md, baseentity.FieldName_Status, to)
+		reflect.SetValue(md, baseentity.FieldName_StatusReason, reason)
+		reflect.SetValue(md, baseentity.FieldName_StatusDate, &transition.Date)
+		err = baseentity.Validate(md, columns...)
+		if err != nil {
+			return nil, err
+		}
+		affected, err := lc.run(session, baseentity.AuditOperation_Update, md, func() (int64, error) {
+			return session.Update(md, columns, "")
+		})
+		if err != nil {
+			return nil, err
+		}
+		if affected == 0 {
+			return nil, errors.New("NotExist")
+		}
+		err = auditor.record(session, baseentity.AuditOperation_Update, []interface{}{current}, md)
+		return nil, err
+	})
+	lc.done(err)
+	if err != nil {
+		for name, value := range olds {
+			reflect.SetValue(md, name, value)
+		}
+		logger.Sugar.Errorf("%v", err.Error())
+		return err
+	}
+	this.afterCommit(func(ctx context.Context) {
+		Publish(ctx, &Event{Topic: EventTopic_StatusTransition, Entity: md, Payload: transition})
+	})
+
+	return nil
+}
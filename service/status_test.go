@@ -0,0 +1,72 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+)
+
+type statusRow struct {
+	baseentity.StatusEntity `xorm:"extends"`
+	UpdateUserId            string `xorm:"varchar(32)"`
+}
+
+func (statusRow) TableName() string {
+	return "test_status"
+}
+
+func TestTransitionStatus(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(statusRow))
+		row := &statusRow{}
+		row.Id = 1
+		row.Status = baseentity.EntityStatus_Draft
+		_, err := svc.Insert(row)
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		load := func() *statusRow {
+			got := &statusRow{}
+			got.Id = 1
+			found, err := svc.Get(got, false, "", "")
+			if err != nil || !found {
+				t.Fatalf("get: %v %v", found, err)
+			}
+			return got
+		}
+		first, second := load(), load()
+		user := svc.WithPrincipal(&Principal{UserId: "u1"})
+		err = user.TransitionStatus(first, baseentity.EntityStatus_Effective, "approved")
+		if err != nil {
+			t.Fatalf("transition: %v", err)
+		}
+		got := load()
+		if got.Status != baseentity.EntityStatus_Effective || got.StatusReason != "approved" || got.UpdateUserId != "u1" {
+			t.Fatalf("after transition: %+v", got)
+		}
+		// second还是草稿，但是检查的是数据库中现在的状态，生效以后不能提交审核
+		updateDate := second.UpdateDate
+		err = svc.WithPrincipal(&Principal{UserId: "u2"}).TransitionStatus(second, baseentity.EntityStatus_Checking, "check")
+		if err == nil {
+			t.Fatalf("transition from stale status")
+		}
+		if second.Status != baseentity.EntityStatus_Draft || second.StatusReason != "" || second.StatusDate != nil ||
+			second.UpdateUserId != "" || second.UpdateDate != updateDate {
+			t.Fatalf("not restored: %+v", second)
+		}
+		got = load()
+		if got.Status != baseentity.EntityStatus_Effective || got.UpdateUserId != "u1" {
+			t.Fatalf("failed transition wrote: %+v", got)
+		}
+		missing := &statusRow{}
+		missing.Id = 9
+		err = svc.TransitionStatus(missing, baseentity.EntityStatus_Effective, "")
+		if err == nil || err.Error() != "NotExist" {
+			t.Fatalf("missing: %v", err)
+		}
+		if time.Since(*got.StatusDate) > time.Minute {
+			t.Fatalf("status date: %v", got.StatusDate)
+		}
+	})
+}
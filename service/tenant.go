@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/curltech/go-colla-core/config"
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/repository"
+	"github.com/curltech/go-colla-core/util/reflect"
+	goreflect "reflect"
+)
+
+/*
+*
+请求的租户，由web层在请求开始的时候放到ctx中，没有的时候使用主体的TenantId，比如
+
+	ctx := service.WithTenant(r.Context(), &service.Tenant{TenantId: tenantId})
+	err := svc.WithContext(ctx).Find(&rows, nil, "", 0, 10, "")
+
+数据库配置database.tenant决定多租户的方式：
+column是共享表，实体嵌入TenantEntity，新增和修改的时候填写TenantId，Get，Find，Count，Update和Delete都加上TenantId的条件，
+没有租户的时候有TenantId的实体读不到任何租户的数据，新增和修改返回ErrNoTenant
+schema是每个租户一个schema，会话使用数据库<DbName>@<SchemaName>，SchemaName为空的时候使用TenantId
+后台任务和系统管理需要访问所有租户的数据的时候使用SystemTenant
+*/
+type Tenant struct {
+	TenantId   string
+	SchemaName string
+}
+
+// 租户的schema，没有设置的时候使用TenantId
+func (this *Tenant) Schema() string {
+	if this.SchemaName != "" {
+		return this.SchemaName
+	}
+
+	return this.TenantId
+}
+
+/*
+*
+系统租户，WithTenant(ctx, SystemTenant)以后不区分租户，可以访问所有租户的数据，比如
+
+	err := svc.WithTenant(service.SystemTenant).Find(&rows, nil, "", 0, 10, "")
+
+只比较指针，TenantId相同的其他Tenant不是系统租户
+*/
+var SystemTenant = &Tenant{}
+
+// column方式的时候，没有租户新增或者修改有TenantId的实体
+var ErrNoTenant = errors.New("NoTenant")
+
+type tenantKey struct{}
+
+// 返回带有租户的ctx
+func WithTenant(ctx context.Context, tenant *Tenant) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// ctx中的租户，没有的时候使用主体的TenantId，都没有的时候返回nil
+func GetTenant(ctx context.Context) *Tenant {
+	if ctx == nil {
+		return nil
+	}
+	tenant, _ := ctx.Value(tenantKey{}).(*Tenant)
+	if tenant != nil {
+		return tenant
+	}
+	principal := GetPrincipal(ctx)
+	if principal != nil && principal.TenantId != "" {
+		return &Tenant{TenantId: principal.TenantId}
+	}
+
+	return nil
+}
+
+// 返回使用租户的服务，和WithContext一样返回OrmBaseService的副本
+func (this *OrmBaseService) WithTenant(tenant *Tenant) BaseService {
+	s := *this
+	s.ctx = WithTenant(this.ctx, tenant)
+
+	return &s
+}
+
+/*
+*
+租户使用的数据库，schema方式的时候是<dbName>@<schema>，否则是dbName
+*/
+func TenantDbName(dbName string, tenant *Tenant) string {
+	if tenant == nil || tenant.Schema() == "" {
+		return dbName
+	}
+	if config.GetDatabaseParams(dbName).Tenant != config.Tenant_Schema {
+		return dbName
+	}
+
+	return dbName + "@" + tenant.Schema()
+}
+
+/*
+*
+在租户的schema中创建或者同步表，一般在开通租户的时候调用，column方式的时候和Sync相同
+*/
+func SyncTenant(dbName string, tenant *Tenant, beans ...interface{}) error {
+	session := GetDbSession(TenantDbName(dbName, tenant))
+	defer session.Close()
+
+	return session.Sync(beans...)
+}
+
+// 服务实际使用的数据库，按照ctx中的租户选择schema
+func (this *OrmBaseService) dbName() string {
+	return TenantDbName(this.DbName, GetTenant(this.ctx))
+}
+
+/*
+*
+column方式的时候ctx中的租户id，isolated表示是否需要按照租户隔离，
+不是column方式或者是系统租户的时候不需要隔离，需要隔离但是没有租户的时候tenantId是空字符串
+*/
+func (this *OrmBaseService) tenantId() (tenantId string, isolated bool) {
+	if config.GetDatabaseParams(this.DbName).Tenant != config.Tenant_Column {
+		return "", false
+	}
+	tenant := GetTenant(this.ctx)
+	if tenant == SystemTenant {
+		return "", false
+	}
+	if tenant == nil {
+		return "", true
+	}
+
+	return tenant.TenantId, true
+}
+
+// 会话加上租户的过滤条件和数据访问策略的条件
+func (this *OrmBaseService) scoped(session repository.DbSession) repository.DbSession {
+	filters := make([]repository.Filter, 0, 2)
+	for _, filter := range []repository.Filter{this.tenantFilter(), this.policyFilter()} {
+		if filter != nil {
+			filters = append(filters, filter)
+		}
+	}
+	if len(filters) == 0 {
+		return session
+	}
+
+	return session.Filter(filters...)
+}
+
+/*
+*
+column方式的租户的过滤条件，只对有TenantId字段的实体有效，不需要隔离的时候返回nil
+没有租户的时候只能访问TenantId为NULL的记录，不能访问任何租户的数据
+*/
+func (this *OrmBaseService) tenantFilter() repository.Filter {
+	tenantId, isolated := this.tenantId()
+	if !isolated {
+		return nil
+	}
+
+	return func(md interface{}) *repository.Criteria {
+		if !hasTenant(md) {
+			return nil
+		}
+		if tenantId == "" {
+			return repository.IsNull(baseentity.FieldName_TenantId)
+		}
+		return repository.Eq(baseentity.FieldName_TenantId, tenantId)
+	}
+}
+
+/*
+*
+新增和修改的时候用ctx中的租户填写实体的TenantId，覆盖实体原来的值，不能修改其他租户的数据
+md可以是实体的指针或者实体数组，需要隔离但是没有租户的时候返回ErrNoTenant
+*/
+func (this *OrmBaseService) stampTenant(md interface{}) error {
+	tenantId, isolated := this.tenantId()
+	if !isolated {
+		return nil
+	}
+	for _, m := range entities(md) {
+		if reflect.IsPtr(m) && hasTenant(m) {
+			if tenantId == "" {
+				logger.Sugar.Errorf("%T without tenant", m)
+				return ErrNoTenant
+			}
+			err := reflect.SetValue(m, baseentity.FieldName_TenantId, tenantId)
+			if err != nil {
+				logger.Sugar.Errorf("%v", err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasTenant(md interface{}) bool {
+	typ := indirectType(md)
+	if typ == nil || typ.Kind() != goreflect.Struct {
+		return false
+	}
+	field, ok := typ.FieldByName(baseentity.FieldName_TenantId)
+
+	return ok && field.Type.Kind() == goreflect.String
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+type tenantRow struct {
+	baseentity.TenantEntity `xorm:"extends"`
+	Name                    string `xorm:"varchar(32)"`
+}
+
+func (tenantRow) TableName() string {
+	return "test_tenant"
+}
+
+func TestTenantColumn(t *testing.T) {
+	svc := newTestService(t, "tenant", new(tenantRow))
+	a := svc.WithTenant(&Tenant{TenantId: "a"})
+	b := svc.WithTenant(&Tenant{TenantId: "b"})
+	for i, s := range []BaseService{a, b} {
+		row := &tenantRow{Name: "row"}
+		row.Id = uint64(i + 1)
+		_, err := s.Insert(row)
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	find := func(s BaseService) string {
+		rows := make([]*tenantRow, 0)
+		err := s.FindByCriteria(&rows, nil, repository.Sort("id", false), 0, 0)
+		if err != nil {
+			t.Fatalf("find: %v", err)
+		}
+		return idsOf(rows)
+	}
+	if find(a) != "[1]" || find(b) != "[2]" {
+		t.Fatalf("isolated: %v %v", find(a), find(b))
+	}
+	// 没有租户的时候读不到任何租户的数据，也不能写
+	if ids := find(svc); ids != "[]" {
+		t.Fatalf("no tenant find: %v", ids)
+	}
+	row := &tenantRow{}
+	row.Id = 1
+	found, err := svc.Get(row, false, "", "")
+	if err != nil || found {
+		t.Fatalf("no tenant get: %v %v", found, err)
+	}
+	row = &tenantRow{Name: "new"}
+	row.Id = 3
+	_, err = svc.Insert(row)
+	if !errors.Is(err, ErrNoTenant) {
+		t.Fatalf("no tenant insert: %v", err)
+	}
+	row.Id = 1
+	_, err = svc.Update(row, []string{"Name"}, "")
+	if !errors.Is(err, ErrNoTenant) {
+		t.Fatalf("no tenant update: %v", err)
+	}
+	_, _, err = svc.UpsertBatch([]interface{}{row}, []string{"id"}, nil)
+	if !errors.Is(err, ErrNoTenant) {
+		t.Fatalf("no tenant upsert: %v", err)
+	}
+	affected, err := svc.Delete(row, "")
+	if err != nil || affected != 0 {
+		t.Fatalf("no tenant delete: %v %v", affected, err)
+	}
+	// 其他租户的记录不能修改
+	row = &tenantRow{}
+	row.Id = 2
+	affected, err = a.Delete(row, "")
+	if err != nil || affected != 0 {
+		t.Fatalf("cross tenant delete: %v %v", affected, err)
+	}
+	// 系统租户访问所有租户的数据
+	system := svc.WithTenant(SystemTenant)
+	if ids := find(system); ids != "[1 2]" {
+		t.Fatalf("system find: %v", ids)
+	}
+	if ids := find(svc.WithTenant(&Tenant{})); ids != "[]" {
+		t.Fatalf("empty tenant find: %v", ids)
+	}
+	affected, err = system.Delete(row, "")
+	if err != nil || affected != 1 {
+		t.Fatalf("system delete: %v %v", affected, err)
+	}
+}
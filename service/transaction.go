@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+// ctx中事务的键，每个命名数据库有自己的事务
+type txKey struct {
+	dbName string
+}
+
+// ctx中的事务，同一个事务只能在一个协程中使用
+type txState struct {
+	session      repository.DbSession
+	savepoints   int
+	rollbackOnly bool                        //不支持保存点的时候，嵌套的处理失败以后整个事务只能回滚
+	afterCommit  []func(ctx context.Context) //最外层的事务提交以后执行
+	finally      []func(ctx context.Context) //最外层的事务结束以后执行，提交和回滚都执行
+}
+
+func getTxState(ctx context.Context, dbName string) *txState {
+	if ctx == nil {
+		return nil
+	}
+	state, ok := ctx.Value(txKey{dbName: dbName}).(*txState)
+	if !ok {
+		return nil
+	}
+
+	return state
+}
+
+// 去掉ctx中这些数据库的事务，保留ctx的其他值，使用返回的ctx的服务开始新的事务
+func withoutTx(ctx context.Context, dbNames ...string) context.Context {
+	for _, dbName := range dbNames {
+		if getTxState(ctx, dbName) != nil {
+			ctx = context.WithValue(ctx, txKey{dbName: dbName}, (*txState)(nil))
+		}
+	}
+
+	return ctx
+}
+
+/*
+*
+在已有的事务中执行，支持保存点的会话使用保存点，fc失败的时候只回滚到保存点，
+否则直接加入已有的事务，fc失败的时候整个事务只能回滚
+*/
+func (this *txState) nest(fc func(s repository.DbSession) (interface{}, error)) (result interface{}, err error) {
+	// 回滚的处理登记的提交以后的处理也要去掉
+	n := len(this.afterCommit)
+	defer func() {
+		if err != nil {
+			this.afterCommit = this.afterCommit[:n]
+		}
+	}()
+	sp, ok := this.session.(repository.Savepointer)
+	if !ok {
+		result, err = fc(this.session)
+		if err != nil {
+			this.rollbackOnly = true
+		}
+		return result, err
+	}
+	this.savepoints++
+	name := fmt.Sprintf("sp_%v", this.savepoints)
+	err = sp.Savepoint(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			logger.Sugar.Errorf("recover rollback to savepoint:%v", name)
+			sp.RollbackTo(name)
+			panic(p) // re-throw panic after Rollback
+		} else if err != nil {
+			logger.Sugar.Errorf("error rollback to savepoint:%v", name)
+			e := sp.RollbackTo(name)
+			if e != nil {
+				logger.Sugar.Errorf("%v", e.Error())
+			}
+		} else {
+			err = sp.ReleaseSavepoint(name)
+		}
+	}()
+	result, err = fc(this.session)
+
+	return result, err
+}
+
+/*
+*
+在事务中执行fn，fn收到的ctx携带事务，在fn中使用WithContext(ctx)的服务都加入这个事务，比如
+
+	err := userService.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, err := userService.WithContext(ctx).Insert(user)
+		if err != nil {
+			return err
+		}
+		_, err = orgService.WithContext(ctx).Save(org)
+		return err
+	})
+
+ctx中已经有这个数据库的事务的时候加入已有的事务，并且使用保存点，fn失败的时候只回滚fn的修改
+fn返回错误或者panic的时候回滚，否则提交，提交以后才调用事务中登记的AfterCommit钩子和实体的事件
+bolt不支持保存点，fn失败的时候整个事务只能回滚
+*/
+func (this *OrmBaseService) RunInTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s := *this
+	s.ctx = ctx
+	dbName := s.dbName()
+	state := getTxState(ctx, dbName)
+	if state != nil {
+		_, err := state.nest(func(s repository.DbSession) (interface{}, error) {
+			return nil, fn(ctx)
+		})
+		return err
+	}
+	state = &txState{}
+	_, err := s.Transaction(func(session repository.DbSession) (interface{}, error) {
+		state.session = session
+		err := fn(context.WithValue(ctx, txKey{dbName: dbName}, state))
+		if err == nil && state.rollbackOnly {
+			err = errors.New("TransactionRollbackOnly")
+		}
+		return nil, err
+	})
+	for _, fc := range state.finally {
+		fc(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	for _, fc := range state.afterCommit {
+		fc(ctx)
+	}
+
+	return nil
+}
+
+// 在缺省数据库的事务中执行fn
+func RunInTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return GetOrmBaseService().RunInTransaction(ctx, fn)
+}
+
+/*
+*
+乐观锁冲突的时候重试，fn返回包装了repository.ErrStaleEntity的错误时重新执行，最多执行attempts次
+fn每次都需要重新读取实体，再修改和更新，比如
+
+	err := service.RetryOnStale(3, func() error {
+		return svc.RunInTransaction(ctx, func(ctx context.Context) error {
+			org := &entity.Org{}
+			_, err := svc.WithContext(ctx).Get(org, false, "", "id = ?", id)
+			if err != nil {
+				return err
+			}
+			org.Name = name
+			_, err = svc.WithContext(ctx).Update(org, nil, "")
+			return err
+		})
+	})
+
+在外层事务中冲突的时候，fn的修改已经回滚到保存点，重试仍然在外层事务中，看不到其他事务提交以后的版本号，
+所以重试应该在事务的最外层
+*/
+func RetryOnStale(attempts int, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = fn()
+		if !errors.Is(err, repository.ErrStaleEntity) {
+			return err
+		}
+		logger.Sugar.Warnf("stale entity, retry %v:%v", i+1, err.Error())
+	}
+
+	return err
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunInTransactionNested(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(pageRow))
+		failure := errors.New("inner")
+		insert := func(ctx context.Context, id uint64) error {
+			row := &pageRow{Rank: int(id)}
+			row.Id = id
+			_, err := svc.WithContext(ctx).Insert(row)
+			return err
+		}
+		err := svc.RunInTransaction(context.Background(), func(ctx context.Context) error {
+			err := insert(ctx, 1)
+			if err != nil {
+				return err
+			}
+			err = svc.RunInTransaction(ctx, func(ctx context.Context) error {
+				err := insert(ctx, 2)
+				if err != nil {
+					return err
+				}
+				return failure
+			})
+			if !errors.Is(err, failure) {
+				t.Fatalf("inner: %v", err)
+			}
+			return insert(ctx, 3)
+		})
+		rows := make([]*pageRow, 0)
+		svc.FindByCriteria(&rows, nil, nil, 0, 0)
+		if dbName == "bolt" {
+			// 不支持保存点，内层失败以后整个事务回滚
+			if err == nil || err.Error() != "TransactionRollbackOnly" || len(rows) != 0 {
+				t.Fatalf("rollback only: %v %v", err, idsOf(rows))
+			}
+			return
+		}
+		if err != nil || idsOf(rows) != "[1 3]" {
+			t.Fatalf("savepoint: %v %v", err, idsOf(rows))
+		}
+	})
+}
+
+func TestSeqInTransaction(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(pageRow))
+		failure := errors.New("rollback")
+		var rolledBack uint64
+		err := svc.RunInTransaction(context.Background(), func(ctx context.Context) error {
+			row := &pageRow{Rank: 1}
+			_, err := svc.WithContext(ctx).Insert(row)
+			if err != nil {
+				return err
+			}
+			rolledBack = row.Id
+			return failure
+		})
+		if !errors.Is(err, failure) || rolledBack == 0 {
+			t.Fatalf("rollback: %v %v", err, rolledBack)
+		}
+		ids := make(map[uint64]bool)
+		err = svc.RunInTransaction(context.Background(), func(ctx context.Context) error {
+			row := &pageRow{}
+			row.Id = 1 << 40
+			_, err := svc.WithContext(ctx).Insert(row)
+			if err != nil {
+				return err
+			}
+			ids[row.Id] = true
+			// 缓存中的id不够，事务中已经有写操作的时候再取序列
+			for _, id := range svc.WithContext(ctx).GetSeqs(1000) {
+				if id == 0 || ids[id] {
+					t.Fatalf("duplicate seq: %v", id)
+				}
+				ids[id] = true
+			}
+			for i := 0; i < 2; i++ {
+				row := &pageRow{Rank: i}
+				_, err := svc.WithContext(ctx).Insert(row)
+				if err != nil {
+					return err
+				}
+				if row.Id == 0 || ids[row.Id] {
+					t.Fatalf("duplicate id: %v", row.Id)
+				}
+				ids[row.Id] = true
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		count, err := svc.CountByCriteria(new(pageRow), nil)
+		if err != nil || count != 3 {
+			t.Fatalf("count: %v %v", count, err)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+type upsertRow struct {
+	baseentity.DeletedEntity `xorm:"extends"`
+	Name                     string `xorm:"varchar(32)"`
+}
+
+func (upsertRow) TableName() string {
+	return "test_upsert"
+}
+
+func newUpsertRow(id uint64, name string) *upsertRow {
+	row := &upsertRow{Name: name}
+	row.Id = id
+	return row
+}
+
+func TestUpsertBatch(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(upsertRow))
+		_, err := svc.Insert(newUpsertRow(1, "a"), newUpsertRow(2, "b"))
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		_, err = svc.Delete(newUpsertRow(2, ""), "")
+		if err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		start := time.Now().Add(-time.Second)
+		mds := []interface{}{newUpsertRow(1, "a2"), newUpsertRow(2, "b2"), newUpsertRow(3, "c")}
+		inserted, updated, err := svc.UpsertBatch(mds, []string{"id"}, nil)
+		if err != nil || inserted != 1 || updated != 2 {
+			t.Fatalf("upsert: %v %v %v", inserted, updated, err)
+		}
+		// 软删除的记录恢复
+		rows := make([]*upsertRow, 0)
+		err = svc.FindByCriteria(&rows, nil, repository.Sort("id", false), 0, 0)
+		if err != nil || idsOf(rows) != "[1 2 3]" {
+			t.Fatalf("find: %v %v", err, idsOf(rows))
+		}
+		names := make([]string, len(rows))
+		for i, row := range rows {
+			names[i] = row.Name
+			if repository.IsDeleted(row) {
+				t.Fatalf("still deleted: %v", row.Id)
+			}
+		}
+		if fmt.Sprint(names) != "[a2 b2 c]" {
+			t.Fatalf("names: %v", names)
+		}
+		// 修改时间总是修改
+		if rows[0].UpdateDate == nil || rows[0].UpdateDate.Before(start) {
+			t.Fatalf("update date: %v", rows[0].UpdateDate)
+		}
+		inserted, updated, err = svc.UpsertBatch([]interface{}{newUpsertRow(1, "a3")}, []string{"id"}, []string{"Name"})
+		if err != nil || inserted != 0 || updated != 1 {
+			t.Fatalf("upsert columns: %v %v %v", inserted, updated, err)
+		}
+		// 一批中冲突键重复的时候拒绝整批，不修改任何记录
+		mds = []interface{}{newUpsertRow(4, "d"), newUpsertRow(1, "a4"), newUpsertRow(4, "d2")}
+		inserted, updated, err = svc.UpsertBatch(mds, []string{"id"}, nil)
+		if !errors.Is(err, repository.ErrDuplicateConflictKey) || inserted != 0 || updated != 0 {
+			t.Fatalf("duplicate conflict key: %v %v %v", inserted, updated, err)
+		}
+		rows = make([]*upsertRow, 0)
+		err = svc.FindByCriteria(&rows, nil, repository.Sort("id", false), 0, 0)
+		if err != nil || idsOf(rows) != "[1 2 3]" || rows[0].Name != "a3" {
+			t.Fatalf("after duplicate: %v %v", err, idsOf(rows))
+		}
+	})
+}
+
+func TestSaveCount(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(upsertRow))
+		_, err := svc.Insert(newUpsertRow(1, "a"), newUpsertRow(2, "b"))
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		added := newUpsertRow(3, "c")
+		added.State = baseentity.EntityState_New
+		modified := newUpsertRow(1, "a2")
+		modified.State = baseentity.EntityState_Modified
+		deleted := newUpsertRow(2, "")
+		deleted.State = baseentity.EntityState_Deleted
+		// 每条记录的影响数累加
+		affected, err := svc.Save(added, modified, deleted)
+		if err != nil || affected != 3 {
+			t.Fatalf("save: %v %v", affected, err)
+		}
+		rows := make([]*upsertRow, 0)
+		err = svc.FindByCriteria(&rows, nil, repository.Sort("id", false), 0, 0)
+		if err != nil || idsOf(rows) != "[1 3]" || rows[0].Name != "a2" {
+			t.Fatalf("find: %v %v", err, idsOf(rows))
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-core/repository"
+)
+
+type versionRow struct {
+	baseentity.VersionEntity `xorm:"extends"`
+	Name                     string `xorm:"varchar(32)"`
+}
+
+func (versionRow) TableName() string {
+	return "test_version"
+}
+
+func TestOptimisticLock(t *testing.T) {
+	forEachDb(t, func(t *testing.T, dbName string) {
+		svc := newTestService(t, dbName, new(versionRow))
+		row := &versionRow{Name: "a"}
+		row.Id = 1
+		_, err := svc.Insert(row)
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		load := func() *versionRow {
+			got := &versionRow{}
+			got.Id = 1
+			found, err := svc.Get(got, false, "", "")
+			if err != nil || !found {
+				t.Fatalf("get: %v %v", found, err)
+			}
+			return got
+		}
+		first, second := load(), load()
+		if first.Version != 1 {
+			t.Fatalf("initial version: %v", first.Version)
+		}
+		first.Name = "b"
+		_, err = svc.Update(first, []string{"Name"}, "")
+		if err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		second.Name = "c"
+		_, err = svc.Update(second, []string{"Name"}, "")
+		if !errors.Is(err, repository.ErrStaleEntity) {
+			t.Fatalf("stale update: %v", err)
+		}
+		// 第一次使用过期的实体，重试的时候重新读取
+		attempts := 0
+		err = RetryOnStale(3, func() error {
+			attempts++
+			row := second
+			if attempts > 1 {
+				row = load()
+			}
+			row.Name = "c"
+			_, err := svc.Update(row, []string{"Name"}, "")
+			return err
+		})
+		if err != nil || attempts != 2 {
+			t.Fatalf("retry: %v %v", err, attempts)
+		}
+		got := load()
+		if got.Name != "c" || got.Version != 3 {
+			t.Fatalf("after retry: %+v", got)
+		}
+		err = RetryOnStale(2, func() error {
+			_, err := svc.Update(second, []string{"Name"}, "")
+			return err
+		})
+		if !errors.Is(err, repository.ErrStaleEntity) {
+			t.Fatalf("retry exhausted: %v", err)
+		}
+	})
+}
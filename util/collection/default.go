@@ -54,10 +54,14 @@ func StructToMap(obj interface{}, options *MapOptions) map[string]interface{} {
 						if f.Len() == 0 {
 							continue
 						}
-					case reflect.Ptr, reflect.Interface, reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+					case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
 						if f.IsNil() {
 							continue
 						}
+					case reflect.Struct, reflect.Array:
+						if f.IsZero() {
+							continue
+						}
 					case reflect.Int, reflect.Float64, reflect.Int64, reflect.Uint, reflect.Uint64:
 						if f.IsZero() {
 							continue